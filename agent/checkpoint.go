@@ -0,0 +1,424 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+const (
+	defaultCheckpointInterval = time.Minute
+	checkpointFile            = "checkpoint.json"
+)
+
+// Checkpoint describes the scan of a run, its open ports and probe results
+// are saved next to it as they're found
+type Checkpoint struct {
+	RunID string `json:"run_id"`
+	// Scan names the objects of the scan, every scan that isn't resumed has
+	// its own
+	Scan    string `json:"scan"`
+	Scanner string `json:"scanner"`
+	// Spec is the scan without its adapters, a resumed scan keeps its
+	// targets, ports, seed and shard
+	Spec      Spec      `json:"spec"`
+	Done      bool      `json:"done"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Checkpointer saves the progress of a scan to a store while it runs, and
+// resumes it on another container or instance: masscan from the resume-index
+// of its paused.conf, the other scanners from the start with the same seed.
+// The open ports and probe results of every attempt are merged without
+// duplicates
+type Checkpointer struct {
+	Store CheckpointStore
+	RunID string
+	// Resume continues the scan checkpointed by the run, otherwise a new scan
+	// is started
+	Resume bool
+	// Interval is how often the open ports and probe results are saved
+	Interval time.Duration
+	// Logf gets the progress of the checkpoints
+	Logf func(format string, args ...interface{})
+
+	mu         sync.Mutex
+	checkpoint Checkpoint
+	attempt    string
+	parts      int
+	open       map[string]bool
+	probed     map[string]bool
+	newOpen    bytes.Buffer
+	newProbes  bytes.Buffer
+}
+
+// Run runs the scan, through the pipeline when it's not nil. open and result
+// get the open ports and probe results of the previous attempts first
+func (c *Checkpointer) Run(ctx context.Context, scanner PortScanner, pipeline *Pipeline, spec Spec, open func(OpenPort), result func(ProbeResult)) error {
+	c.open = make(map[string]bool)
+	c.probed = make(map[string]bool)
+	// the parts of every attempt are kept in the order of the attempts, the
+	// random suffix keeps apart the attempts started at the same time
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	c.attempt = fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102T150405.000000"), suffix)
+
+	var found []OpenPort
+	var probes []ProbeResult
+	var paused []byte
+	if c.Resume {
+		var err error
+		if found, probes, paused, err = c.load(ctx, scanner.Name(), &spec); err != nil {
+			return err
+		}
+		c.logf("resuming scan %s of run %s, %d open ports and %d probe results so far", c.checkpoint.Scan, c.RunID, len(found), len(probes))
+	} else {
+		// a resumed scan needs the seed the scan started with
+		for spec.Seed == 0 {
+			var b [8]byte
+			rand.Read(b[:])
+			spec.Seed = int64(binary.LittleEndian.Uint64(b[:]) >> 1)
+		}
+		c.checkpoint = Checkpoint{
+			RunID:   c.RunID,
+			Scan:    c.attempt,
+			Scanner: scanner.Name(),
+			Spec:    spec,
+		}
+		c.checkpoint.Spec.Adapters = nil
+		if err := c.saveCheckpoint(ctx); err != nil {
+			return fmt.Errorf("failed to save checkpoint of run %s: %s", c.RunID, err.Error())
+		}
+	}
+
+	for _, port := range found {
+		c.open[port.HostPort()] = true
+		open(port)
+	}
+	for _, r := range probes {
+		c.probed[probeKey(r)] = true
+		result(r)
+	}
+	if c.checkpoint.Done {
+		c.logf("scan %s of run %s is done", c.checkpoint.Scan, c.RunID)
+		return nil
+	}
+
+	m, isMasscan := scanner.(*Masscan)
+	if isMasscan && paused != nil {
+		index, err := masscan.ParsePaused(paused)
+		if err != nil {
+			return err
+		}
+		m.ResumeIndex = index
+		c.logf("masscan resumes from index %d", index)
+	}
+
+	wrapped := &checkpointScanner{PortScanner: scanner, c: c}
+	if pipeline != nil {
+		// the open ports that weren't probed are probed first
+		for _, port := range found {
+			if !c.probed[port.HostPort()] && !c.probed[unbracket(port.IP)] {
+				wrapped.pending = append(wrapped.pending, port)
+			}
+		}
+	}
+
+	stopSaving := c.saveEvery(c.Interval)
+	recordOpen := func(port OpenPort) {
+		if c.recordOpen(port) {
+			open(port)
+		}
+	}
+	var err error
+	if pipeline != nil {
+		pipeline.Scanner = wrapped
+		err = pipeline.Run(ctx, spec, recordOpen, func(r ProbeResult) {
+			c.recordProbe(r)
+			result(r)
+		})
+	} else {
+		err = wrapped.Scan(ctx, spec, recordOpen)
+	}
+	stopSaving()
+
+	// ctx is done when the scan was interrupted, the checkpoint is saved anyway
+	saveCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if isMasscan {
+		if paused, perr := m.Paused(); perr != nil {
+			c.logf("failed to read paused.conf: %s", perr.Error())
+		} else if paused != nil {
+			if perr := c.Store.Put(saveCtx, path.Join(c.checkpoint.Scan, "paused.conf"), paused); perr != nil {
+				c.logf("failed to save paused.conf: %s", perr.Error())
+			}
+		}
+	}
+	c.checkpoint.Done = err == nil
+	if serr := c.save(saveCtx); serr != nil {
+		c.logf("failed to save checkpoint of run %s: %s", c.RunID, serr.Error())
+	} else if err != nil {
+		c.logf("scan %s of run %s is checkpointed, resume it with `netz run --resume %s`", c.checkpoint.Scan, c.RunID, c.RunID)
+	}
+	return err
+}
+
+// load reads the checkpoint of the run, and checks the scanner and the spec
+// are the scan it describes. The seed and the shard of the checkpoint are set
+// on the spec
+func (c *Checkpointer) load(ctx context.Context, scanner string, spec *Spec) ([]OpenPort, []ProbeResult, []byte, error) {
+	body, err := c.Store.Get(ctx, checkpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil, fmt.Errorf("run %s has no checkpoint to resume", c.RunID)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := json.Unmarshal(body, &c.checkpoint); err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to parse checkpoint of run %s: %s", c.RunID, err.Error())
+	}
+
+	if spec.Seed == 0 {
+		spec.Seed = c.checkpoint.Spec.Seed
+	}
+	if spec.Shard == nil {
+		spec.Shard = c.checkpoint.Spec.Shard
+	}
+	if !sameScan(Checkpoint{Scanner: scanner, Spec: *spec}, c.checkpoint) {
+		return nil, nil, nil, fmt.Errorf("the scan doesn't match the checkpoint of run %s, a resumed scan must have the same scanner, targets, ports, seed and shard", c.RunID)
+	}
+
+	var found []OpenPort
+	seen := make(map[string]bool)
+	err = c.readParts(ctx, "open-ports", func(line []byte) {
+		var port OpenPort
+		if json.Unmarshal(line, &port) == nil && !seen[port.HostPort()] {
+			seen[port.HostPort()] = true
+			found = append(found, port)
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var probes []ProbeResult
+	seen = make(map[string]bool)
+	err = c.readParts(ctx, "probes", func(line []byte) {
+		if r, ok := parseZGrab2(line); ok && !seen[probeKey(r)] {
+			seen[probeKey(r)] = true
+			probes = append(probes, r)
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	paused, err := c.Store.Get(ctx, path.Join(c.checkpoint.Scan, "paused.conf"))
+	if errors.Is(err, os.ErrNotExist) {
+		return found, probes, nil, nil
+	}
+	return found, probes, paused, err
+}
+
+// HasCheckpoint reports whether the store has the checkpoint of a scan to
+// resume
+func HasCheckpoint(ctx context.Context, store CheckpointStore) (bool, error) {
+	_, err := store.Get(ctx, checkpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sameScan reports whether the checkpoints scan the same probes in the same
+// order, the scanners order the probes of a seed differently
+func sameScan(a Checkpoint, b Checkpoint) bool {
+	key := func(c Checkpoint) string {
+		s := c.Spec
+		shard := ""
+		if s.Shard != nil {
+			shard = s.Shard.String()
+		}
+		// a nil list is the same scan as an empty one
+		return fmt.Sprint(c.Scanner, s.Targets, s.TargetFiles, s.Ports, s.Excludes, s.ExcludeFile, s.Seed, shard, s.Retries)
+	}
+	return key(a) == key(b)
+}
+
+func (c *Checkpointer) readParts(ctx context.Context, dir string, fn func(line []byte)) error {
+	names, err := c.Store.List(ctx, path.Join(c.checkpoint.Scan, dir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		body, err := c.Store.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		s := bufio.NewScanner(bytes.NewReader(body))
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for s.Scan() {
+			fn(s.Bytes())
+		}
+		if err := s.Err(); err != nil {
+			return fmt.Errorf("unable to read %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// probeKey is the port of a probe result, zgrab2 results only have the ip
+func probeKey(r ProbeResult) string {
+	if r.Port == 0 {
+		return unbracket(r.IP)
+	}
+	return joinHostPort(unbracket(r.IP), r.Port)
+}
+
+// recordOpen saves the open port with the next checkpoint, it returns false
+// when the port is already saved
+func (c *Checkpointer) recordOpen(port OpenPort) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open[port.HostPort()] {
+		return false
+	}
+	c.open[port.HostPort()] = true
+	body, _ := json.Marshal(port)
+	c.newOpen.Write(append(body, '\n'))
+	return true
+}
+
+func (c *Checkpointer) recordProbe(r ProbeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probed[probeKey(r)] = true
+	c.newProbes.Write(append(append([]byte(nil), r.Raw...), '\n'))
+}
+
+func (c *Checkpointer) seen(port OpenPort) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open[port.HostPort()]
+}
+
+// saveEvery saves the checkpoint every interval until the returned func is
+// called
+func (c *Checkpointer) saveEvery(interval time.Duration) func() {
+	if interval == 0 {
+		interval = defaultCheckpointInterval
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if err := c.save(ctx); err != nil {
+					c.logf("failed to save checkpoint of run %s: %s", c.RunID, err.Error())
+				}
+				cancel()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// save writes the open ports and probe results found since the last save as
+// new parts, then the checkpoint. What fails to be written is kept for the
+// next save
+func (c *Checkpointer) save(ctx context.Context) error {
+	c.mu.Lock()
+	open := append([]byte(nil), c.newOpen.Bytes()...)
+	probes := append([]byte(nil), c.newProbes.Bytes()...)
+	c.newOpen.Reset()
+	c.newProbes.Reset()
+	c.parts++
+	part := fmt.Sprintf("%s-%06d.jsonl", c.attempt, c.parts)
+	c.mu.Unlock()
+
+	var err error
+	if len(open) > 0 {
+		if err = c.Store.Put(ctx, path.Join(c.checkpoint.Scan, "open-ports", part), open); err != nil {
+			c.restore(&c.newOpen, open)
+		}
+	}
+	if len(probes) > 0 {
+		if perr := c.Store.Put(ctx, path.Join(c.checkpoint.Scan, "probes", part), probes); perr != nil {
+			c.restore(&c.newProbes, probes)
+			err = perr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return c.saveCheckpoint(ctx)
+}
+
+// restore puts back what failed to be saved, before what was found since
+func (c *Checkpointer) restore(buf *bytes.Buffer, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rest := append(body, buf.Bytes()...)
+	buf.Reset()
+	buf.Write(rest)
+}
+
+func (c *Checkpointer) saveCheckpoint(ctx context.Context) error {
+	c.mu.Lock()
+	c.checkpoint.UpdatedAt = time.Now().UTC()
+	body, err := json.MarshalIndent(c.checkpoint, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Store.Put(ctx, checkpointFile, append(body, '\n'))
+}
+
+func (c *Checkpointer) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
+
+// checkpointScanner probes the open ports of the checkpoint that have no
+// probe result first, then leaves out the open ports the checkpoint has
+type checkpointScanner struct {
+	PortScanner
+	c       *Checkpointer
+	pending []OpenPort
+}
+
+func (s *checkpointScanner) Scan(ctx context.Context, spec Spec, found func(OpenPort)) error {
+	for _, port := range s.pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		found(port)
+	}
+	return s.PortScanner.Scan(ctx, spec, func(port OpenPort) {
+		if !s.c.seen(port) {
+			found(port)
+		}
+	})
+}
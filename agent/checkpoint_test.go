@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+func checkpointSpec() Spec {
+	return Spec{Targets: []string{"192.0.2.0/24"}, Ports: "1-3", Rate: 1000}
+}
+
+// attempt runs the scan with a checkpointer of the store and returns the
+// ports of the open ports and of the probe results it got
+func attempt(t *testing.T, store CheckpointStore, resume bool, scanner PortScanner, spec Spec) (open []int, probed []int, err error) {
+	t.Helper()
+	c := &Checkpointer{Store: store, RunID: "run-1", Resume: resume, Interval: time.Hour, Logf: t.Logf}
+	pipeline := &Pipeline{Prober: &fakeProber{}}
+	err = c.Run(context.Background(), scanner, pipeline, spec, func(port OpenPort) {
+		open = append(open, port.Port)
+	}, func(r ProbeResult) {
+		probed = append(probed, r.Port)
+	})
+	return open, probed, err
+}
+
+func loadCheckpoint(t *testing.T, store CheckpointStore) Checkpoint {
+	t.Helper()
+	body, err := store.Get(context.Background(), checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(body, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint
+}
+
+func TestCheckpointResume(t *testing.T) {
+	store, err := NewRunCheckpointStore(t.TempDir()+"/", "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := HasCheckpoint(context.Background(), store); err != nil || found {
+		t.Fatalf("empty store has a checkpoint: %v, %v", found, err)
+	}
+
+	// the first attempt is interrupted after two open ports
+	spec := checkpointSpec()
+	spec.Shard = &masscan.Shard{ID: 1, Total: 2}
+	first := &fakeScanner{ports: 2, err: errors.New("interrupted")}
+	open, probed, err := attempt(t, store, false, first, spec)
+	if err == nil || err.Error() != "interrupted" {
+		t.Fatalf("got error %v", err)
+	}
+	if found, err := HasCheckpoint(context.Background(), store); err != nil || !found {
+		t.Fatalf("no checkpoint after the first attempt: %v", err)
+	}
+	checkpoint := loadCheckpoint(t, store)
+	if checkpoint.Spec.Seed == 0 || checkpoint.Spec.Seed != first.spec.Seed {
+		t.Errorf("checkpoint has seed %d, the scan had %d", checkpoint.Spec.Seed, first.spec.Seed)
+	}
+	if checkpoint.Done || checkpoint.Scanner != "fake" {
+		t.Errorf("got checkpoint %+v", checkpoint)
+	}
+	if !reflect.DeepEqual(open, []int{1, 2}) || !reflect.DeepEqual(probed, []int{1, 2}) {
+		t.Errorf("first attempt got open ports %v and probes %v", open, probed)
+	}
+
+	// the resumed scan reuses the seed and the shard, the ports found again
+	// are left out
+	second := &fakeScanner{ports: 3}
+	open, probed, err = attempt(t, store, true, second, checkpointSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.spec.Seed != checkpoint.Spec.Seed || second.spec.Shard == nil || *second.spec.Shard != *spec.Shard {
+		t.Errorf("resumed scan has seed %d and shard %v, want %d and %v", second.spec.Seed, second.spec.Shard, checkpoint.Spec.Seed, spec.Shard)
+	}
+	if !reflect.DeepEqual(open, []int{1, 2, 3}) || !reflect.DeepEqual(probed, []int{1, 2, 3}) {
+		t.Errorf("resumed attempt got open ports %v and probes %v", open, probed)
+	}
+	if resumed := loadCheckpoint(t, store); !resumed.Done || resumed.Scan != checkpoint.Scan {
+		t.Errorf("got checkpoint %+v, want scan %s done", resumed, checkpoint.Scan)
+	}
+
+	// a done scan only reports the merged parts of every attempt
+	third := &fakeScanner{ports: 5}
+	open, probed, err = attempt(t, store, true, third, checkpointSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.spec.Ports != "" {
+		t.Errorf("a done scan ran again")
+	}
+	if !reflect.DeepEqual(open, []int{1, 2, 3}) || !reflect.DeepEqual(probed, []int{1, 2, 3}) {
+		t.Errorf("done scan got open ports %v and probes %v", open, probed)
+	}
+	parts, err := store.List(context.Background(), checkpoint.Scan+"/open-ports")
+	if err != nil || len(parts) != 2 {
+		t.Errorf("got open port parts %v, %v", parts, err)
+	}
+}
+
+func TestCheckpointMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		scanner string
+		modify  func(spec *Spec)
+		err     string
+	}{
+		{name: "same scan", modify: func(spec *Spec) {}},
+		{name: "other rate and adapters", modify: func(spec *Spec) { spec.Rate = 10; spec.Adapters = []masscan.Adapter{{Name: "eth1"}} }},
+		{name: "other scanner", scanner: "other", modify: func(spec *Spec) {}, err: "doesn't match the checkpoint of run run-1"},
+		{name: "other ports", modify: func(spec *Spec) { spec.Ports = "1-4" }, err: "doesn't match"},
+		{name: "other targets", modify: func(spec *Spec) { spec.Targets = []string{"198.51.100.0/24"} }, err: "doesn't match"},
+		{name: "other seed", modify: func(spec *Spec) { spec.Seed = 1 }, err: "doesn't match"},
+		{name: "other shard", modify: func(spec *Spec) { spec.Shard = &masscan.Shard{ID: 1, Total: 3} }, err: "doesn't match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &DirStore{Dir: t.TempDir()}
+			if _, _, err := attempt(t, store, false, &fakeScanner{ports: 1, err: errors.New("interrupted")}, checkpointSpec()); err == nil {
+				t.Fatal("the first attempt wasn't interrupted")
+			}
+
+			spec := checkpointSpec()
+			tt.modify(&spec)
+			scanner := &fakeScanner{name: tt.scanner, ports: 1}
+			_, _, err := attempt(t, store, true, scanner, spec)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			case tt.err != "" && scanner.spec.Ports != "":
+				t.Errorf("a mismatched scan ran")
+			}
+		})
+	}
+
+	// there's nothing to resume without a checkpoint
+	_, _, err := attempt(t, &DirStore{Dir: t.TempDir()}, true, &fakeScanner{}, checkpointSpec())
+	if err == nil || !strings.Contains(err.Error(), "run run-1 has no checkpoint to resume") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+// fakeMasscan writes a masscan that keeps its config, prints the output and
+// exits with the status
+func fakeMasscan(t *testing.T, output string, paused string, status int) *Masscan {
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncp \"$2\" masscan.conf\nprintf '" + output + "'\n"
+	if paused != "" {
+		script += "printf '" + paused + "' > paused.conf\n"
+	}
+	script += "exit " + strconv.Itoa(status) + "\n"
+	path := filepath.Join(dir, "masscan")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &Masscan{Path: path, Dir: dir, Stderr: os.Stderr}
+}
+
+func TestCheckpointMasscanPaused(t *testing.T) {
+	store := &DirStore{Dir: t.TempDir()}
+
+	// masscan writes paused.conf when it's interrupted
+	interrupted := fakeMasscan(t, "open tcp 1 192.0.2.1 1600000000\\n", "resume-index = 42\\n", 1)
+	if _, _, err := attempt(t, store, false, interrupted, checkpointSpec()); err == nil {
+		t.Fatal("the first attempt wasn't interrupted")
+	}
+	checkpoint := loadCheckpoint(t, store)
+	paused, err := store.Get(context.Background(), checkpoint.Scan+"/paused.conf")
+	if err != nil || string(paused) != "resume-index = 42\n" {
+		t.Fatalf("got paused.conf %q, %v", paused, err)
+	}
+
+	// the resumed masscan, on another instance, starts from its resume-index
+	resumed := fakeMasscan(t, "open tcp 2 192.0.2.1 1600000001\\n", "", 0)
+	open, _, err := attempt(t, store, true, resumed, checkpointSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.ResumeIndex != 42 {
+		t.Errorf("masscan resumed from index %d", resumed.ResumeIndex)
+	}
+	conf, err := ioutil.ReadFile(filepath.Join(resumed.Dir, "masscan.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(conf), "resume-index = 42\n") || !strings.Contains(string(conf), "seed = ") {
+		t.Errorf("resumed masscan got config:\n%s", conf)
+	}
+	if !reflect.DeepEqual(open, []int{1, 2}) {
+		t.Errorf("got open ports %v", open)
+	}
+
+	// an invalid paused.conf isn't resumed from
+	if err := store.Put(context.Background(), checkpoint.Scan+"/paused.conf", []byte("rate = 100\n")); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint = loadCheckpoint(t, store)
+	checkpoint.Done = false
+	body, _ := json.Marshal(checkpoint)
+	if err := store.Put(context.Background(), checkpointFile, body); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := attempt(t, store, true, fakeMasscan(t, "", "", 0), checkpointSpec()); err == nil || !strings.Contains(err.Error(), "no resume-index") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHTTPWorkers = 100
+	defaultHTTPTimeout = 10 * time.Second
+	maxHTTPBody        = 256 * 1024
+)
+
+// HTTPProber probes the open ports with a pool of HTTP clients, like the http
+// module of zgrab2 with retry-https, and reports the results in its JSON
+type HTTPProber struct {
+	// Endpoint is the path requested, / when empty
+	Endpoint string
+	// Workers is the number of ports probed at once
+	Workers int
+	// Timeout of a probe
+	Timeout time.Duration
+}
+
+func (h *HTTPProber) Name() string {
+	return "http"
+}
+
+func (h *HTTPProber) Probe(ctx context.Context, ports <-chan OpenPort, found func(ProbeResult)) error {
+	workers := h.Workers
+	if workers < 1 {
+		workers = defaultHTTPWorkers
+	}
+	timeout := h.Timeout
+	if timeout == 0 {
+		timeout = defaultHTTPTimeout
+	}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		// the response of the endpoint is the result, not where it redirects
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for port := range ports {
+				result := h.probe(ctx, client, port)
+				mu.Lock()
+				found(result)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// zgrab2HTTP is the http module of a zgrab2 record
+type zgrab2HTTP struct {
+	Status    string            `json:"status"`
+	Protocol  string            `json:"protocol"`
+	Result    *zgrab2HTTPResult `json:"result,omitempty"`
+	Timestamp string            `json:"timestamp"`
+	Error     string            `json:"error,omitempty"`
+}
+
+type zgrab2HTTPResult struct {
+	Response zgrab2HTTPResponse `json:"response"`
+}
+
+type zgrab2HTTPResponse struct {
+	Status     string              `json:"status"`
+	StatusCode int                 `json:"status_code"`
+	Protocol   string              `json:"protocol"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+}
+
+func (h *HTTPProber) probe(ctx context.Context, client *http.Client, port OpenPort) ProbeResult {
+	module := zgrab2HTTP{Protocol: "http", Timestamp: time.Now().UTC().Format(time.RFC3339)}
+	response, err := h.get(ctx, client, "http", port)
+	if err != nil {
+		// retry-https
+		response, err = h.get(ctx, client, "https", port)
+	}
+	if err != nil {
+		module.Status = probeStatus(err)
+		module.Error = err.Error()
+	} else {
+		module.Status = "success"
+		module.Result = &zgrab2HTTPResult{Response: *response}
+	}
+
+	result := ProbeResult{IP: unbracket(port.IP), Port: port.Port}
+	result.Raw, _ = json.Marshal(struct {
+		IP   string                `json:"ip"`
+		Port int                   `json:"port"`
+		Data map[string]zgrab2HTTP `json:"data"`
+	}{result.IP, result.Port, map[string]zgrab2HTTP{"http": module}})
+	return result
+}
+
+func (h *HTTPProber) get(ctx context.Context, client *http.Client, scheme string, port OpenPort) (*zgrab2HTTPResponse, error) {
+	endpoint := orDefault(h.Endpoint, "/")
+	if !strings.HasPrefix(endpoint, "/") {
+		endpoint = "/" + endpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+port.HostPort()+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPBody))
+	if err != nil {
+		return nil, err
+	}
+	return &zgrab2HTTPResponse{
+		Status:     resp.Status,
+		StatusCode: resp.StatusCode,
+		Protocol:   resp.Proto,
+		Headers:    resp.Header,
+		Body:       string(body),
+	}, nil
+}
+
+// probeStatus is the zgrab2 status of a failed probe
+func probeStatus(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "connection-timeout"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "connection-refused"
+	}
+	return "unknown-error"
+}
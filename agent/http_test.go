@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// field returns the value at the path of a decoded JSON record
+func field(record interface{}, path ...string) interface{} {
+	for _, key := range path {
+		object, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = object[key]
+	}
+	return record
+}
+
+func openPort(t *testing.T, addr string) OpenPort {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return OpenPort{IP: host, Port: p, Proto: "tcp"}
+}
+
+// connOnly hides the *tls.Conn so net/http doesn't answer plain HTTP with a
+// 400, the connection is closed like most TLS servers do
+type connOnly struct {
+	net.Listener
+}
+
+func (l connOnly) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	return struct{ net.Conn }{c}, err
+}
+
+// tlsOnlyServer serves handler over TLS only and returns its address
+func tlsOnlyServer(t *testing.T, handler http.Handler) string {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go http.Serve(connOnly{tls.NewListener(l, server.TLS)}, handler)
+	return l.Addr().String()
+}
+
+func TestHTTPProber(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" {
+			http.Redirect(w, r, "/status", http.StatusFound)
+			return
+		}
+		w.Header().Set("Server", "netz-test")
+		w.Write([]byte("ok"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	tlsOnly := tlsOnlyServer(t, handler)
+	redirect := httptest.NewServer(http.RedirectHandler("/elsewhere", http.StatusMovedPermanently))
+	defer redirect.Close()
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name   string
+		addr   string
+		status string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "http",
+			addr:   plain.Listener.Addr().String(),
+			status: "success",
+			want: map[string]interface{}{
+				"status":      "200 OK",
+				"status_code": float64(200),
+				"protocol":    "HTTP/1.1",
+				"body":        "ok",
+			},
+		},
+		{
+			name:   "retry https",
+			addr:   tlsOnly,
+			status: "success",
+			want: map[string]interface{}{
+				"status":      "200 OK",
+				"status_code": float64(200),
+				"protocol":    "HTTP/1.1",
+				"body":        "ok",
+			},
+		},
+		{
+			name:   "redirect isn't followed",
+			addr:   redirect.Listener.Addr().String(),
+			status: "success",
+			want: map[string]interface{}{
+				"status":      "301 Moved Permanently",
+				"status_code": float64(301),
+				"protocol":    "HTTP/1.1",
+			},
+		},
+		{
+			name:   "closed port",
+			addr:   closed,
+			status: "connection-refused",
+		},
+	}
+
+	ports := make(chan OpenPort, len(tests))
+	for _, tt := range tests {
+		ports <- openPort(t, tt.addr)
+	}
+	close(ports)
+	records := map[int]interface{}{}
+	prober := &HTTPProber{Endpoint: "status", Workers: 2, Timeout: 5 * time.Second}
+	if err := prober.Probe(context.Background(), ports, func(r ProbeResult) {
+		var record interface{}
+		if err := json.Unmarshal(r.Raw, &record); err != nil {
+			t.Errorf("result of %s:%d: %s", r.IP, r.Port, err.Error())
+		}
+		records[r.Port] = record
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := openPort(t, tt.addr)
+			record, ok := records[port.Port]
+			if !ok {
+				t.Fatalf("no result")
+			}
+			if ip := field(record, "ip"); ip != port.IP {
+				t.Errorf("got ip %v, want %s", ip, port.IP)
+			}
+			if got := field(record, "port"); got != float64(port.Port) {
+				t.Errorf("got port %v, want %d", got, port.Port)
+			}
+			module := field(record, "data", "http")
+			if status := field(module, "status"); status != tt.status {
+				t.Errorf("got status %v, want %s (error %v)", status, tt.status, field(module, "error"))
+			}
+			if protocol := field(module, "protocol"); protocol != "http" {
+				t.Errorf("got protocol %v", protocol)
+			}
+			if _, err := time.Parse(time.RFC3339, field(module, "timestamp").(string)); err != nil {
+				t.Errorf("timestamp: %s", err.Error())
+			}
+
+			response := field(module, "result", "response")
+			if tt.want == nil {
+				if response != nil || field(module, "error") == nil {
+					t.Errorf("got response %v and error %v of a failed probe", response, field(module, "error"))
+				}
+				return
+			}
+			got := map[string]interface{}{}
+			for key := range tt.want {
+				got[key] = field(response, key)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got response %v, want %v", got, tt.want)
+			}
+			if field(response, "headers") == nil {
+				t.Errorf("no headers in the response")
+			}
+		})
+	}
+	if server := field(records[openPort(t, plain.Listener.Addr().String()).Port], "data", "http", "result", "response", "headers", "Server"); !reflect.DeepEqual(server, []interface{}{"netz-test"}) {
+		t.Errorf("got Server header %v", server)
+	}
+}
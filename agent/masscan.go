@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+// Masscan runs scans with masscan, from a config file it writes
+type Masscan struct {
+	// Path of the binary, masscan in PATH when empty
+	Path string
+	// ConfigPath is where the config is written, a temporary file when empty
+	ConfigPath string
+	// Stderr gets the status of masscan
+	Stderr io.Writer
+	// Dir is where masscan runs and writes paused.conf when it's
+	// interrupted, the current directory when empty
+	Dir string
+	// ResumeIndex continues an interrupted scan, see Paused
+	ResumeIndex uint64
+}
+
+func (m *Masscan) Name() string {
+	return "masscan"
+}
+
+// Config returns the masscan config of the spec, it lists the open ports on
+// the standard output
+func (m *Masscan) Config(spec Spec) *masscan.Config {
+	return &masscan.Config{
+		Adapters:       spec.Adapters,
+		Rate:           spec.Rate,
+		Ports:          spec.Ports,
+		Ranges:         spec.Targets,
+		IncludeFiles:   spec.TargetFiles,
+		Excludes:       spec.Excludes,
+		ExcludeFile:    spec.ExcludeFile,
+		OutputFormat:   "list",
+		OutputFilename: "-",
+		Seed:           spec.Seed,
+		Shard:          spec.Shard,
+		Retries:        spec.Retries,
+		ResumeIndex:    m.ResumeIndex,
+	}
+}
+
+// Paused returns the paused.conf masscan wrote when it was interrupted, nil
+// when there's none
+func (m *Masscan) Paused() ([]byte, error) {
+	body, err := ioutil.ReadFile(filepath.Join(m.Dir, "paused.conf"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return body, err
+}
+
+func (m *Masscan) Scan(ctx context.Context, spec Spec, found func(OpenPort)) error {
+	path := m.ConfigPath
+	if path == "" {
+		f, err := ioutil.TempFile("", "masscan-*.conf")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+		path = f.Name()
+	}
+	if err := m.Config(spec).WriteFile(path); err != nil {
+		return err
+	}
+	// masscan runs in Dir
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	// a paused.conf of a previous scan isn't taken for this one
+	os.Remove(filepath.Join(m.Dir, "paused.conf"))
+
+	cmd := exec.Command(orDefault(m.Path, "masscan"), "-c", path)
+	cmd.Dir = m.Dir
+	cmd.Stderr = m.Stderr
+	return run(ctx, cmd, parseMasscanList, found)
+}
+
+// parseMasscanList parses a line of the list output of masscan, such as
+// "open tcp 80 192.0.2.1 1600000000"
+func parseMasscanList(line string) (OpenPort, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "open" {
+		return OpenPort{}, false
+	}
+	port, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return OpenPort{}, false
+	}
+	seconds, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return OpenPort{}, false
+	}
+	return OpenPort{
+		IP:    unbracket(fields[3]),
+		Port:  port,
+		Proto: fields[1],
+		Time:  time.Unix(seconds, 0).UTC(),
+	}, true
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
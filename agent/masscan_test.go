@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMasscanList(t *testing.T) {
+	tests := []struct {
+		line string
+		want OpenPort
+		ok   bool
+	}{
+		{line: "open tcp 80 192.0.2.1 1600000000", want: OpenPort{IP: "192.0.2.1", Port: 80, Proto: "tcp", Time: time.Unix(1600000000, 0).UTC()}, ok: true},
+		{line: "open udp 53 192.0.2.1 1600000000", want: OpenPort{IP: "192.0.2.1", Port: 53, Proto: "udp", Time: time.Unix(1600000000, 0).UTC()}, ok: true},
+		{line: "open tcp 443 [2001:db8::1] 1600000001", want: OpenPort{IP: "2001:db8::1", Port: 443, Proto: "tcp", Time: time.Unix(1600000001, 0).UTC()}, ok: true},
+		{line: "  open  tcp 22 192.0.2.2 1600000002  ", want: OpenPort{IP: "192.0.2.2", Port: 22, Proto: "tcp", Time: time.Unix(1600000002, 0).UTC()}, ok: true},
+		// the header and footer of the list output
+		{line: "#masscan"},
+		{line: "# end"},
+		{line: ""},
+		// banners and closed ports aren't open ports
+		{line: "banner tcp 80 192.0.2.1 1600000000 http HTTP/1.1 200 OK"},
+		{line: "closed tcp 80 192.0.2.1 1600000000"},
+		// malformed lines
+		{line: "open tcp 80 192.0.2.1"},
+		{line: "open tcp http 192.0.2.1 1600000000"},
+		{line: "open tcp 80 192.0.2.1 yesterday"},
+	}
+	for _, tt := range tests {
+		got, ok := parseMasscanList(tt.line)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMasscanList(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// only the open ports of the output of a scanner are found
+func TestRunParsesOutput(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "masscan.list")
+	list := "#masscan\nopen tcp 80 192.0.2.1 1600000000\nbanner tcp 80 192.0.2.1 1600000000 http -\nopen tcp 443 [2001:db8::1] 1600000001\n# end\n"
+	if err := ioutil.WriteFile(output, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var ports []OpenPort
+	if err := run(context.Background(), exec.Command("cat", output), parseMasscanList, func(port OpenPort) {
+		ports = append(ports, port)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.1:80", "[2001:db8::1]:443"}
+	if len(ports) != len(want) {
+		t.Fatalf("found %+v, want %v", ports, want)
+	}
+	for i, port := range ports {
+		if port.HostPort() != want[i] {
+			t.Errorf("found %s, want %s", port.HostPort(), want[i])
+		}
+	}
+}
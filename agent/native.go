@@ -0,0 +1,550 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultNativeWait = 10 * time.Second
+	// the source port of the probes, replies to other ports aren't ours
+	defaultNativeSourcePort = 61000
+
+	// the replies of scans up to this many probes are deduplicated exactly,
+	// with a bit per probe
+	maxExactProbes = 1 << 26
+	// larger scans remember the recent replies in a table of this many
+	// slots, like masscan does
+	recentRepliesBits = 20
+)
+
+// Native is a SYN scanner built into the agent, it sends raw TCP SYN packets
+// through AF_PACKET with a PACKET_MMAP ring on every adapter and matches the
+// SYN-ACK replies with stateless cookies, so it keeps no state per probe. It
+// runs on linux with CAP_NET_RAW, scans IPv4 TCP ports and needs the router
+// MAC of every adapter
+type Native struct {
+	// Wait is how long replies are waited for after the last probe was sent
+	Wait time.Duration
+	// SourcePort of the probes
+	SourcePort int
+}
+
+func (n *Native) Name() string {
+	return "native"
+}
+
+func (n *Native) Scan(ctx context.Context, spec Spec, found func(OpenPort)) error {
+	plan, err := n.plan(spec)
+	if err != nil {
+		return err
+	}
+	return n.scan(ctx, plan, found)
+}
+
+// nativeAdapter is an adapter the probes are sent from
+type nativeAdapter struct {
+	name      string
+	ip        net.IP
+	mac       net.HardwareAddr
+	routerMAC net.HardwareAddr
+}
+
+// nativePlan is everything a scan needs, checked before anything is sent
+type nativePlan struct {
+	adapters   []nativeAdapter
+	targets    *targetSet
+	rate       int
+	retries    int
+	shard      int
+	shards     int
+	sourcePort uint16
+	wait       time.Duration
+	// the secret of the cookies and the permutation of the probes
+	seed   int64
+	secret uint64
+}
+
+func (n *Native) plan(spec Spec) (*nativePlan, error) {
+	if spec.Rate < 1 {
+		return nil, fmt.Errorf("rate %d must be positive", spec.Rate)
+	}
+	if len(spec.Adapters) == 0 {
+		return nil, errors.New("the native scanner needs an adapter")
+	}
+
+	plan := &nativePlan{
+		rate:       spec.Rate,
+		retries:    spec.Retries,
+		shard:      0,
+		shards:     1,
+		sourcePort: uint16(defaultNativeSourcePort),
+		wait:       n.Wait,
+		seed:       spec.Seed,
+	}
+	if n.SourcePort != 0 {
+		plan.sourcePort = uint16(n.SourcePort)
+	}
+	if plan.wait == 0 {
+		plan.wait = defaultNativeWait
+	}
+	if spec.Shard != nil {
+		plan.shard = spec.Shard.ID - 1
+		plan.shards = spec.Shard.Total
+	}
+	if plan.seed == 0 {
+		var b [8]byte
+		rand.Read(b[:])
+		plan.seed = int64(binary.LittleEndian.Uint64(b[:]))
+	}
+	plan.secret = mrand.New(mrand.NewSource(plan.seed)).Uint64()
+
+	for _, adapter := range spec.Adapters {
+		if strings.HasPrefix(adapter.Name, "zc:") {
+			return nil, fmt.Errorf("the native scanner can't open the PF_RING ZC adapter %s", adapter.Name)
+		}
+		a := nativeAdapter{name: adapter.Name, ip: net.ParseIP(adapter.IP).To4()}
+		if a.ip == nil {
+			return nil, fmt.Errorf("adapter %s has no IPv4 address", adapter.Name)
+		}
+		var err error
+		if a.mac, err = net.ParseMAC(adapter.MAC); err != nil {
+			return nil, fmt.Errorf("adapter %s has an invalid mac %q", adapter.Name, adapter.MAC)
+		}
+		if a.routerMAC, err = net.ParseMAC(adapter.RouterMAC); err != nil {
+			return nil, fmt.Errorf("adapter %s has no router mac, the native scanner doesn't resolve it", adapter.Name)
+		}
+		plan.adapters = append(plan.adapters, a)
+	}
+
+	ports, err := parseTCPPorts(spec.Ports)
+	if err != nil {
+		return nil, err
+	}
+	include, err := parseRanges(spec.Targets, spec.TargetFiles)
+	if err != nil {
+		return nil, err
+	}
+	var excludeFiles []string
+	if spec.ExcludeFile != "" {
+		excludeFiles = append(excludeFiles, spec.ExcludeFile)
+	}
+	exclude, err := parseRanges(spec.Excludes, excludeFiles)
+	if err != nil {
+		return nil, err
+	}
+	plan.targets = newTargetSet(include, exclude, ports)
+	if plan.targets.size() == 0 {
+		return nil, errors.New("no target to scan")
+	}
+	return plan, nil
+}
+
+// ipRange is an inclusive range of IPv4 addresses
+type ipRange struct {
+	first uint32
+	last  uint32
+}
+
+// parseRanges parses IPv4 addresses, CIDRs and first-last ranges, and the
+// lines of the files, lines starting with # are comments
+func parseRanges(values []string, files []string) ([]ipRange, error) {
+	values = append([]string(nil), values...)
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			if line != "" {
+				values = append(values, line)
+			}
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var ranges []ipRange
+	for _, value := range values {
+		r, err := parseRange(value)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parseRange(value string) (ipRange, error) {
+	if _, ipnet, err := net.ParseCIDR(value); err == nil {
+		ip := ipnet.IP.To4()
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("the native scanner doesn't scan IPv6, %s", value)
+		}
+		ones, _ := ipnet.Mask.Size()
+		first := binary.BigEndian.Uint32(ip)
+		return ipRange{first: first, last: first | uint32(uint64(1)<<(32-ones)-1)}, nil
+	}
+
+	bounds := strings.SplitN(value, "-", 2)
+	var r []uint32
+	for _, bound := range bounds {
+		ip := net.ParseIP(strings.TrimSpace(bound))
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("invalid range %q", value)
+		}
+		if ip.To4() == nil {
+			return ipRange{}, fmt.Errorf("the native scanner doesn't scan IPv6, %s", value)
+		}
+		r = append(r, binary.BigEndian.Uint32(ip.To4()))
+	}
+	if len(r) == 1 {
+		return ipRange{first: r[0], last: r[0]}, nil
+	}
+	if r[0] > r[1] {
+		return ipRange{}, fmt.Errorf("invalid range %q", value)
+	}
+	return ipRange{first: r[0], last: r[1]}, nil
+}
+
+// parseTCPPorts parses a port list of TCP ports
+func parseTCPPorts(ports string) ([]uint16, error) {
+	seen := make(map[uint16]bool)
+	var out []uint16
+	for _, port := range strings.Split(ports, ",") {
+		spec := strings.TrimPrefix(strings.TrimSpace(port), "T:")
+		if strings.Contains(spec, ":") {
+			return nil, fmt.Errorf("the native scanner only scans TCP ports, %q given", port)
+		}
+		bounds := strings.SplitN(spec, "-", 2)
+		var r []int
+		for _, bound := range bounds {
+			n, err := strconv.Atoi(bound)
+			if err != nil || n < 0 || n > 65535 {
+				return nil, fmt.Errorf("invalid port %q", port)
+			}
+			r = append(r, n)
+		}
+		if len(r) == 1 {
+			r = append(r, r[0])
+		}
+		for p := r[0]; p <= r[1]; p++ {
+			if !seen[uint16(p)] {
+				seen[uint16(p)] = true
+				out = append(out, uint16(p))
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("ports to scan are required")
+	}
+	return out, nil
+}
+
+// targetSet is every (address, port) probe of a scan, indexed so the probes
+// can be sent in a random order without keeping them in memory
+type targetSet struct {
+	ranges    []ipRange
+	offsets   []uint64
+	ips       uint64
+	ports     []uint16
+	portIndex map[uint16]uint64
+}
+
+// newTargetSet returns the probes of the ranges without the excluded ones
+func newTargetSet(include []ipRange, exclude []ipRange, ports []uint16) *targetSet {
+	ranges := subtract(merge(include), merge(exclude))
+	t := &targetSet{ranges: ranges, ports: ports, portIndex: make(map[uint16]uint64)}
+	for i, port := range ports {
+		t.portIndex[port] = uint64(i)
+	}
+	for _, r := range ranges {
+		t.offsets = append(t.offsets, t.ips)
+		t.ips += uint64(r.last-r.first) + 1
+	}
+	return t
+}
+
+func (t *targetSet) size() uint64 {
+	return t.ips * uint64(len(t.ports))
+}
+
+// at returns the probe of an index below size
+func (t *targetSet) at(i uint64) (uint32, uint16) {
+	ipIndex := i % t.ips
+	port := t.ports[i/t.ips]
+	r := sort.Search(len(t.offsets), func(j int) bool { return t.offsets[j] > ipIndex }) - 1
+	return t.ranges[r].first + uint32(ipIndex-t.offsets[r]), port
+}
+
+// index returns the index of the probe to dst:port, false when it isn't a
+// probe of the set
+func (t *targetSet) index(dst uint32, port uint16) (uint64, bool) {
+	p, ok := t.portIndex[port]
+	if !ok {
+		return 0, false
+	}
+	r := sort.Search(len(t.ranges), func(j int) bool { return t.ranges[j].last >= dst })
+	if r == len(t.ranges) || t.ranges[r].first > dst {
+		return 0, false
+	}
+	return p*t.ips + t.offsets[r] + uint64(dst-t.ranges[r].first), true
+}
+
+// replySet is the probes that were answered, in bounded memory: a bit per
+// probe when the scan is small enough, else a table of the recent replies
+// where a reply evicted by another one can be reported again
+type replySet struct {
+	targets *targetSet
+	bits    []uint64
+	recent  []uint64
+}
+
+func newReplySet(targets *targetSet) *replySet {
+	s := &replySet{targets: targets}
+	if n := targets.size(); n <= maxExactProbes {
+		s.bits = make([]uint64, (n+63)/64)
+	} else {
+		s.recent = make([]uint64, 1<<recentRepliesBits)
+	}
+	return s
+}
+
+// add returns whether the probe to dst:port wasn't answered before
+func (s *replySet) add(dst uint32, port uint16) bool {
+	if s.bits != nil {
+		i, ok := s.targets.index(dst, port)
+		if !ok {
+			return false
+		}
+		word, bit := i/64, uint64(1)<<(i%64)
+		if s.bits[word]&bit != 0 {
+			return false
+		}
+		s.bits[word] |= bit
+		return true
+	}
+
+	// the key is never 0, which is an empty slot
+	key := uint64(1)<<48 | uint64(dst)<<16 | uint64(port)
+	slot := &s.recent[key*0x9e3779b97f4a7c15>>(64-recentRepliesBits)]
+	if *slot == key {
+		return false
+	}
+	*slot = key
+	return true
+}
+
+// merge sorts the ranges and merges the ones that overlap or touch
+func merge(ranges []ipRange) []ipRange {
+	ranges = append([]ipRange(nil), ranges...)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].first < ranges[j].first })
+	var out []ipRange
+	for _, r := range ranges {
+		if n := len(out); n > 0 && uint64(r.first) <= uint64(out[n-1].last)+1 {
+			if r.last > out[n-1].last {
+				out[n-1].last = r.last
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// subtract removes the merged excluded ranges from the merged ranges
+func subtract(ranges []ipRange, exclude []ipRange) []ipRange {
+	var out []ipRange
+	for _, r := range ranges {
+		first := uint64(r.first)
+		for _, e := range exclude {
+			if uint64(e.last) < first || e.first > r.last {
+				continue
+			}
+			if uint64(e.first) > first {
+				out = append(out, ipRange{first: uint32(first), last: e.first - 1})
+			}
+			first = uint64(e.last) + 1
+		}
+		if first <= uint64(r.last) {
+			out = append(out, ipRange{first: uint32(first), last: r.last})
+		}
+	}
+	return out
+}
+
+// permutation visits every index below n once, in an order decided by the
+// seed: i -> (a*i + b) mod n with a coprime to n
+type permutation struct {
+	n uint64
+	a uint64
+	b uint64
+}
+
+func newPermutation(n uint64, seed int64) permutation {
+	r := mrand.New(mrand.NewSource(seed))
+	p := permutation{n: n, a: 1}
+	if n < 2 {
+		return p
+	}
+	for {
+		p.a = r.Uint64()%(n-1) + 1
+		if gcd(p.a, n) == 1 {
+			break
+		}
+	}
+	p.b = r.Uint64() % n
+	return p
+}
+
+func (p permutation) at(i uint64) uint64 {
+	hi, lo := bits.Mul64(p.a, i)
+	_, rem := bits.Div64(hi%p.n, lo, p.n)
+	return (rem + p.b) % p.n
+}
+
+func gcd(a uint64, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// cookie is the sequence number of the probe to dst:dport, a SYN-ACK acks
+// cookie+1 so the reply is matched without remembering the probe
+func cookie(secret uint64, src uint32, dst uint32, sport uint16, dport uint16) uint32 {
+	var b [20]byte
+	binary.BigEndian.PutUint64(b[0:], secret)
+	binary.BigEndian.PutUint32(b[8:], src)
+	binary.BigEndian.PutUint32(b[12:], dst)
+	binary.BigEndian.PutUint16(b[16:], sport)
+	binary.BigEndian.PutUint16(b[18:], dport)
+	h := fnv.New64a()
+	h.Write(b[:])
+	sum := h.Sum64()
+	return uint32(sum ^ sum>>32)
+}
+
+const (
+	ethHeaderLen  = 14
+	ipHeaderLen   = 20
+	tcpHeaderLen  = 24 // with the MSS option
+	synPacketLen  = ethHeaderLen + ipHeaderLen + tcpHeaderLen
+	etherTypeIPv4 = 0x0800
+	protoTCP      = 6
+
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// buildSYN writes the ethernet frame of a SYN probe to b, which has
+// synPacketLen bytes
+func buildSYN(b []byte, a *nativeAdapter, dst uint32, sport uint16, dport uint16, seq uint32, id uint16) {
+	copy(b[0:6], a.routerMAC)
+	copy(b[6:12], a.mac)
+	binary.BigEndian.PutUint16(b[12:14], etherTypeIPv4)
+
+	ip := b[ethHeaderLen : ethHeaderLen+ipHeaderLen]
+	ip[0] = 0x45
+	ip[1] = 0
+	binary.BigEndian.PutUint16(ip[2:4], ipHeaderLen+tcpHeaderLen)
+	binary.BigEndian.PutUint16(ip[4:6], id)
+	binary.BigEndian.PutUint16(ip[6:8], 0)
+	ip[8] = 64
+	ip[9] = protoTCP
+	binary.BigEndian.PutUint16(ip[10:12], 0)
+	copy(ip[12:16], a.ip)
+	binary.BigEndian.PutUint32(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:12], checksum(ip, 0))
+
+	tcp := b[ethHeaderLen+ipHeaderLen : synPacketLen]
+	binary.BigEndian.PutUint16(tcp[0:2], sport)
+	binary.BigEndian.PutUint16(tcp[2:4], dport)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], 0)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(tcp[14:16], 65535)
+	binary.BigEndian.PutUint16(tcp[16:18], 0)
+	binary.BigEndian.PutUint16(tcp[18:20], 0)
+	// MSS 1460
+	tcp[20], tcp[21] = 2, 4
+	binary.BigEndian.PutUint16(tcp[22:24], 1460)
+
+	pseudo := uint32(0)
+	pseudo += uint32(binary.BigEndian.Uint16(ip[12:14])) + uint32(binary.BigEndian.Uint16(ip[14:16]))
+	pseudo += uint32(binary.BigEndian.Uint16(ip[16:18])) + uint32(binary.BigEndian.Uint16(ip[18:20]))
+	pseudo += protoTCP + tcpHeaderLen
+	binary.BigEndian.PutUint16(tcp[16:18], checksum(tcp, pseudo))
+}
+
+// checksum is the internet checksum of b, added to an initial sum
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// parseSYNACK returns the open port of a frame received on the adapter, when
+// it's a SYN-ACK to a probe of the scan
+func parseSYNACK(frame []byte, a *nativeAdapter, plan *nativePlan) (OpenPort, bool) {
+	if len(frame) < ethHeaderLen+ipHeaderLen || binary.BigEndian.Uint16(frame[12:14]) != etherTypeIPv4 {
+		return OpenPort{}, false
+	}
+	ip := frame[ethHeaderLen:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ip[0]>>4 != 4 || ihl < ipHeaderLen || ip[9] != protoTCP || len(ip) < ihl+20 {
+		return OpenPort{}, false
+	}
+	if !net.IP(ip[16:20]).Equal(a.ip) {
+		return OpenPort{}, false
+	}
+	tcp := ip[ihl:]
+	if binary.BigEndian.Uint16(tcp[2:4]) != plan.sourcePort {
+		return OpenPort{}, false
+	}
+	if tcp[13]&(tcpFlagSYN|tcpFlagACK|tcpFlagRST) != tcpFlagSYN|tcpFlagACK {
+		return OpenPort{}, false
+	}
+
+	src := binary.BigEndian.Uint32(ip[12:16])
+	sport := binary.BigEndian.Uint16(tcp[0:2])
+	ack := binary.BigEndian.Uint32(tcp[8:12])
+	if ack-1 != cookie(plan.secret, binary.BigEndian.Uint32(a.ip), src, plan.sourcePort, sport) {
+		return OpenPort{}, false
+	}
+	return OpenPort{
+		IP:    net.IP(ip[12:16]).String(),
+		Port:  int(sport),
+		Proto: "tcp",
+		Time:  time.Now().UTC(),
+	}, true
+}
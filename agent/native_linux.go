@@ -0,0 +1,316 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linux/if_packet.h
+const (
+	solPacket     = 263
+	packetVersion = 10
+	packetTxRing  = 13
+	packetLoss    = 14
+	tpacketV2     = 1
+
+	tpStatusAvailable   = 0
+	tpStatusSendRequest = 1
+	tpStatusWrongFormat = 4
+
+	// the frame starts after the tpacket2_hdr
+	tpacket2DataOffset = 32
+
+	ringBlockSize = 1 << 16
+	ringBlockNr   = 16
+	ringFrameSize = 1 << 11
+	ringFrameNr   = ringBlockSize / ringFrameSize * ringBlockNr
+
+	// frames are flushed to the adapter in batches
+	flushBatch = 64
+	// replies waiting to be reported, the receivers wait when it's full
+	replyQueue = 1024
+)
+
+func (n *Native) scan(ctx context.Context, plan *nativePlan, found func(OpenPort)) error {
+	var (
+		stop   = make(chan struct{})
+		recvWG sync.WaitGroup
+		sendWG sync.WaitGroup
+	)
+
+	var senders []*ringSender
+	defer func() {
+		for _, s := range senders {
+			s.Close()
+		}
+	}()
+	var receivers []int
+	defer func() {
+		for _, fd := range receivers {
+			syscall.Close(fd)
+		}
+	}()
+	for i := range plan.adapters {
+		a := &plan.adapters[i]
+		iface, err := net.InterfaceByName(a.name)
+		if err != nil {
+			return err
+		}
+		fd, err := openReceiver(iface.Index)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %s", a.name, err.Error())
+		}
+		receivers = append(receivers, fd)
+		s, err := newRingSender(iface.Index)
+		if err != nil {
+			return fmt.Errorf("failed to open the ring of %s: %s", a.name, err.Error())
+		}
+		senders = append(senders, s)
+	}
+
+	// the receivers hand the replies over without waiting for found, which
+	// is called from a single goroutine that owns the answered probes
+	replies := make(chan OpenPort, replyQueue)
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		answered := newReplySet(plan.targets)
+		for port := range replies {
+			dst := binary.BigEndian.Uint32(net.ParseIP(port.IP).To4())
+			if answered.add(dst, uint16(port.Port)) {
+				found(port)
+			}
+		}
+	}()
+
+	// the replies are received before the first probe is sent
+	for i, fd := range receivers {
+		recvWG.Add(1)
+		go func(a *nativeAdapter, fd int) {
+			defer recvWG.Done()
+			receive(fd, a, plan, stop, replies)
+		}(&plan.adapters[i], fd)
+	}
+
+	errs := make(chan error, len(senders))
+	for i, s := range senders {
+		sendWG.Add(1)
+		go func(k int, s *ringSender) {
+			defer sendWG.Done()
+			errs <- send(ctx, s, k, plan)
+		}(i, s)
+	}
+	sendWG.Wait()
+	close(errs)
+	var err error
+	for e := range errs {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err == nil {
+		select {
+		case <-time.After(plan.wait):
+		case <-ctx.Done():
+		}
+	}
+	close(stop)
+	recvWG.Wait()
+	close(replies)
+	<-reported
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// send sends the probes of the adapter k: every pass goes over the probes of
+// the shard in the order of the permutation, and deals them to the adapters
+func send(ctx context.Context, s *ringSender, k int, plan *nativePlan) error {
+	a := &plan.adapters[k]
+	src := binary.BigEndian.Uint32(a.ip)
+	size := plan.targets.size()
+	perm := newPermutation(size, plan.seed)
+	stride := uint64(plan.shards) * uint64(len(plan.adapters))
+	rate := float64(plan.rate) / float64(len(plan.adapters))
+
+	start := time.Now()
+	sent := 0
+	for pass := 0; pass <= plan.retries; pass++ {
+		for i := uint64(plan.shard) + uint64(plan.shards)*uint64(k); i < size; i += stride {
+			if sent%flushBatch == 0 {
+				if ctx.Err() != nil {
+					return nil
+				}
+				if err := s.Flush(); err != nil {
+					return err
+				}
+				// the probes are paced to the rate of the adapter
+				if ahead := time.Duration(float64(sent)/rate*float64(time.Second)) - time.Since(start); ahead > 0 {
+					time.Sleep(ahead)
+				}
+			}
+
+			dst, dport := plan.targets.at(perm.at(i))
+			frame, err := s.Next()
+			if err != nil {
+				return err
+			}
+			seq := cookie(plan.secret, src, dst, plan.sourcePort, dport)
+			buildSYN(frame[:synPacketLen], a, dst, plan.sourcePort, dport, seq, uint16(seq>>16))
+			s.Queue(synPacketLen)
+			sent++
+		}
+	}
+	return s.Flush()
+}
+
+// receive matches the replies received on the socket until stop is closed
+func receive(fd int, a *nativeAdapter, plan *nativePlan, stop chan struct{}, replies chan<- OpenPort) {
+	buf := make([]byte, 1<<16)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			continue
+		}
+		if port, ok := parseSYNACK(buf[:n], a, plan); ok {
+			replies <- port
+		}
+	}
+}
+
+// openReceiver opens a socket of the IPv4 frames of the interface, it times
+// out so the receive loop sees when to stop
+func openReceiver(ifindex int) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_IP)))
+	if err != nil {
+		return -1, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: ifindex}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	tv := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// ringSender sends frames through a PACKET_MMAP TX ring: frames are written
+// to the ring and sent by the kernel on Flush, without a syscall per frame
+type ringSender struct {
+	fd      int
+	ring    []byte
+	current int
+}
+
+func newRingSender(ifindex int) (*ringSender, error) {
+	// protocol 0 so the socket doesn't receive anything
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &ringSender{fd: fd}
+	if err := s.setup(ifindex); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ringSender) setup(ifindex int) error {
+	if err := syscall.SetsockoptInt(s.fd, solPacket, packetVersion, tpacketV2); err != nil {
+		return err
+	}
+	// frames the adapter rejects are dropped instead of blocking the ring
+	if err := syscall.SetsockoptInt(s.fd, solPacket, packetLoss, 1); err != nil {
+		return err
+	}
+	req := unix.TpacketReq{
+		Block_size: ringBlockSize,
+		Block_nr:   ringBlockNr,
+		Frame_size: ringFrameSize,
+		Frame_nr:   ringFrameNr,
+	}
+	if err := unix.SetsockoptTpacketReq(s.fd, solPacket, packetTxRing, &req); err != nil {
+		return err
+	}
+	ring, err := syscall.Mmap(s.fd, 0, ringBlockSize*ringBlockNr, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	s.ring = ring
+	return syscall.Bind(s.fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: ifindex})
+}
+
+func (s *ringSender) status(frame int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.ring[frame*ringFrameSize]))
+}
+
+// Next returns the data of the next frame of the ring, waiting for the
+// kernel to send it when the ring is full
+func (s *ringSender) Next() ([]byte, error) {
+	for {
+		switch atomic.LoadUint32(s.status(s.current)) {
+		case tpStatusAvailable:
+			offset := s.current*ringFrameSize + tpacket2DataOffset
+			return s.ring[offset : (s.current+1)*ringFrameSize], nil
+		case tpStatusWrongFormat:
+			return nil, fmt.Errorf("the kernel rejected frame %d of the ring", s.current)
+		}
+		if err := s.Flush(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Queue hands the frame returned by Next to the kernel
+func (s *ringSender) Queue(length int) {
+	frame := s.ring[s.current*ringFrameSize:]
+	// tp_len of the tpacket2_hdr
+	*(*uint32)(unsafe.Pointer(&frame[4])) = uint32(length)
+	atomic.StoreUint32(s.status(s.current), tpStatusSendRequest)
+	s.current = (s.current + 1) % ringFrameNr
+}
+
+// Flush sends the queued frames, it returns when they're sent
+func (s *ringSender) Flush() error {
+	// unix.Sendto needs an address, the frames of the ring already have theirs
+	_, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(s.fd), 0, 0, 0, 0, 0)
+	if errno != 0 && errno != unix.EINTR {
+		return errno
+	}
+	return nil
+}
+
+func (s *ringSender) Close() error {
+	if s.ring != nil {
+		syscall.Munmap(s.ring)
+	}
+	return syscall.Close(s.fd)
+}
+
+// htons converts a short to network byte order
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
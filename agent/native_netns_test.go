@@ -0,0 +1,131 @@
+//go:build linux && netns
+// +build linux,netns
+
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+// the end to end test of the native scanner creates a network namespace and
+// a veth pair, it runs as root with: go test -tags netns ./agent
+
+const (
+	testNetns    = "netz-test"
+	testHostVeth = "netz-veth0"
+	testHostMAC  = "02:00:00:99:00:02"
+	testPeerVeth = "netz-veth1"
+	testPeerMAC  = "02:00:00:99:00:01"
+)
+
+func ipCommand(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %s: %s", strings.Join(args, " "), err.Error(), out)
+	}
+}
+
+// TestNetnsListener is the listener of TestNativeScansVeth, which runs the
+// test binary in the namespace to have it. It listens until stdin is closed
+func TestNetnsListener(t *testing.T) {
+	addr := os.Getenv("NETZ_TEST_LISTEN")
+	if addr == "" {
+		t.Skip("runs as the listener of TestNativeScansVeth")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fmt.Println("listening")
+	ioutil.ReadAll(os.Stdin)
+}
+
+// listenInNetns listens on the address inside the network namespace until
+// the returned function is called
+func listenInNetns(t *testing.T, netns string, addr string) func() {
+	cmd := exec.Command("ip", "netns", "exec", netns, os.Args[0], "-test.run=^TestNetnsListener$")
+	cmd.Env = append(os.Environ(), "NETZ_TEST_LISTEN="+addr)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "listening\n" {
+		stdin.Close()
+		cmd.Wait()
+		t.Fatalf("the listener didn't start: %q %v", line, err)
+	}
+	return func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+}
+
+func TestNativeScansVeth(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	cleanup := func() {
+		exec.Command("ip", "link", "del", testHostVeth).Run()
+		exec.Command("ip", "netns", "del", testNetns).Run()
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	ipCommand(t, "netns", "add", testNetns)
+	ipCommand(t, "link", "add", testHostVeth, "address", testHostMAC, "type", "veth", "peer", "name", testPeerVeth, "address", testPeerMAC)
+	ipCommand(t, "link", "set", testPeerVeth, "netns", testNetns)
+	ipCommand(t, "addr", "add", "10.99.0.2/24", "dev", testHostVeth)
+	ipCommand(t, "link", "set", testHostVeth, "up")
+	ipCommand(t, "-n", testNetns, "addr", "add", "10.99.0.1/24", "dev", testPeerVeth)
+	ipCommand(t, "-n", testNetns, "link", "set", testPeerVeth, "up")
+
+	stop := listenInNetns(t, testNetns, "10.99.0.1:8080")
+	defer stop()
+
+	spec := Spec{
+		Targets: []string{"10.99.0.1"},
+		Ports:   "8079-8081",
+		Rate:    1000,
+		// every probe is sent twice, the open port is reported once
+		Retries: 1,
+		Adapters: []masscan.Adapter{{
+			Name:      testHostVeth,
+			IP:        "10.99.0.2",
+			MAC:       testHostMAC,
+			RouterMAC: testPeerMAC,
+		}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var open []OpenPort
+	err := (&Native{Wait: 2 * time.Second}).Scan(ctx, spec, func(port OpenPort) {
+		open = append(open, port)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 1 || open[0].HostPort() != "10.99.0.1:8080" || open[0].Proto != "tcp" {
+		t.Errorf("found %v, want 10.99.0.1:8080 once", open)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import (
+	"context"
+	"errors"
+)
+
+// scan needs AF_PACKET, which only linux has
+func (n *Native) scan(ctx context.Context, plan *nativePlan, found func(OpenPort)) error {
+	return errors.New("the native scanner is only supported on linux")
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func ipv4(s string) uint32 {
+	return binary.BigEndian.Uint32(net.ParseIP(s).To4())
+}
+
+func TestTargetSetIndex(t *testing.T) {
+	include := []ipRange{{first: ipv4("10.0.0.0"), last: ipv4("10.0.0.255")}, {first: ipv4("10.0.2.0"), last: ipv4("10.0.2.15")}}
+	exclude := []ipRange{{first: ipv4("10.0.0.128"), last: ipv4("10.0.0.255")}}
+	targets := newTargetSet(include, exclude, []uint16{80, 443})
+
+	// every probe is found at its own index
+	for i := uint64(0); i < targets.size(); i++ {
+		dst, port := targets.at(i)
+		if got, ok := targets.index(dst, port); !ok || got != i {
+			t.Fatalf("index of probe %d is %d, %v", i, got, ok)
+		}
+	}
+	for _, probe := range []struct {
+		dst  string
+		port uint16
+	}{{"10.0.0.200", 80}, {"10.0.1.1", 80}, {"10.0.2.16", 443}, {"10.0.0.1", 22}} {
+		if _, ok := targets.index(ipv4(probe.dst), probe.port); ok {
+			t.Errorf("%s:%d isn't a probe of the set", probe.dst, probe.port)
+		}
+	}
+}
+
+func TestReplySet(t *testing.T) {
+	small := newTargetSet([]ipRange{{first: ipv4("10.0.0.0"), last: ipv4("10.0.255.255")}}, nil, []uint16{80, 443})
+	// 2^32 addresses on 64 ports is more probes than the bitmap takes
+	var ports []uint16
+	for port := uint16(420); port < 484; port++ {
+		ports = append(ports, port)
+	}
+	large := newTargetSet([]ipRange{{first: 0, last: ipv4("255.255.255.255")}}, nil, ports)
+
+	for name, targets := range map[string]*targetSet{"bitmap": small, "recent": large} {
+		replies := newReplySet(targets)
+		if (replies.bits != nil) != (name == "bitmap") {
+			t.Fatalf("%s: the set of %d probes has a bitmap %v", name, targets.size(), replies.bits != nil)
+		}
+		for _, dst := range []string{"10.0.0.1", "10.0.3.7"} {
+			if !replies.add(ipv4(dst), 443) {
+				t.Errorf("%s: first reply of %s:443 was a duplicate", name, dst)
+			}
+			if replies.add(ipv4(dst), 443) {
+				t.Errorf("%s: second reply of %s:443 was reported", name, dst)
+			}
+		}
+		if !replies.add(ipv4("10.0.0.1"), 80) && name == "bitmap" {
+			t.Errorf("%s: 10.0.0.1:80 was taken for 10.0.0.1:443", name)
+		}
+		if !replies.add(ipv4("10.0.0.1"), 442) && name == "recent" {
+			t.Errorf("%s: 10.0.0.1:442 was taken for 10.0.0.1:443", name)
+		}
+	}
+}
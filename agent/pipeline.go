@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultQueueSize       = 10000
+	defaultMetricsInterval = 10 * time.Second
+)
+
+// Pipeline streams the open ports of a scan to a prober through a bounded
+// queue, so the probes start with the first open port instead of after the
+// scan. The scan waits while the queue is full
+type Pipeline struct {
+	Scanner PortScanner
+	Prober  Prober
+	// QueueSize is the number of open ports waiting for the prober
+	QueueSize int
+	// Metrics gets the back-pressure metrics every MetricsInterval
+	Metrics         io.Writer
+	MetricsInterval time.Duration
+
+	found   int64
+	probed  int64
+	blocked int64
+	queue   chan OpenPort
+}
+
+// PipelineStats are the back-pressure metrics of a pipeline, the probe stage
+// falls behind when the queue is full and the scan is blocked
+type PipelineStats struct {
+	Found     int64 `json:"found"`
+	Probed    int64 `json:"probed"`
+	Queued    int   `json:"queued"`
+	QueueSize int   `json:"queue_size"`
+	// Blocked is how long the scan waited for room in the queue
+	Blocked time.Duration `json:"blocked"`
+}
+
+func (s PipelineStats) String() string {
+	return fmt.Sprintf("%d found, %d probed, queue %d/%d, %d in flight, scan blocked %s",
+		s.Found, s.Probed, s.Queued, s.QueueSize, s.InFlight(), s.Blocked.Round(time.Millisecond))
+}
+
+// InFlight is the number of ports the prober took from the queue and has no
+// result for yet
+func (s PipelineStats) InFlight() int64 {
+	return s.Found - s.Probed - int64(s.Queued)
+}
+
+// Stats returns the metrics of the pipeline so far
+func (p *Pipeline) Stats() PipelineStats {
+	return PipelineStats{
+		Found:     atomic.LoadInt64(&p.found),
+		Probed:    atomic.LoadInt64(&p.probed),
+		Queued:    len(p.queue),
+		QueueSize: cap(p.queue),
+		Blocked:   time.Duration(atomic.LoadInt64(&p.blocked)),
+	}
+}
+
+// Run runs the scan and the probes, open is called with every open port and
+// result with every result of the prober
+func (p *Pipeline) Run(ctx context.Context, spec Spec, open func(OpenPort), result func(ProbeResult)) error {
+	size := p.QueueSize
+	if size < 1 {
+		size = DefaultQueueSize
+	}
+	p.queue = make(chan OpenPort, size)
+
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+
+	scanning := int32(1)
+	var probeErr error
+	probeDone := make(chan struct{})
+	go func() {
+		defer close(probeDone)
+		probeErr = p.Prober.Probe(ctx, p.queue, func(r ProbeResult) {
+			atomic.AddInt64(&p.probed, 1)
+			result(r)
+		})
+		if probeErr == nil && atomic.LoadInt32(&scanning) == 1 {
+			probeErr = errors.New("stopped before the scan")
+		}
+		// the scan is pointless without the probes
+		cancelScan()
+	}()
+
+	metricsDone := make(chan struct{})
+	if p.Metrics != nil {
+		go p.report(probeDone, metricsDone)
+	} else {
+		close(metricsDone)
+	}
+
+	scanErr := p.Scanner.Scan(scanCtx, spec, func(port OpenPort) {
+		atomic.AddInt64(&p.found, 1)
+		open(port)
+		select {
+		case p.queue <- port:
+			return
+		default:
+		}
+		start := time.Now()
+		select {
+		case p.queue <- port:
+		case <-probeDone:
+		case <-scanCtx.Done():
+		}
+		atomic.AddInt64(&p.blocked, int64(time.Since(start)))
+	})
+	atomic.StoreInt32(&scanning, 0)
+	close(p.queue)
+	<-probeDone
+	<-metricsDone
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if probeErr != nil {
+		return fmt.Errorf("%s failed: %s", p.Prober.Name(), probeErr.Error())
+	}
+	return scanErr
+}
+
+// report writes the metrics every interval until the probes are done, and
+// once more with the totals
+func (p *Pipeline) report(probeDone chan struct{}, done chan struct{}) {
+	defer close(done)
+	interval := p.MetricsInterval
+	if interval == 0 {
+		interval = defaultMetricsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last PipelineStats
+	for {
+		select {
+		case <-ticker.C:
+			stats := p.Stats()
+			line := fmt.Sprintf("pipeline: %s", stats)
+			// the scan waited on the probes since the last metrics, or is waiting
+			if stats.Blocked > last.Blocked || stats.Queued == stats.QueueSize {
+				line += fmt.Sprintf(", the probe stage is falling behind (%d probed/s, %d found/s)",
+					int64(float64(stats.Probed-last.Probed)/interval.Seconds()),
+					int64(float64(stats.Found-last.Found)/interval.Seconds()))
+			}
+			fmt.Fprintln(p.Metrics, line)
+			last = stats
+		case <-probeDone:
+			fmt.Fprintf(p.Metrics, "pipeline: done, %s\n", p.Stats())
+			return
+		}
+	}
+}
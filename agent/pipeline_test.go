@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeScanner finds the ports 1 to ports of 192.0.2.1
+type fakeScanner struct {
+	name  string
+	ports int
+	err   error
+	// spec is the spec of the last scan
+	spec Spec
+	// returned is the number of calls to found that returned
+	returned int64
+}
+
+func (s *fakeScanner) Name() string {
+	return orDefault(s.name, "fake")
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, spec Spec, found func(OpenPort)) error {
+	s.spec = spec
+	for port := 1; port <= s.ports; port++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		found(OpenPort{IP: "192.0.2.1", Port: port, Proto: "tcp"})
+		atomic.AddInt64(&s.returned, 1)
+	}
+	return s.err
+}
+
+// fakeProber probes one port at a time after release is closed
+type fakeProber struct {
+	release chan struct{}
+	delay   time.Duration
+	err     error
+	// stop returns before the queue is closed
+	stop bool
+}
+
+func (p *fakeProber) Name() string {
+	return "fake"
+}
+
+func (p *fakeProber) Probe(ctx context.Context, ports <-chan OpenPort, found func(ProbeResult)) error {
+	if p.release != nil {
+		<-p.release
+	}
+	if p.err != nil || p.stop {
+		return p.err
+	}
+	for port := range ports {
+		time.Sleep(p.delay)
+		result := ProbeResult{IP: port.IP, Port: port.Port}
+		result.Raw, _ = json.Marshal(result)
+		found(result)
+	}
+	return nil
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	scanner := &fakeScanner{ports: 5}
+	prober := &fakeProber{release: make(chan struct{}), delay: time.Millisecond}
+	var metrics bytes.Buffer
+	p := &Pipeline{
+		Scanner:         scanner,
+		Prober:          prober,
+		QueueSize:       2,
+		Metrics:         &metrics,
+		MetricsInterval: 5 * time.Millisecond,
+	}
+
+	var opened int64
+	var results []int
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run(context.Background(), Spec{}, func(OpenPort) {
+			atomic.AddInt64(&opened, 1)
+		}, func(r ProbeResult) {
+			results = append(results, r.Port)
+		})
+	}()
+
+	// the third port waits for room in the queue of two
+	waitFor(t, "the third open port", func() bool { return atomic.LoadInt64(&opened) == 3 })
+	time.Sleep(50 * time.Millisecond)
+	if returned := atomic.LoadInt64(&scanner.returned); returned != 2 {
+		t.Fatalf("the scan went on with %d ports for a full queue", returned)
+	}
+	if found := atomic.LoadInt64(&opened); found != 3 {
+		t.Fatalf("the scan found %d ports while the queue was full", found)
+	}
+
+	close(prober.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(results, want) {
+		t.Errorf("got results of ports %v, want %v", results, want)
+	}
+	stats := p.Stats()
+	if stats.Found != 5 || stats.Probed != 5 || stats.Queued != 0 || stats.QueueSize != 2 || stats.InFlight() != 0 {
+		t.Errorf("got stats %s", stats)
+	}
+	if stats.Blocked < 50*time.Millisecond {
+		t.Errorf("the scan was blocked for %v", stats.Blocked)
+	}
+	if !strings.Contains(metrics.String(), "the probe stage is falling behind") {
+		t.Errorf("no back-pressure in the metrics:\n%s", metrics.String())
+	}
+	if !strings.Contains(metrics.String(), "pipeline: done, 5 found, 5 probed, queue 0/2") {
+		t.Errorf("no totals in the metrics:\n%s", metrics.String())
+	}
+}
+
+func TestPipelineErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		scanner *fakeScanner
+		prober  *fakeProber
+		err     string
+		probed  int
+	}{
+		{
+			name:    "scan failed",
+			scanner: &fakeScanner{ports: 2, err: errors.New("no adapter")},
+			prober:  &fakeProber{},
+			err:     "no adapter",
+			probed:  2,
+		},
+		{
+			name:    "probes failed",
+			scanner: &fakeScanner{ports: 5},
+			prober:  &fakeProber{err: errors.New("no zgrab2")},
+			err:     "fake failed: no zgrab2",
+		},
+		{
+			name:    "probes stopped before the scan",
+			scanner: &fakeScanner{ports: 5},
+			prober:  &fakeProber{stop: true},
+			err:     "fake failed: stopped before the scan",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pipeline{Scanner: tt.scanner, Prober: tt.prober, QueueSize: 1}
+			probed := 0
+			err := p.Run(context.Background(), Spec{}, func(OpenPort) {}, func(ProbeResult) { probed++ })
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+			if probed != tt.probed {
+				t.Errorf("probed %d ports, want %d", probed, tt.probed)
+			}
+		})
+	}
+}
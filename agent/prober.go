@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ProbeResult is the result of probing an open port, in the JSON of zgrab2 so
+// the same filters run on the results of every prober
+type ProbeResult struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port,omitempty"`
+	// Raw is the JSON record of the result
+	Raw json.RawMessage `json:"-"`
+}
+
+// Prober probes the open ports it reads from ports until it's closed, and
+// calls found with every result. The scan is slowed down while the prober
+// doesn't keep up
+type Prober interface {
+	Name() string
+	Probe(ctx context.Context, ports <-chan OpenPort, found func(ProbeResult)) error
+}
+
+// Probers are the names of the probers
+var Probers = []string{"zgrab2", "http"}
+
+// NewProber returns the prober of the name, zgrab2 with its binary in PATH
+func NewProber(name string) (Prober, error) {
+	switch name {
+	case "zgrab2":
+		return &ZGrab2{}, nil
+	case "http":
+		return &HTTPProber{}, nil
+	}
+	return nil, fmt.Errorf("unknown prober %q, must be one of %s", name, strings.Join(Probers, ", "))
+}
@@ -0,0 +1,150 @@
+// Package agent runs the scan stages inside the scan container. Port scans go
+// through a PortScanner, so masscan, zmap and the native scanner take the
+// same spec and report open ports the same way
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+// interruptGrace is how long an interrupted scan has to exit, masscan waits
+// 10 seconds for the last replies before it saves paused.conf
+const interruptGrace = 30 * time.Second
+
+// Spec is a port scan, in terms every backend translates to its own config
+type Spec struct {
+	// Targets are addresses, CIDRs or first-last ranges
+	Targets []string `json:"targets"`
+	// TargetFiles are files of targets, such as IPv6 hitlists
+	TargetFiles []string `json:"target_files,omitempty"`
+	// Ports is a port list such as "80,443,8000-8100", with U: for UDP
+	Ports       string            `json:"ports"`
+	Rate        int               `json:"rate"`
+	Excludes    []string          `json:"excludes,omitempty"`
+	ExcludeFile string            `json:"exclude_file,omitempty"`
+	Adapters    []masscan.Adapter `json:"adapters,omitempty"`
+	// Seed must be the same for every shard of a scan
+	Seed    int64          `json:"seed,omitempty"`
+	Shard   *masscan.Shard `json:"shard,omitempty"`
+	Retries int            `json:"retries,omitempty"`
+}
+
+// SpecFromConfig returns the spec of a masscan config
+func SpecFromConfig(conf *masscan.Config) Spec {
+	return Spec{
+		Targets:     conf.Ranges,
+		TargetFiles: conf.IncludeFiles,
+		Ports:       conf.Ports,
+		Rate:        conf.Rate,
+		Excludes:    conf.Excludes,
+		ExcludeFile: conf.ExcludeFile,
+		Adapters:    conf.Adapters,
+		Seed:        conf.Seed,
+		Shard:       conf.Shard,
+		Retries:     conf.Retries,
+	}
+}
+
+// OpenPort is a port found open by a scan
+type OpenPort struct {
+	IP    string    `json:"ip"`
+	Port  int       `json:"port"`
+	Proto string    `json:"proto"`
+	Time  time.Time `json:"time"`
+}
+
+// HostPort returns the address of the port, IPv6 addresses in brackets
+func (p OpenPort) HostPort() string {
+	return joinHostPort(p.IP, p.Port)
+}
+
+// PortScanner runs a port scan and calls found with every open port as it's
+// found, the scan is slowed down while found blocks
+type PortScanner interface {
+	Name() string
+	Scan(ctx context.Context, spec Spec, found func(OpenPort)) error
+}
+
+// PortScanners are the names of the backends
+var PortScanners = []string{"masscan", "zmap", "native"}
+
+// NewPortScanner returns the backend of the name, with its binary in PATH
+func NewPortScanner(name string) (PortScanner, error) {
+	switch name {
+	case "masscan":
+		return &Masscan{}, nil
+	case "zmap":
+		return &ZMap{}, nil
+	case "native":
+		return &Native{}, nil
+	}
+	return nil, fmt.Errorf("unknown port scanner %q, must be one of %s", name, strings.Join(PortScanners, ", "))
+}
+
+// run runs the command and parses every line of its output, lines that
+// aren't open ports are skipped. When ctx is done the command is interrupted
+// the way Ctrl-C does, so masscan saves where it stopped, and it's killed
+// when it doesn't exit within interruptGrace
+func run(ctx context.Context, cmd *exec.Cmd, parse func(line string) (OpenPort, bool), found func(OpenPort)) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+		cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-time.After(interruptGrace):
+			cmd.Process.Kill()
+		case <-exited:
+		}
+	}()
+
+	s := bufio.NewScanner(stdout)
+	for s.Scan() {
+		if port, ok := parse(s.Text()); ok {
+			found(port)
+		}
+	}
+	// the rest of the output is drained so the command doesn't block on it
+	io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", cmd.Path, err.Error())
+	}
+	return s.Err()
+}
+
+func joinHostPort(ip string, port int) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf("[%s]:%d", ip, port)
+	}
+	return fmt.Sprintf("%s:%d", ip, port)
+}
+
+// unbracket removes the brackets around an IPv6 address
+func unbracket(ip string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+}
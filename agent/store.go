@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// CheckpointStore keeps the checkpoints of scans where they outlive the
+// instance, or at least the container
+type CheckpointStore interface {
+	// Get returns the object of the name, os.ErrNotExist when there's none
+	Get(ctx context.Context, name string) ([]byte, error)
+	Put(ctx context.Context, name string, body []byte) error
+	// List returns the names of the objects under the prefix, sorted
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// NewCheckpointStore returns the store of a location, s3://bucket/prefix or
+// a local directory
+func NewCheckpointStore(location string) (CheckpointStore, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return &DirStore{Dir: location}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid checkpoint location %q, must be s3://bucket/prefix", location)
+	}
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	// the container doesn't know the region of the bucket
+	region, err := s3manager.GetBucketRegion(context.Background(), sess, u.Host, "us-east-1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the region of bucket %s: %s", u.Host, err.Error())
+	}
+	return &S3Store{
+		Client: s3.New(sess, aws.NewConfig().WithRegion(region)),
+		Bucket: u.Host,
+		Prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// NewRunCheckpointStore returns the store of the checkpoints of the run under
+// the location
+func NewRunCheckpointStore(location string, runID string) (CheckpointStore, error) {
+	return NewCheckpointStore(strings.TrimSuffix(location, "/") + "/" + runID)
+}
+
+// DirStore keeps the checkpoints in a directory
+type DirStore struct {
+	Dir string
+}
+
+func (d *DirStore) Get(ctx context.Context, name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(d.Dir, filepath.FromSlash(name)))
+}
+
+// Put writes the object atomically, an interrupted Put leaves the previous one
+func (d *DirStore) Put(ctx context.Context, name string, body []byte) error {
+	file := filepath.Join(d.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func (d *DirStore) List(ctx context.Context, prefix string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(d.Dir, filepath.FromSlash(prefix)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && !strings.HasSuffix(f.Name(), ".tmp") {
+			names = append(names, path.Join(prefix, f.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// S3Store keeps the checkpoints in a bucket, under a prefix
+type S3Store struct {
+	Client *s3.S3
+	Bucket string
+	Prefix string
+}
+
+func (s *S3Store) key(name string) string {
+	return path.Join(s.Prefix, name)
+}
+
+func (s *S3Store) Get(ctx context.Context, name string) ([]byte, error) {
+	out, err := s.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+func (s *S3Store) Put(ctx context.Context, name string, body []byte) error {
+	_, err := s.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := s.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.key(prefix) + "/"),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			names = append(names, strings.TrimPrefix(strings.TrimPrefix(aws.StringValue(object.Key), s.Prefix), "/"))
+		}
+		return true
+	})
+	sort.Strings(names)
+	return names, err
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDirStore(t *testing.T) {
+	ctx := context.Background()
+	store := &DirStore{Dir: filepath.Join(t.TempDir(), "run-1")}
+
+	if _, err := store.Get(ctx, checkpointFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v for a missing object", err)
+	}
+	if names, err := store.List(ctx, "scan/open-ports"); err != nil || names != nil {
+		t.Errorf("listed %v, %v in a missing directory", names, err)
+	}
+
+	for _, name := range []string{"scan/open-ports/b.jsonl", "scan/open-ports/a.jsonl", "scan/probes/a.jsonl", checkpointFile} {
+		if err := store.Put(ctx, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a replaced object has the new body
+	if err := store.Put(ctx, checkpointFile, []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := store.Get(ctx, checkpointFile); err != nil || string(body) != "replaced" {
+		t.Errorf("got %q, %v", body, err)
+	}
+	// an interrupted Put leaves its temporary file, it isn't an object
+	if err := ioutil.WriteFile(filepath.Join(store.Dir, "scan", "open-ports", "c.jsonl.tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := store.List(ctx, "scan/open-ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"scan/open-ports/a.jsonl", "scan/open-ports/b.jsonl"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+	for _, name := range names {
+		if body, err := store.Get(ctx, name); err != nil || string(body) != name {
+			t.Errorf("got %q, %v for %s", body, err, name)
+		}
+	}
+	// the objects, not the prefixes under the prefix
+	if names, err := store.List(ctx, "scan"); err != nil || names != nil {
+		t.Errorf("listed %v, %v", names, err)
+	}
+}
+
+func TestNewCheckpointStore(t *testing.T) {
+	tests := []struct {
+		location string
+		runID    string
+		dir      string
+		err      bool
+	}{
+		{location: "/opt/results/checkpoints", runID: "run-1", dir: "/opt/results/checkpoints/run-1"},
+		{location: "/opt/results/checkpoints/", runID: "run-1", dir: "/opt/results/checkpoints/run-1"},
+		{location: "s3:///netz", runID: "run-1", err: true},
+		{location: "s3://", runID: "run-1", err: true},
+	}
+	for _, tt := range tests {
+		store, err := NewRunCheckpointStore(tt.location, tt.runID)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v", tt.location, err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if dir, ok := store.(*DirStore); !ok || dir.Dir != tt.dir {
+			t.Errorf("%s: got store %#v, want directory %s", tt.location, store, tt.dir)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// ZGrab2 probes the open ports with zgrab2 multiple, the targets are streamed
+// to it as they're found
+type ZGrab2 struct {
+	// Path of the binary, zgrab2 in PATH when empty
+	Path string
+	// ConfigPath is the ini of the modules, zgrab2.ini when empty
+	ConfigPath string
+	// Stderr gets the status of zgrab2
+	Stderr io.Writer
+}
+
+func (z *ZGrab2) Name() string {
+	return "zgrab2"
+}
+
+func (z *ZGrab2) Probe(ctx context.Context, ports <-chan OpenPort, found func(ProbeResult)) error {
+	cmd := exec.CommandContext(ctx, orDefault(z.Path, "zgrab2"), "multiple", "-c", orDefault(z.ConfigPath, "zgrab2.ini"))
+	cmd.Stderr = z.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		defer stdin.Close()
+		w := bufio.NewWriter(stdin)
+		for port := range ports {
+			if _, err := fmt.Fprintln(w, zgrab2Target(port)); err != nil {
+				break
+			}
+			// zgrab2 gets the targets as they come, not when the buffer fills
+			if len(ports) == 0 {
+				w.Flush()
+			}
+		}
+		w.Flush()
+	}()
+
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		if result, ok := parseZGrab2(s.Bytes()); ok {
+			found(result)
+		}
+	}
+	io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", cmd.Path, err.Error())
+	}
+	return s.Err()
+}
+
+// zgrab2Target is the input line of zgrab2 for the port, "ip, domain, tag,
+// port" with the IPv6 addresses without brackets
+func zgrab2Target(port OpenPort) string {
+	return fmt.Sprintf("%s,,,%d", unbracket(port.IP), port.Port)
+}
+
+// parseZGrab2 parses a line of the output of zgrab2
+func parseZGrab2(line []byte) (ProbeResult, bool) {
+	var result ProbeResult
+	if err := json.Unmarshal(line, &result); err != nil || result.IP == "" {
+		return ProbeResult{}, false
+	}
+	result.Raw = append(json.RawMessage(nil), line...)
+	return result, true
+}
@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZMap runs scans with zmap. zmap scans a single TCP port of IPv4 targets
+// from a single adapter, and can't open PF_RING ZC adapters
+type ZMap struct {
+	// Path of the binary, zmap in PATH when empty
+	Path string
+	// Stderr gets the status of zmap
+	Stderr io.Writer
+}
+
+func (z *ZMap) Name() string {
+	return "zmap"
+}
+
+// Args returns the arguments of zmap for the spec, with the files it writes
+// the targets and excludes to. The files are removed by cleanup
+func (z *ZMap) Args(spec Spec) (args []string, cleanup func(), err error) {
+	var files []string
+	removeFiles := func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+	defer func() {
+		if err != nil {
+			removeFiles()
+		}
+	}()
+
+	port, err := zmapPort(spec.Ports)
+	if err != nil {
+		return nil, nil, err
+	}
+	if spec.Rate < 1 {
+		return nil, nil, fmt.Errorf("rate %d must be positive", spec.Rate)
+	}
+	args = []string{
+		"--target-port", strconv.Itoa(port),
+		"--rate", strconv.Itoa(spec.Rate),
+		"--output-file", "-",
+		"--output-module", "csv",
+		"--output-fields", "saddr,sport,timestamp_ts",
+		"--output-filter", "success = 1 && repeat = 0",
+	}
+
+	switch len(spec.Adapters) {
+	case 0:
+	case 1:
+		adapter := spec.Adapters[0]
+		if strings.HasPrefix(adapter.Name, "zc:") {
+			return nil, nil, fmt.Errorf("zmap can't open the PF_RING ZC adapter %s", adapter.Name)
+		}
+		args = append(args, "--interface", adapter.Name)
+		if adapter.IP != "" {
+			args = append(args, "--source-ip", adapter.IP)
+		}
+		if adapter.MAC != "" {
+			args = append(args, "--source-mac", adapter.MAC)
+		}
+		if adapter.RouterMAC != "" {
+			args = append(args, "--gateway-mac", adapter.RouterMAC)
+		}
+	default:
+		return nil, nil, fmt.Errorf("zmap sends from a single adapter, %d given", len(spec.Adapters))
+	}
+
+	if spec.Seed != 0 {
+		args = append(args, "--seed", strconv.FormatInt(spec.Seed, 10))
+	}
+	if spec.Shard != nil {
+		if spec.Seed == 0 {
+			return nil, nil, errors.New("zmap needs a seed to shard a scan")
+		}
+		args = append(args, "--shards", strconv.Itoa(spec.Shard.Total), "--shard", strconv.Itoa(spec.Shard.ID-1))
+	}
+	if spec.Retries > 0 {
+		args = append(args, "--probes", strconv.Itoa(spec.Retries+1))
+	}
+
+	// zmap takes a single file of excludes and a single file of targets
+	if len(spec.Excludes) > 0 || spec.ExcludeFile != "" {
+		var excludeFiles []string
+		if spec.ExcludeFile != "" {
+			excludeFiles = append(excludeFiles, spec.ExcludeFile)
+		}
+		file, err := writeRanges("zmap-blocklist-*.txt", spec.Excludes, excludeFiles...)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, file)
+		args = append(args, "--blacklist-file", file)
+	}
+	if len(spec.TargetFiles) > 0 {
+		file, err := writeRanges("zmap-allowlist-*.txt", nil, spec.TargetFiles...)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, file)
+		args = append(args, "--whitelist-file", file)
+	}
+
+	for _, target := range append(append([]string(nil), spec.Targets...), spec.Excludes...) {
+		if strings.Contains(target, ":") {
+			return nil, nil, fmt.Errorf("zmap doesn't scan IPv6, %s", target)
+		}
+	}
+	for _, target := range spec.Targets {
+		if strings.Contains(target, "-") {
+			return nil, nil, fmt.Errorf("zmap takes CIDRs, %s", target)
+		}
+	}
+	args = append(args, spec.Targets...)
+	return args, removeFiles, nil
+}
+
+// zmapPort returns the single TCP port of a port list
+func zmapPort(ports string) (int, error) {
+	spec := strings.TrimPrefix(strings.TrimSpace(ports), "T:")
+	port, err := strconv.Atoi(spec)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("zmap scans a single TCP port, %q given", ports)
+	}
+	return port, nil
+}
+
+// writeRanges writes the ranges and the content of the files to a new file
+func writeRanges(pattern string, ranges []string, files ...string) (string, error) {
+	f, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, r := range ranges {
+		fmt.Fprintln(f, r)
+	}
+	for _, file := range files {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+		f.Write(body)
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			fmt.Fprintln(f)
+		}
+	}
+	return f.Name(), nil
+}
+
+func (z *ZMap) Scan(ctx context.Context, spec Spec, found func(OpenPort)) error {
+	args, cleanup, err := z.Args(spec)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	cmd := exec.Command(orDefault(z.Path, "zmap"), args...)
+	cmd.Stderr = z.Stderr
+	return run(ctx, cmd, parseZMapCSV, found)
+}
+
+// parseZMapCSV parses a line of the csv output of zmap with the saddr, sport
+// and timestamp_ts fields, such as "192.0.2.1,80,1600000000"
+func parseZMapCSV(line string) (OpenPort, bool) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) < 3 {
+		return OpenPort{}, false
+	}
+	// the header and anything else that isn't a result
+	port, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return OpenPort{}, false
+	}
+	seconds, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return OpenPort{}, false
+	}
+	return OpenPort{
+		IP:    fields[0],
+		Port:  port,
+		Proto: "tcp",
+		Time:  time.Unix(seconds, 0).UTC(),
+	}, true
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseZMapCSV(t *testing.T) {
+	tests := []struct {
+		line string
+		want OpenPort
+		ok   bool
+	}{
+		{line: "192.0.2.1,80,1600000000", want: OpenPort{IP: "192.0.2.1", Port: 80, Proto: "tcp", Time: time.Unix(1600000000, 0).UTC()}, ok: true},
+		{line: "192.0.2.1,443,1600000001\r\n", want: OpenPort{IP: "192.0.2.1", Port: 443, Proto: "tcp", Time: time.Unix(1600000001, 0).UTC()}, ok: true},
+		// fields after the requested ones are ignored
+		{line: "192.0.2.2,22,1600000002,synack", want: OpenPort{IP: "192.0.2.2", Port: 22, Proto: "tcp", Time: time.Unix(1600000002, 0).UTC()}, ok: true},
+		// the header of the csv output
+		{line: "saddr,sport,timestamp_ts"},
+		{line: ""},
+		// malformed lines
+		{line: "192.0.2.1,80"},
+		{line: "192.0.2.1 80 1600000000"},
+		{line: "192.0.2.1,http,1600000000"},
+		{line: "192.0.2.1,80,2020-09-13T12:26:40Z"},
+	}
+	for _, tt := range tests {
+		got, ok := parseZMapCSV(tt.line)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseZMapCSV(%q) = %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestZMapPort(t *testing.T) {
+	tests := []struct {
+		ports string
+		want  int
+		err   bool
+	}{
+		{ports: "80", want: 80},
+		{ports: " T:443 ", want: 443},
+		{ports: "80,443", err: true},
+		{ports: "8000-8100", err: true},
+		{ports: "U:53", err: true},
+		{ports: "65536", err: true},
+	}
+	for _, tt := range tests {
+		got, err := zmapPort(tt.ports)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("zmapPort(%q) = %d, %v", tt.ports, got, err)
+		}
+	}
+}
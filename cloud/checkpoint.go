@@ -0,0 +1,82 @@
+package cloud
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// DefaultCheckpointLocation is where the scan container checkpoints its scan
+// by default, the results directory on the instance. It survives the task
+// but not the instance, s3://bucket/prefix survives both
+const DefaultCheckpointLocation = resultsDir + "/checkpoints"
+
+// CheckpointEnvironment returns the environment of the scan container that
+// checkpoints its scan under the run id, or resumes the checkpointed scan of
+// the resume run when it's set, that run may be another one
+func CheckpointEnvironment(runID string, location string, resume string) map[string]string {
+	if location == "" {
+		location = DefaultCheckpointLocation
+	}
+	env := map[string]string{
+		"RUN_ID":         runID,
+		"CHECKPOINT_URL": location,
+	}
+	if resume != "" {
+		env["CHECKPOINT_RESUME"] = resume
+	}
+	return env
+}
+
+// checkpointPolicy returns the role policy that lets the scan container read
+// and write the objects under an S3 checkpoint location, nothing when the
+// checkpoints are kept on the instance
+func checkpointPolicy(location string) (string, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return "", nil
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid checkpoint location %q, must be s3://bucket/prefix", location)
+	}
+	bucket := u.Host
+	objects := bucket + "/*"
+	if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+		objects = bucket + "/" + prefix + "/*"
+	}
+
+	// listing the bucket makes a missing checkpoint NoSuchKey instead of
+	// AccessDenied, the objects are only those under the prefix
+	return fmt.Sprintf(`{
+		"Version": "2012-10-17",
+		"Statement": [
+		  {
+			"Effect": "Allow",
+			"Action": [
+			  "s3:GetBucketLocation",
+			  "s3:ListBucket"
+			],
+			"Resource": [
+			  "arn:aws:s3:::%s"
+			]
+		  },
+		  {
+			"Effect": "Allow",
+			"Action": [
+			  "s3:GetObject",
+			  "s3:PutObject"
+			],
+			"Resource": [
+			  "arn:aws:s3:::%s"
+			]
+		  }
+		]
+	  }
+	`, bucket, objects), nil
+}
+
+// checkpointPolicyName is the name of the checkpoint policy of a run, every
+// run has its own on the role the runs share
+func checkpointPolicyName(rolePolicyName string, runID string) string {
+	return rolePolicyName + "-" + runID
+}
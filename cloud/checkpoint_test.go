@@ -0,0 +1,50 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestCheckpointPolicy(t *testing.T) {
+	tests := []struct {
+		location  string
+		resources []string
+		err       bool
+	}{
+		{location: DefaultCheckpointLocation},
+		{location: "/tmp/checkpoints"},
+		{location: "s3://bucket", resources: []string{"arn:aws:s3:::bucket", "arn:aws:s3:::bucket/*"}},
+		{location: "s3://bucket/netz/", resources: []string{"arn:aws:s3:::bucket", "arn:aws:s3:::bucket/netz/*"}},
+		{location: "s3:///netz", err: true},
+	}
+	for _, tt := range tests {
+		doc, err := checkpointPolicy(tt.location)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v", tt.location, err)
+			continue
+		}
+		if doc == "" {
+			if tt.resources != nil {
+				t.Errorf("%s: no policy", tt.location)
+			}
+			continue
+		}
+
+		var policy struct {
+			Statement []struct {
+				Resource []string
+			}
+		}
+		if err := json.Unmarshal([]byte(doc), &policy); err != nil {
+			t.Fatalf("%s: invalid policy: %s", tt.location, err.Error())
+		}
+		var resources []string
+		for _, statement := range policy.Statement {
+			resources = append(resources, statement.Resource...)
+		}
+		if fmt.Sprint(resources) != fmt.Sprint(tt.resources) {
+			t.Errorf("%s: got resources %v, want %v", tt.location, resources, tt.resources)
+		}
+	}
+}
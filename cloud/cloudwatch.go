@@ -7,40 +7,60 @@ import (
 	"sync"
 	"time"
 
-	log "github.com/cmpxchg16/netz/logger"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 )
 
 const (
 	defaultLogTimeout      = time.Minute * 120
 	defaultLogPollInterval = time.Second * 5
+	defaultLogPollMaxDelay = time.Second * 30
+	defaultLogDedupWindow  = time.Minute
+	defaultLogMaxErrors    = 5
+	// how long a watcher keeps polling for late events after its task stopped
+	defaultLogDrainTimeout = time.Minute * 2
+	// polls without new events that end the drain
+	logDrainQuietPolls = 2
 )
 
 type cloudwatchLogsInterface interface {
-	DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput,
-		fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error
-	DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
-	PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error)
-	FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput,
-		fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error
+	DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput,
+		fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error
+	PutLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.PutLogEventsInput,
+		opts ...request.Option) (*cloudwatchlogs.PutLogEventsOutput, error)
+	FilterLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput,
+		opts ...request.Option) (*cloudwatchlogs.FilterLogEventsOutput, error)
+	DescribeLogGroupsWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogGroupsInput,
+		opts ...request.Option) (*cloudwatchlogs.DescribeLogGroupsOutput, error)
+	StartLiveTailWithContext(ctx aws.Context, input *cloudwatchlogs.StartLiveTailInput,
+		opts ...request.Option) (*cloudwatchlogs.StartLiveTailOutput, error)
+	CreateLogGroupWithContext(ctx aws.Context, input *cloudwatchlogs.CreateLogGroupInput,
+		opts ...request.Option) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	PutRetentionPolicyWithContext(ctx aws.Context, input *cloudwatchlogs.PutRetentionPolicyInput,
+		opts ...request.Option) (*cloudwatchlogs.PutRetentionPolicyOutput, error)
+	CreateLogStreamWithContext(ctx aws.Context, input *cloudwatchlogs.CreateLogStreamInput,
+		opts ...request.Option) (*cloudwatchlogs.CreateLogStreamOutput, error)
+	DeleteLogStreamWithContext(ctx aws.Context, input *cloudwatchlogs.DeleteLogStreamInput,
+		opts ...request.Option) (*cloudwatchlogs.DeleteLogStreamOutput, error)
 }
 
 type logWaiter struct {
 	CloudWatchLogs cloudwatchLogsInterface
+	Logger         Logger
 
 	LogGroupName  string
 	LogStreamName string
 
 	Interval time.Duration
 	Timeout  time.Duration
+	// MaxErrors is how many consecutive errors are retried before giving up
+	MaxErrors int
 }
 
 // streamExists checks the log group for a specific log stream
-func (lw *logWaiter) streamExists() (bool, error) {
+func (lw *logWaiter) streamExists(ctx context.Context) (bool, error) {
 	params := &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName:        aws.String(lw.LogGroupName),
 		LogStreamNamePrefix: aws.String(lw.LogStreamName),
@@ -48,26 +68,28 @@ func (lw *logWaiter) streamExists() (bool, error) {
 	}
 
 	var exists bool
-	err := lw.CloudWatchLogs.DescribeLogStreamsPages(params,
+	err := lw.CloudWatchLogs.DescribeLogStreamsPagesWithContext(ctx, params,
 		func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
 			for _, stream := range page.LogStreams {
-				// return early if we match the log stream
+				// stop early if we match the log stream
 				if *stream.LogStreamName == lw.LogStreamName {
 					exists = true
-					return true
+					return false
 				}
 			}
-			return lastPage
+			return !lastPage
 		})
 
 	return exists, err
 }
 
+func (lw *logWaiter) logger() Logger {
+	return streamLogger(lw.Logger, lw.LogGroupName, lw.LogStreamName)
+}
+
 // Wait waits for a log stream to exist
 func (lw *logWaiter) Wait(ctx context.Context) error {
-	log.Logger.Infof("waiting for log stream %s to exist...", lw.LogStreamName)
-	t := time.Now()
-
+	ctx = withLogger(ctx, lw.logger())
 	pollInterval := lw.Interval
 	if pollInterval == time.Duration(0) {
 		pollInterval = defaultLogPollInterval
@@ -78,43 +100,44 @@ func (lw *logWaiter) Wait(ctx context.Context) error {
 		timeout = defaultLogTimeout
 	}
 
-	ticker := time.NewTicker(pollInterval)
-	defer ticker.Stop()
-	done := make(chan bool)
-	go func() {
-		time.Sleep(timeout)
-		done <- true
-	}()
+	maxErrors := lw.MaxErrors
+	if maxErrors == 0 {
+		maxErrors = defaultLogMaxErrors
+	}
 
-	for {
-		exists, err := lw.streamExists()
+	w := newWaiter(fmt.Sprintf("log stream %s to exist", lw.LogStreamName), WaiterConfig{
+		Timeout:   timeout,
+		MinDelay:  pollInterval,
+		MaxDelay:  defaultLogPollMaxDelay,
+		MaxErrors: maxErrors,
+	})
+	return w.Wait(ctx, func(ctx context.Context) (bool, error) {
+		exists, err := lw.streamExists(ctx)
 
 		// handle rate-limiting errors which seem to occur during
-		// excessive polling operations
+		// excessive polling operations, the waiter backs off without
+		// spending the error budget
 		if isRateLimited(err) {
-			time.Sleep(5 * time.Second)
-			continue
-		} else if err != nil {
-			//return err
-			continue
-		} else if exists {
-			log.Logger.Infof("found stream %s after %v", lw.LogStreamName, time.Now().Sub(t))
-			return nil
+			lw.logger().Debugf("rate limited while waiting for stream %s", lw.LogStreamName)
+			return false, nil
 		}
+		return exists, err
+	})
+}
 
-		select {
-		case <-done:
-			log.Logger.Error("timed out waiting for stream")
-			return fmt.Errorf("timed out waiting for stream %s", lw.LogStreamName)
-		case <-ticker.C:
-			continue
-		}
-	}
+// streamLogger returns the child logger of the cloudwatch component for a
+// log stream
+func streamLogger(logger Logger, logGroup string, logStream string) Logger {
+	return orNop(logger).WithFields(Fields{
+		"component":  "cloudwatch",
+		"log_group":  logGroup,
+		"log_stream": logStream,
+	})
 }
 
 func isRateLimited(err error) bool {
 	if aerr, ok := err.(awserr.Error); ok {
-		if aerr.Code() == "Throttling" {
+		if aerr.Code() == "Throttling" || request.IsErrorThrottle(aerr) {
 			return true
 		}
 	}
@@ -123,6 +146,7 @@ func isRateLimited(err error) bool {
 
 type logWatcher struct {
 	CloudWatchLogs cloudwatchLogsInterface
+	Logger         Logger
 
 	LogGroupName  string
 	LogStreamName string
@@ -130,43 +154,122 @@ type logWatcher struct {
 
 	Interval time.Duration
 	Timeout  time.Duration
+	// Window is how far before the newest delivered event every poll looks
+	// again, so events ingested late or sharing a timestamp aren't lost
+	Window time.Duration
+	// LiveTail streams events through a live tail session instead of polling,
+	// polling is used when live tail isn't available
+	LiveTail bool
+	// DrainTimeout is how long the events ingested after Finish are polled for
+	DrainTimeout time.Duration
+
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopped  bool
+	finish   chan struct{}
+	finished bool
+
+	// newest timestamp delivered so far
+	last int64
+	// events before it were delivered before the watcher started
+	from int64
+	// ids of delivered events inside the window, by their timestamp
+	seen map[string]int64
+	// request of a poll that failed in the middle of its pages, it's resumed
+	// from its next token by the next poll
+	pending *cloudwatchlogs.FilterLogEventsInput
+	// events delivered by polling and by live tail, live tail events have no
+	// ids so the two are matched by content when switching between them
+	polled eventCounts
+	tailed eventCounts
+}
 
-	mu   sync.Mutex
-	stop chan struct{}
+func (lw *logWatcher) logger() Logger {
+	return streamLogger(lw.Logger, lw.LogGroupName, lw.LogStreamName)
 }
 
 func (lw *logWatcher) Watch(ctx context.Context) error {
+	ctx = withLogger(ctx, lw.logger())
 	lw.mu.Lock()
-	lw.stop = make(chan struct{})
+	if lw.stop == nil {
+		lw.stop = make(chan struct{})
+	}
 	lw.mu.Unlock()
 
 	waiter := &logWaiter{
 		CloudWatchLogs: lw.CloudWatchLogs,
+		Logger:         lw.Logger,
 		LogGroupName:   lw.LogGroupName,
 		LogStreamName:  lw.LogStreamName,
 		Interval:       lw.Interval,
 		Timeout:        lw.Timeout,
 	}
 
-	if err := waiter.Wait(ctx); err != nil {
-		return err
+	// the stream of a task that stopped before logging anything never exists
+	waitCtx, cancelFn := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-lw.finishChan():
+			cancelFn()
+		case <-lw.stop:
+			cancelFn()
+		case <-waitCtx.Done():
+		}
+	}()
+	err := waiter.Wait(waitCtx)
+	cancelFn()
+	if lw.isStopped() {
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() != nil || !lw.isFinished() {
+			return err
+		}
+		if exists, err := waiter.streamExists(ctx); err != nil || !exists {
+			lw.logger().Debugf("log stream %s doesn't exist after its task stopped", lw.LogStreamName)
+			return err
+		}
 	}
 
-	var after int64
-	var err error
+	for lw.LiveTail && !lw.isFinished() {
+		err := lw.tail(ctx)
+		if err == nil && lw.isFinished() && !lw.isStopped() {
+			break
+		}
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, errLiveTailEnded) {
+			lw.logger().Debugf("live tail session of stream %s ended, starting a new one", lw.LogStreamName)
+			continue
+		}
+		if errors.Is(err, errLiveTailSampled) {
+			lw.logger().Warnf("live tail of stream %s is sampled, polling it instead so no event is missed", lw.LogStreamName)
+			lw.LiveTail = false
+			break
+		}
+		lw.logger().Warnf("live tail of stream %s is unavailable, falling back to polling: %s", lw.LogStreamName, err.Error())
+		lw.LiveTail = false
+	}
 
 	pollInterval := lw.Interval
 	if pollInterval == time.Duration(0) {
-		pollInterval = time.Second * 5
+		pollInterval = defaultLogPollInterval
 	}
 
 	for {
 		select {
 		case <-time.After(pollInterval):
-			if after, err = lw.printEventsAfter(ctx, after); err != nil {
-				return err
+			if _, err := lw.printEvents(ctx); err != nil {
+				if !isRateLimited(err) {
+					return err
+				}
+				lw.logger().Debugf("rate limited while reading stream %s, retrying", lw.LogStreamName)
 			}
 
+		case <-lw.finishChan():
+			return lw.drain(ctx, pollInterval)
+
 		case <-lw.stop:
 			return nil
 
@@ -176,129 +279,463 @@ func (lw *logWatcher) Watch(ctx context.Context) error {
 	}
 }
 
+// drain polls the events ingested after the task stopped, until a few polls
+// in a row have no new events or the drain timeout expired
+func (lw *logWatcher) drain(ctx context.Context, pollInterval time.Duration) error {
+	timeout := lw.DrainTimeout
+	if timeout == time.Duration(0) {
+		timeout = defaultLogDrainTimeout
+	}
+	deadline := time.After(timeout)
+
+	lw.logger().Debugf("draining log stream %s", lw.LogStreamName)
+	quiet := 0
+	for quiet < logDrainQuietPolls {
+		count, err := lw.printEvents(ctx)
+		if err != nil && !isRateLimited(err) {
+			return err
+		}
+		if err == nil && count == 0 {
+			quiet++
+		} else {
+			quiet = 0
+		}
+		if lw.isStopped() {
+			return nil
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-deadline:
+			lw.logger().Warnf("gave up draining log stream %s after %v", lw.LogStreamName, timeout)
+			return nil
+		case <-lw.stop:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	lw.logger().Debugf("drained log stream %s", lw.LogStreamName)
+	return nil
+}
+
+// resume makes the watcher deliver only events from the given timestamp and
+// not in the given ids, which were delivered before
+func (lw *logWatcher) resume(last int64, seen map[string]int64) {
+	lw.last = last
+	lw.from = last
+	lw.seen = make(map[string]int64, len(seen))
+	for id, ts := range seen {
+		lw.seen[id] = ts
+	}
+}
+
 func (lw *logWatcher) Stop() error {
 	lw.mu.Lock()
 	defer lw.mu.Unlock()
-	if lw.stop != nil {
+	// a watcher stopped before it started returns right away
+	if lw.stop == nil {
+		lw.stop = make(chan struct{})
+	}
+	if !lw.stopped {
+		lw.stopped = true
 		close(lw.stop)
-		return nil
 	}
-	return errors.New("log watcher not started")
+	return nil
 }
 
-func (lw *logWatcher) printEventsAfter(ctx context.Context, ts int64) (int64, error) {
-	log.Logger.Tracef("Printing events in stream %q after %d", lw.LogStreamName, ts)
-	t := time.Now()
-	var count int64
+func (lw *logWatcher) isStopped() bool {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.stopped
+}
+
+// Finish tells the watcher the task stopped, it delivers the events that are
+// still being ingested and returns
+func (lw *logWatcher) Finish() {
+	ch := lw.finishChan()
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if !lw.finished {
+		lw.finished = true
+		close(ch)
+	}
+}
+
+func (lw *logWatcher) finishChan() chan struct{} {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.finish == nil {
+		lw.finish = make(chan struct{})
+	}
+	return lw.finish
+}
+
+func (lw *logWatcher) isFinished() bool {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.finished
+}
 
-	filterInput := &cloudwatchlogs.FilterLogEventsInput{
-		LogGroupName:   aws.String(lw.LogGroupName),
-		LogStreamNames: aws.StringSlice([]string{lw.LogStreamName}),
-		StartTime:      aws.Int64(ts + 1),
+// printEvents prints the events that weren't delivered yet, following the
+// pagination tokens until the last page, and returns how many it printed
+func (lw *logWatcher) printEvents(ctx context.Context) (int64, error) {
+	window := lw.window()
+	if lw.seen == nil {
+		lw.seen = make(map[string]int64)
 	}
 
-	err := lw.CloudWatchLogs.FilterLogEventsPages(filterInput,
-		func(p *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) (shouldContinue bool) {
-			for _, event := range p.Events {
-				log.Logger.Trace(event)
+	input := lw.pending
+	if input == nil {
+		start := lw.last - window.Milliseconds()
+		if start < lw.from {
+			start = lw.from
+		}
+		if start < 0 {
+			start = 0
+		}
+		input = &cloudwatchlogs.FilterLogEventsInput{
+			LogGroupName:   aws.String(lw.LogGroupName),
+			LogStreamNames: aws.StringSlice([]string{lw.LogStreamName}),
+			StartTime:      aws.Int64(start),
+		}
+	}
+	lw.logger().Tracef("printing events in stream %q from %d", lw.LogStreamName, aws.Int64Value(input.StartTime))
+
+	t := time.Now()
+	var count int64
+	for {
+		page, err := lw.CloudWatchLogs.FilterLogEventsWithContext(ctx, input)
+		if err != nil {
+			lw.pending = input
+			return count, err
+		}
+
+		for _, event := range page.Events {
+			if lw.deliver(event) {
 				count++
-				if !lw.Printer(event) {
-					log.Logger.Info("stopping log watcher via print function")
-					lw.Stop()
-				}
-				if *event.Timestamp > ts {
-					ts = *event.Timestamp
-				}
 			}
-			return lastPage
-		})
-	if err != nil {
-		log.Logger.Tracef("printed %d events in %v", count, time.Now().Sub(t))
+			if lw.isStopped() {
+				lw.pending = nil
+				return count, nil
+			}
+		}
+
+		if page.NextToken == nil || *page.NextToken == "" {
+			break
+		}
+		next := *input
+		next.NextToken = page.NextToken
+		input = &next
+
+		if ctx.Err() != nil {
+			lw.pending = input
+			return count, ctx.Err()
+		}
+	}
+	lw.pending = nil
+	lw.forget()
+
+	lw.logger().Tracef("printed %d events in %v", count, time.Now().Sub(t))
+	return count, nil
+}
+
+func (lw *logWatcher) window() time.Duration {
+	if lw.Window == time.Duration(0) {
+		return defaultLogDedupWindow
 	}
+	return lw.Window
+}
 
-	return ts, err
+// forget forgets the events that fell out of the window before the newest
+// delivered one, polling doesn't return them again
+func (lw *logWatcher) forget() {
+	oldest := lw.last - lw.window().Milliseconds()
+	for id, ts := range lw.seen {
+		if ts < oldest {
+			delete(lw.seen, id)
+		}
+	}
+	lw.polled.prune(oldest)
+	lw.tailed.prune(oldest)
+}
+
+// deliver prints the event unless it was already delivered
+func (lw *logWatcher) deliver(event *cloudwatchlogs.FilteredLogEvent) bool {
+	id := aws.StringValue(event.EventId)
+	if _, ok := lw.seen[id]; ok {
+		return false
+	}
+
+	ts := aws.Int64Value(event.Timestamp)
+	lw.seen[id] = ts
+	if lw.tailed.take(event) {
+		return false
+	}
+	if lw.LiveTail {
+		lw.polled.add(event)
+	}
+	if ts > lw.last {
+		lw.last = ts
+	}
+
+	lw.logger().Tracef("%v", event)
+	if !lw.Printer(event) {
+		lw.logger().Infof("stopping log watcher via print function")
+		lw.Stop()
+	}
+	return true
 }
 
 type logWriter struct {
 	CloudWatchLogs cloudwatchLogsInterface
+	Logger         Logger
 
 	LogGroupName  string
 	LogStreamName string
 
 	Interval time.Duration
 	Timeout  time.Duration
+
+	mu sync.Mutex
+	// ready is set once the stream is known to exist, sequence is the token
+	// of the next write to it
+	ready    bool
+	sequence *string
+}
+
+func (lw *logWriter) logger() Logger {
+	return streamLogger(lw.Logger, lw.LogGroupName, lw.LogStreamName)
+}
+
+// CreateStream creates the log stream unless it exists
+func (lw *logWriter) CreateStream(ctx context.Context) error {
+	ctx = withLogger(ctx, lw.logger())
+	err := callAWS(ctx, "logs CreateLogStream", func(ctx context.Context) error {
+		_, err := lw.CloudWatchLogs.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(lw.LogGroupName),
+			LogStreamName: aws.String(lw.LogStreamName),
+		})
+		return err
+	})
+	// a new stream takes its first write without a sequence token
+	var sequence *string
+	if errors.Is(err, ErrAlreadyExists) {
+		sequence, err = lw.nextSequenceToken(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	lw.mu.Lock()
+	lw.ready = true
+	lw.sequence = sequence
+	lw.mu.Unlock()
+	return nil
 }
 
-func (lw *logWriter) nextSequenceToken() (*string, error) {
-	log.Logger.Tracef("finding next sequence token for stream %s", lw.LogStreamName)
+func (lw *logWriter) nextSequenceToken(ctx context.Context) (*string, error) {
+	lw.logger().Tracef("finding next sequence token for stream %s", lw.LogStreamName)
 
-	streams, err := lw.CloudWatchLogs.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+	var stream *cloudwatchlogs.LogStream
+	err := lw.CloudWatchLogs.DescribeLogStreamsPagesWithContext(ctx, &cloudwatchlogs.DescribeLogStreamsInput{
 		LogGroupName:        aws.String(lw.LogGroupName),
 		LogStreamNamePrefix: aws.String(lw.LogStreamName),
-		Descending:          aws.Bool(true),
-		Limit:               aws.Int64(1),
+	}, func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+		for _, s := range page.LogStreams {
+			if aws.StringValue(s.LogStreamName) == lw.LogStreamName {
+				stream = s
+				return false
+			}
+		}
+		return !lastPage
 	})
 	if err != nil {
 		return nil, err
-	} else if len(streams.LogStreams) == 0 {
+	} else if stream == nil {
 		return nil, fmt.Errorf("failed to find stream %s in group %s", lw.LogStreamName, lw.LogGroupName)
 	}
 
-	return streams.LogStreams[0].UploadSequenceToken, nil
+	return stream.UploadSequenceToken, nil
 }
 
+// WriteString writes the message to the stream, the stream and its sequence
+// token are only looked up before the first write
 func (lw *logWriter) WriteString(ctx context.Context, msg string) error {
-	waiter := &logWaiter{
-		CloudWatchLogs: lw.CloudWatchLogs,
-		LogGroupName:   lw.LogGroupName,
-		LogStreamName:  lw.LogStreamName,
-		Interval:       lw.Interval,
-		Timeout:        lw.Timeout,
-	}
+	ctx = withLogger(ctx, lw.logger())
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
 
-	if err := waiter.Wait(ctx); err != nil {
-		return err
+	if !lw.ready {
+		waiter := &logWaiter{
+			CloudWatchLogs: lw.CloudWatchLogs,
+			Logger:         lw.Logger,
+			LogGroupName:   lw.LogGroupName,
+			LogStreamName:  lw.LogStreamName,
+			Interval:       lw.Interval,
+			Timeout:        lw.Timeout,
+		}
+		if err := waiter.Wait(ctx); err != nil {
+			return err
+		}
+		sequence, err := lw.nextSequenceToken(ctx)
+		if err != nil {
+			return err
+		}
+		lw.ready = true
+		lw.sequence = sequence
 	}
 
-	sequence, err := lw.nextSequenceToken()
+	lw.logger().Tracef("putting log message %q to %s", msg, lw.LogStreamName)
+	event := &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(msg),
+		Timestamp: aws.Int64(aws.TimeUnixMilli(time.Now())),
+	}
+	var out *cloudwatchlogs.PutLogEventsOutput
+	put := func() error {
+		return callAWS(ctx, "logs PutLogEvents", func(ctx context.Context) (err error) {
+			out, err = lw.CloudWatchLogs.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+				SequenceToken: lw.sequence,
+				LogGroupName:  aws.String(lw.LogGroupName),
+				LogStreamName: aws.String(lw.LogStreamName),
+				LogEvents:     []*cloudwatchlogs.InputLogEvent{event},
+			})
+			return err
+		})
+	}
+	err := put()
+	// someone else wrote to the stream since, the error has the token
+	var invalid *cloudwatchlogs.InvalidSequenceTokenException
+	if errors.As(err, &invalid) && invalid.ExpectedSequenceToken != nil {
+		lw.sequence = invalid.ExpectedSequenceToken
+		err = put()
+	}
 	if err != nil {
 		return err
 	}
+	lw.sequence = out.NextSequenceToken
+	return nil
+}
 
-	log.Logger.Tracef("putting log message %q to %s", msg, lw.LogStreamName)
-	_, err = lw.CloudWatchLogs.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
-		SequenceToken: sequence,
-		LogGroupName:  aws.String(lw.LogGroupName),
-		LogStreamName: aws.String(lw.LogStreamName),
-		LogEvents: []*cloudwatchlogs.InputLogEvent{
-			{
-				Message:   aws.String(msg),
-				Timestamp: aws.Int64(aws.TimeUnixMilli(time.Now())),
-			},
-		},
-	})
-	return err
+// logRetentionDays are the retention periods CloudWatch Logs accepts
+var logRetentionDays = []int{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1096, 1827, 2192, 2557, 2922, 3288, 3653}
+
+// CheckLogRetentionDays returns an error unless CloudWatch Logs accepts the
+// retention period, zero means the events never expire
+func CheckLogRetentionDays(days int) error {
+	if days == 0 {
+		return nil
+	}
+	for _, d := range logRetentionDays {
+		if d == days {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log retention of %d days, must be one of %v", days, logRetentionDays)
 }
 
-func createLogGroup(sess *session.Session, logGroup string) error {
-	cwl := cloudwatchlogs.New(sess)
-	groups, err := cwl.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
-		Limit:              aws.Int64(1),
+// findLogGroup returns the log group with exactly the given name, or nil when
+// there is none, log groups are only looked up by prefix so every match is
+// checked
+func findLogGroup(ctx context.Context, cwl cloudwatchLogsInterface, logGroup string) (*cloudwatchlogs.LogGroup, error) {
+	input := &cloudwatchlogs.DescribeLogGroupsInput{
 		LogGroupNamePrefix: aws.String(logGroup),
+	}
+	for {
+		var groups *cloudwatchlogs.DescribeLogGroupsOutput
+		err := callAWS(ctx, "logs DescribeLogGroups", func(ctx context.Context) (err error) {
+			groups, err = cwl.DescribeLogGroupsWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups.LogGroups {
+			if aws.StringValue(group.LogGroupName) == logGroup {
+				return group, nil
+			}
+		}
+		if aws.StringValue(groups.NextToken) == "" {
+			return nil, nil
+		}
+		input.NextToken = groups.NextToken
+	}
+}
+
+// createLogGroup creates the log group unless it exists, the retention and
+// the kms key are only set on a group it creates
+func createLogGroup(ctx context.Context, cwl cloudwatchLogsInterface, logGroup string, retentionDays int, kmsKeyID string) error {
+	logger := loggerFrom(ctx).WithFields(Fields{
+		"component": "cloudwatch",
+		"log_group": logGroup,
 	})
+	if err := CheckLogRetentionDays(retentionDays); err != nil {
+		return err
+	}
+
+	group, err := findLogGroup(ctx, cwl, logGroup)
 	if err != nil {
 		return err
 	}
-	if len(groups.LogGroups) == 0 {
-		log.Logger.Infof("creating log group %s", logGroup)
-		_, err = cwl.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
-			LogGroupName: aws.String(logGroup),
+	if group != nil {
+		logger.Debugf("log group %s exists", logGroup)
+		if retentionDays != 0 && aws.Int64Value(group.RetentionInDays) != int64(retentionDays) {
+			logger.Warnf("log group %s exists with a retention of %d days, not changing it",
+				logGroup, aws.Int64Value(group.RetentionInDays))
+		}
+		if kmsKeyID != "" && aws.StringValue(group.KmsKeyId) == "" {
+			logger.Warnf("log group %s exists unencrypted, not encrypting it", logGroup)
+		}
+		return nil
+	}
+
+	logger.Infof("creating log group %s", logGroup)
+	input := &cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(logGroup),
+	}
+	if kmsKeyID != "" {
+		input.KmsKeyId = aws.String(kmsKeyID)
+	}
+	err = callAWS(ctx, "logs CreateLogGroup", func(ctx context.Context) error {
+		_, err := cwl.CreateLogGroupWithContext(ctx, input)
+		return err
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		// created by someone else in the meantime
+		logger.Debugf("log group %s exists", logGroup)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create log group %s: %s", logGroup, err.Error())
+	}
+
+	if retentionDays != 0 {
+		logger.Infof("setting retention of log group %s to %d days", logGroup, retentionDays)
+		err = callAWS(ctx, "logs PutRetentionPolicy", func(ctx context.Context) error {
+			_, err := cwl.PutRetentionPolicyWithContext(ctx, &cloudwatchlogs.PutRetentionPolicyInput{
+				LogGroupName:    aws.String(logGroup),
+				RetentionInDays: aws.Int64(int64(retentionDays)),
+			})
+			return err
 		})
 		if err != nil {
-			return err
+			return fmt.Errorf("unable to set retention of log group %s: %s", logGroup, err.Error())
 		}
-	} else {
-		log.Logger.Debugf("log group %s exists", logGroup)
 	}
 	return nil
 }
+
+// deleteLogStream deletes the log stream, a stream that doesn't exist is
+// already deleted
+func deleteLogStream(ctx context.Context, cwl cloudwatchLogsInterface, logGroup string, logStream string) error {
+	err := callAWS(ctx, "logs DeleteLogStream", func(ctx context.Context) error {
+		_, err := cwl.DeleteLogStreamWithContext(ctx, &cloudwatchlogs.DeleteLogStreamInput{
+			LogGroupName:  aws.String(logGroup),
+			LogStreamName: aws.String(logStream),
+		})
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,296 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// fakeLogs is a log stream served by FilterLogEvents in pages, the calls
+// listed in throttled fail with a throttling error. The methods it doesn't
+// implement panic through the nil interface
+type fakeLogs struct {
+	cloudwatchLogsInterface
+
+	mu       sync.Mutex
+	events   []*cloudwatchlogs.FilteredLogEvent
+	pageSize int
+	// throttled are the numbers of the FilterLogEvents calls that fail,
+	// starting at 1
+	throttled map[int]bool
+	calls     []cloudwatchlogs.FilterLogEventsInput
+	// describeThrottles is how many DescribeLogStreams calls fail first
+	describeThrottles int
+}
+
+func throttlingError() error {
+	return awserr.New("ThrottlingException", "Rate exceeded", nil)
+}
+
+func (f *fakeLogs) add(id string, ts int64, msg string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, &cloudwatchlogs.FilteredLogEvent{
+		EventId:   aws.String(id),
+		Timestamp: aws.Int64(ts),
+		Message:   aws.String(msg),
+	})
+}
+
+func (f *fakeLogs) FilterLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.FilterLogEventsInput, opts ...request.Option) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, *input)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.throttled[len(f.calls)] {
+		return nil, throttlingError()
+	}
+
+	var matched []*cloudwatchlogs.FilteredLogEvent
+	for _, event := range f.events {
+		if aws.Int64Value(event.Timestamp) >= aws.Int64Value(input.StartTime) {
+			matched = append(matched, event)
+		}
+	}
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	end := len(matched)
+	if f.pageSize > 0 && start+f.pageSize < end {
+		end = start + f.pageSize
+	}
+	out := &cloudwatchlogs.FilterLogEventsOutput{Events: matched[start:end]}
+	if end < len(matched) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+func (f *fakeLogs) DescribeLogStreamsPagesWithContext(ctx aws.Context, input *cloudwatchlogs.DescribeLogStreamsInput, fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool, opts ...request.Option) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.describeThrottles > 0 {
+		f.describeThrottles--
+		return throttlingError()
+	}
+	fn(&cloudwatchlogs.DescribeLogStreamsOutput{
+		LogStreams: []*cloudwatchlogs.LogStream{{LogStreamName: input.LogStreamNamePrefix}},
+	}, true)
+	return nil
+}
+
+// printed collects the messages a watcher prints
+type printed struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (p *printed) print(event *cloudwatchlogs.FilteredLogEvent) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, aws.StringValue(event.Message))
+	return true
+}
+
+func (p *printed) get() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.messages...)
+}
+
+func newTestWatcher(logs *fakeLogs, p *printed) *logWatcher {
+	return &logWatcher{
+		CloudWatchLogs: logs,
+		LogGroupName:   "group",
+		LogStreamName:  "stream",
+		Printer:        p.print,
+		Interval:       time.Millisecond,
+	}
+}
+
+func TestPrintEventsFollowsPages(t *testing.T) {
+	logs := &fakeLogs{pageSize: 2}
+	for i := 1; i <= 5; i++ {
+		logs.add(fmt.Sprintf("id%d", i), int64(i*1000), fmt.Sprintf("message %d", i))
+	}
+	p := &printed{}
+	lw := newTestWatcher(logs, p)
+
+	count, err := lw.printEvents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("printed %d events, want 5", count)
+	}
+	if got := fmt.Sprint(p.get()); got != "[message 1 message 2 message 3 message 4 message 5]" {
+		t.Errorf("printed %s", got)
+	}
+	if len(logs.calls) != 3 {
+		t.Fatalf("made %d calls, want 3", len(logs.calls))
+	}
+	for i, token := range []string{"", "2", "4"} {
+		if got := aws.StringValue(logs.calls[i].NextToken); got != token {
+			t.Errorf("call %d has token %q, want %q", i+1, got, token)
+		}
+	}
+}
+
+func TestPrintEventsResumesThrottledPoll(t *testing.T) {
+	logs := &fakeLogs{pageSize: 2, throttled: map[int]bool{2: true}}
+	for i := 1; i <= 5; i++ {
+		logs.add(fmt.Sprintf("id%d", i), int64(i*1000), fmt.Sprintf("message %d", i))
+	}
+	p := &printed{}
+	lw := newTestWatcher(logs, p)
+
+	count, err := lw.printEvents(context.Background())
+	if !isRateLimited(err) {
+		t.Fatalf("got error %v, want a throttling error", err)
+	}
+	if count != 2 {
+		t.Errorf("printed %d events before the throttling, want 2", count)
+	}
+
+	count, err = lw.printEvents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("printed %d events after the throttling, want 3", count)
+	}
+	// the poll goes on from the page that failed
+	if got := aws.StringValue(logs.calls[2].NextToken); got != "2" {
+		t.Errorf("resumed from token %q, want 2", got)
+	}
+	if got := len(p.get()); got != 5 {
+		t.Errorf("printed %d events, want 5", got)
+	}
+}
+
+func TestPrintEventsDedupAcrossWindows(t *testing.T) {
+	logs := &fakeLogs{}
+	logs.add("id1", 1000, "first")
+	logs.add("id2", 1500, "second")
+	p := &printed{}
+	lw := newTestWatcher(logs, p)
+	lw.Window = time.Second
+
+	tests := []struct {
+		add   func()
+		count int64
+		start int64
+		seen  int
+	}{
+		{count: 2, start: 0, seen: 2},
+		// an event ingested late with the timestamp of one already printed,
+		// the poll looks a window back and prints only the new ones
+		{add: func() {
+			logs.add("id3", 1500, "third")
+			logs.add("id4", 3000, "fourth")
+		}, count: 2, start: 500, seen: 1},
+		{count: 0, start: 2000, seen: 1},
+	}
+	for i, tt := range tests {
+		if tt.add != nil {
+			tt.add()
+		}
+		count, err := lw.printEvents(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tt.count {
+			t.Errorf("poll %d printed %d events, want %d", i+1, count, tt.count)
+		}
+		if got := aws.Int64Value(logs.calls[len(logs.calls)-1].StartTime); got != tt.start {
+			t.Errorf("poll %d started at %d, want %d", i+1, got, tt.start)
+		}
+		// the ids that fell out of the window are forgotten
+		if len(lw.seen) != tt.seen {
+			t.Errorf("poll %d keeps %d ids, want %d", i+1, len(lw.seen), tt.seen)
+		}
+	}
+	if got := fmt.Sprint(p.get()); got != "[first second third fourth]" {
+		t.Errorf("printed %s", got)
+	}
+}
+
+func TestPrintEventsHonoursContext(t *testing.T) {
+	logs := &fakeLogs{}
+	logs.add("id1", 1000, "first")
+	lw := newTestWatcher(logs, &printed{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := lw.printEvents(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLogWaiterBacksOffWhenThrottled(t *testing.T) {
+	logs := &fakeLogs{describeThrottles: 3}
+	waiter := &logWaiter{
+		CloudWatchLogs: logs,
+		LogGroupName:   "group",
+		LogStreamName:  "stream",
+		Interval:       time.Millisecond,
+		Timeout:        time.Minute,
+		MaxErrors:      1,
+	}
+	// throttling doesn't spend the error budget
+	if err := waiter.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if logs.describeThrottles != 0 {
+		t.Errorf("%d throttled calls left", logs.describeThrottles)
+	}
+}
+
+func TestWatchRetriesThrottledPolls(t *testing.T) {
+	logs := &fakeLogs{throttled: map[int]bool{1: true, 2: true}}
+	for i := 1; i <= 3; i++ {
+		logs.add(fmt.Sprintf("id%d", i), int64(i*1000), fmt.Sprintf("message %d", i))
+	}
+	p := &printed{}
+	lw := newTestWatcher(logs, p)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- lw.Watch(context.Background())
+	}()
+
+	deadline := time.After(10 * time.Second)
+	for len(p.get()) < 3 {
+		select {
+		case err := <-done:
+			t.Fatalf("watch returned %v before printing every event", err)
+		case <-deadline:
+			t.Fatalf("printed %d events, want 3", len(p.get()))
+		case <-time.After(time.Millisecond):
+		}
+	}
+	lw.Finish()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-deadline:
+		t.Fatal("watch didn't return after finish")
+	}
+	if got := len(p.get()); got != 3 {
+		t.Errorf("printed %d events, want 3", got)
+	}
+}
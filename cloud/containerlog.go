@@ -0,0 +1,195 @@
+package cloud
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const (
+	// ContainerLogFile has the raw container log events of a run
+	ContainerLogFile = "container.log"
+	// NetzLogFile has netz's own orchestration log messages of a run
+	NetzLogFile = "netz.log"
+
+	containerLogTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+	// live tail events have no id
+	noEventID = "-"
+)
+
+// DefaultOutputDir returns ~/.netz/output, or a relative directory when the
+// home directory can't be resolved
+func DefaultOutputDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".netz", "output")
+	}
+	return filepath.Join(home, ".netz", "output")
+}
+
+// RunOutputDir returns the directory the files of a run are kept in
+func RunOutputDir(outputDir string, runID string) string {
+	return filepath.Join(outputDir, runID)
+}
+
+// LoggedEvent is a container log event as it's kept in the container log
+type LoggedEvent struct {
+	Timestamp int64
+	Stream    string
+	EventID   string
+	Message   string
+}
+
+// Time returns the CloudWatch timestamp of the event
+func (e LoggedEvent) Time() time.Time {
+	return time.Unix(0, e.Timestamp*int64(time.Millisecond))
+}
+
+func (e LoggedEvent) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s",
+		e.Time().UTC().Format(containerLogTimeFormat), e.Stream, e.EventID, e.Message)
+}
+
+func parseLoggedEvent(line string) (LoggedEvent, error) {
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) != 4 {
+		return LoggedEvent{}, fmt.Errorf("malformed container log line %q", line)
+	}
+	t, err := time.Parse(containerLogTimeFormat, fields[0])
+	if err != nil {
+		return LoggedEvent{}, err
+	}
+	return LoggedEvent{
+		Timestamp: aws.TimeUnixMilli(t),
+		Stream:    fields[1],
+		EventID:   fields[2],
+		Message:   fields[3],
+	}, nil
+}
+
+// ReadContainerLog calls fn with every event of the container log in order
+func ReadContainerLog(path string, fn func(LoggedEvent)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if s.Text() == "" {
+			continue
+		}
+		event, err := parseLoggedEvent(s.Text())
+		if err != nil {
+			return err
+		}
+		fn(event)
+	}
+	return s.Err()
+}
+
+// logPosition is where a stream was mirrored up to, the newest timestamp
+// and the ids of the events at it
+type logPosition struct {
+	last int64
+	seen map[string]int64
+}
+
+// ContainerLog mirrors the container log events of a run to a local file
+type ContainerLog struct {
+	mu        sync.Mutex
+	file      *os.File
+	positions map[string]*logPosition
+}
+
+// OpenContainerLog opens the container log for appending, events it already
+// has aren't written again
+func OpenContainerLog(path string) (*ContainerLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	cl := &ContainerLog{positions: make(map[string]*logPosition)}
+	err := ReadContainerLog(path, func(event LoggedEvent) {
+		cl.track(event)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cl.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *ContainerLog) track(event LoggedEvent) {
+	pos, ok := cl.positions[event.Stream]
+	if !ok {
+		pos = &logPosition{seen: make(map[string]int64)}
+		cl.positions[event.Stream] = pos
+	}
+	if event.Timestamp > pos.last {
+		pos.last = event.Timestamp
+		pos.seen = make(map[string]int64)
+	}
+	if event.Timestamp == pos.last && event.EventID != noEventID {
+		pos.seen[event.EventID] = event.Timestamp
+	}
+}
+
+// position returns a copy of where the stream was mirrored up to, nil when
+// it wasn't
+func (cl *ContainerLog) position(stream string) *logPosition {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	pos, ok := cl.positions[stream]
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]int64, len(pos.seen))
+	for id, ts := range pos.seen {
+		seen[id] = ts
+	}
+	return &logPosition{last: pos.last, seen: seen}
+}
+
+func newLoggedEvent(stream string, event *cloudwatchlogs.FilteredLogEvent) LoggedEvent {
+	logged := LoggedEvent{
+		Timestamp: aws.Int64Value(event.Timestamp),
+		Stream:    stream,
+		EventID:   aws.StringValue(event.EventId),
+		Message:   aws.StringValue(event.Message),
+	}
+	if logged.EventID == "" {
+		logged.EventID = noEventID
+	}
+	return logged
+}
+
+// Write appends the event of the stream to the container log
+func (cl *ContainerLog) Write(stream string, event *cloudwatchlogs.FilteredLogEvent) error {
+	logged := newLoggedEvent(stream, event)
+	// one event per line, keep the line breaks of multi-line events escaped
+	logged.Message = strings.ReplaceAll(strings.TrimRight(logged.Message, "\n"), "\n", `\n`)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.track(logged)
+	_, err := fmt.Fprintln(cl.file, logged.String())
+	return err
+}
+
+func (cl *ContainerLog) Close() error {
+	return cl.file.Close()
+}
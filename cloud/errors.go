@@ -0,0 +1,189 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Classes of AWS errors, match them with errors.Is
+var (
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
+	ErrUnsupported          = errors.New("unsupported")
+	ErrAccessDenied         = errors.New("access denied")
+	ErrInvalidParameter     = errors.New("invalid parameter")
+	ErrDependencyViolation  = errors.New("dependency violation")
+	ErrAlreadyExists        = errors.New("already exists")
+	ErrNotFound             = errors.New("not found")
+)
+
+var errorClasses = map[string]error{
+	"AddressLimitExceeded":          ErrQuotaExceeded,
+	"InstanceLimitExceeded":         ErrQuotaExceeded,
+	"NetworkInterfaceLimitExceeded": ErrQuotaExceeded,
+	"VcpuLimitExceeded":             ErrQuotaExceeded,
+	"LimitExceeded":                 ErrQuotaExceeded,
+	"LimitExceededException":        ErrQuotaExceeded,
+
+	"InsufficientInstanceCapacity": ErrInsufficientCapacity,
+	"InsufficientAddressCapacity":  ErrInsufficientCapacity,
+	"InsufficientHostCapacity":     ErrInsufficientCapacity,
+	"InsufficientCapacity":         ErrInsufficientCapacity,
+
+	"Unsupported":          ErrUnsupported,
+	"UnsupportedOperation": ErrUnsupported,
+
+	"UnauthorizedOperation":       ErrAccessDenied,
+	"AccessDenied":                ErrAccessDenied,
+	"AccessDeniedException":       ErrAccessDenied,
+	"AuthFailure":                 ErrAccessDenied,
+	"OptInRequired":               ErrAccessDenied,
+	"InvalidClientTokenId":        ErrAccessDenied,
+	"UnrecognizedClientException": ErrAccessDenied,
+
+	"InvalidParameterValue":       ErrInvalidParameter,
+	"InvalidParameter":            ErrInvalidParameter,
+	"InvalidParameterCombination": ErrInvalidParameter,
+	"InvalidParameterException":   ErrInvalidParameter,
+	"MissingParameter":            ErrInvalidParameter,
+	"ValidationError":             ErrInvalidParameter,
+	"MalformedPolicyDocument":     ErrInvalidParameter,
+
+	"DependencyViolation":                        ErrDependencyViolation,
+	"DeleteConflict":                             ErrDependencyViolation,
+	"InvalidNetworkInterface.InUse":              ErrDependencyViolation,
+	"ClusterContainsContainerInstancesException": ErrDependencyViolation,
+	"ClusterContainsTasksException":              ErrDependencyViolation,
+
+	"EntityAlreadyExists":            ErrAlreadyExists,
+	"ResourceAlreadyExistsException": ErrAlreadyExists,
+
+	"NoSuchEntity":                       ErrNotFound,
+	"ResourceNotFoundException":          ErrNotFound,
+	"ClusterNotFoundException":           ErrNotFound,
+	"InvalidInstanceID.NotFound":         ErrNotFound,
+	"InvalidNetworkInterfaceID.NotFound": ErrNotFound,
+	"InvalidAllocationID.NotFound":       ErrNotFound,
+}
+
+// Error is an AWS error of a failed call, classified with one of the
+// Err* classes when its code is known
+type Error struct {
+	Op    string
+	Code  string
+	Class error
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return e.Class != nil && e.Class == target
+}
+
+// classify wraps the error of the op with its class
+func classify(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Op: op, Err: err}
+	if aerr, ok := err.(awserr.Error); ok {
+		e.Code = aerr.Code()
+		e.Class = errorClasses[e.Code]
+	}
+	return e
+}
+
+// awsErrorCode returns the AWS error code of err, or an empty string
+func awsErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// isRetryable reports whether a failed call should be tried again, throttling
+// and transient service errors always are, other classes only when asked for
+func isRetryable(err error, retryOn []error) bool {
+	origErr := err
+	var e *Error
+	if errors.As(err, &e) {
+		origErr = e.Err
+	}
+	if request.IsErrorThrottle(origErr) || request.IsErrorRetryable(origErr) {
+		return true
+	}
+	for _, class := range retryOn {
+		if errors.Is(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryConfig controls retrying of failed AWS calls
+type RetryConfig struct {
+	MaxAttempts int
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryConfig is used for every EC2, IAM and ECS call
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts: 6,
+	MinDelay:    time.Second,
+	MaxDelay:    time.Second * 20,
+}
+
+// withoutSDKRetries returns a copy of the config with the retries of the SDK
+// disabled, callAWS retries the calls itself
+func withoutSDKRetries(config *aws.Config) *aws.Config {
+	return config.Copy().WithMaxRetries(0)
+}
+
+// callAWS runs fn and retries it with backoff while it fails with retryable
+// errors, the returned error is classified
+func callAWS(ctx context.Context, op string, fn func(ctx context.Context) error, retryOn ...error) error {
+	config := DefaultRetryConfig
+	delay := config.MinDelay
+
+	for attempt := 1; ; attempt++ {
+		err := classify(op, fn(ctx))
+		if err == nil {
+			return nil
+		}
+		if attempt >= config.MaxAttempts || !isRetryable(err, retryOn) || ctx.Err() != nil {
+			return err
+		}
+
+		loggerFrom(ctx).Debugf("%s failed (attempt %d/%d), retrying: %s", op, attempt, config.MaxAttempts, err.Error())
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		delay *= 2
+		if delay > config.MaxDelay {
+			delay = config.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// errLiveTailEnded is returned when a live tail session ended by itself,
+// sessions are limited in time so a new one should be started
+var errLiveTailEnded = errors.New("live tail session ended")
+
+// errLiveTailSampled is returned when a live tail session started sampling,
+// the events it drops are only returned by polling
+var errLiveTailSampled = errors.New("live tail session is sampled")
+
+type eventKey struct {
+	timestamp int64
+	message   string
+}
+
+// eventCounts counts delivered events by their content, to match events
+// delivered by live tail with the same events returned by polling
+type eventCounts map[eventKey]int
+
+func keyOf(event *cloudwatchlogs.FilteredLogEvent) eventKey {
+	return eventKey{
+		timestamp: aws.Int64Value(event.Timestamp),
+		message:   aws.StringValue(event.Message),
+	}
+}
+
+func (c *eventCounts) add(event *cloudwatchlogs.FilteredLogEvent) {
+	if *c == nil {
+		*c = make(eventCounts)
+	}
+	(*c)[keyOf(event)]++
+}
+
+// take reports whether the event was counted and uncounts it
+func (c eventCounts) take(event *cloudwatchlogs.FilteredLogEvent) bool {
+	key := keyOf(event)
+	if c[key] == 0 {
+		return false
+	}
+	c[key]--
+	if c[key] == 0 {
+		delete(c, key)
+	}
+	return true
+}
+
+// prune forgets events older than the given timestamp
+func (c eventCounts) prune(oldest int64) {
+	for key := range c {
+		if key.timestamp < oldest {
+			delete(c, key)
+		}
+	}
+}
+
+// logGroupArn returns the arn of the log group, live tail sessions refer to
+// log groups by arn only
+func (lw *logWatcher) logGroupArn(ctx context.Context) (string, error) {
+	group, err := findLogGroup(ctx, lw.CloudWatchLogs, lw.LogGroupName)
+	if err != nil {
+		return "", err
+	}
+	if group == nil {
+		return "", fmt.Errorf("log group %s not found", lw.LogGroupName)
+	}
+	if group.LogGroupArn != nil {
+		return *group.LogGroupArn, nil
+	}
+	return strings.TrimSuffix(aws.StringValue(group.Arn), ":*"), nil
+}
+
+// tail delivers the events of the stream as they are ingested, until the
+// watcher is stopped or finished or the session ends
+func (lw *logWatcher) tail(ctx context.Context) error {
+	arn, err := lw.logGroupArn(ctx)
+	if err != nil {
+		return err
+	}
+
+	out, err := lw.CloudWatchLogs.StartLiveTailWithContext(ctx, &cloudwatchlogs.StartLiveTailInput{
+		LogGroupIdentifiers: aws.StringSlice([]string{arn}),
+		LogStreamNames:      aws.StringSlice([]string{lw.LogStreamName}),
+	})
+	if err != nil {
+		return err
+	}
+	stream := out.GetStream()
+	defer stream.Close()
+	lw.logger().Debugf("started live tail session of stream %s", lw.LogStreamName)
+
+	// events ingested before the session started are only returned by polling
+	if _, err := lw.printEvents(ctx); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case event, ok := <-stream.Events():
+			if !ok {
+				if err := stream.Err(); err != nil {
+					return err
+				}
+				return errLiveTailEnded
+			}
+
+			update, ok := event.(*cloudwatchlogs.LiveTailSessionUpdate)
+			if !ok {
+				continue
+			}
+			// the events of a sampled update and the ones after it are polled,
+			// from a window before the newest event delivered
+			if update.SessionMetadata != nil && aws.BoolValue(update.SessionMetadata.Sampled) {
+				return errLiveTailSampled
+			}
+			for _, result := range update.SessionResults {
+				lw.deliverTailed(result)
+				if lw.isStopped() {
+					return nil
+				}
+			}
+			lw.forget()
+
+		case <-lw.stop:
+			return nil
+
+		case <-lw.finishChan():
+			return nil
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// deliverTailed prints a live tail event unless polling already delivered it
+func (lw *logWatcher) deliverTailed(result *cloudwatchlogs.LiveTailSessionLogEvent) {
+	event := &cloudwatchlogs.FilteredLogEvent{
+		IngestionTime: result.IngestionTime,
+		LogStreamName: result.LogStreamName,
+		Message:       result.Message,
+		Timestamp:     result.Timestamp,
+	}
+	if lw.polled.take(event) {
+		return
+	}
+	lw.tailed.add(event)
+
+	if ts := aws.Int64Value(event.Timestamp); ts > lw.last {
+		lw.last = ts
+	}
+
+	lw.logger().Tracef("%v", event)
+	if !lw.Printer(event) {
+		lw.logger().Infof("stopping log watcher via print function")
+		lw.Stop()
+	}
+}
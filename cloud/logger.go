@@ -0,0 +1,119 @@
+package cloud
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are structured fields added to log messages
+type Fields map[string]interface{}
+
+// Logger is what the cloud package logs through, nothing is logged unless a
+// logger is given with WithLogger
+type Logger interface {
+	WithFields(fields Fields) Logger
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NopLogger returns a logger that discards every message
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (l nopLogger) WithFields(fields Fields) Logger         { return l }
+func (nopLogger) Tracef(format string, args ...interface{}) {}
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// NewLogrusLogger returns a logger that logs to a logrus logger
+func NewLogrusLogger(logger *logrus.Logger) Logger {
+	if logger == nil {
+		return NopLogger()
+	}
+	return logrusLogger{logrus.NewEntry(logger)}
+}
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l logrusLogger) Tracef(format string, args ...interface{}) { l.entry.Tracef(format, args...) }
+func (l logrusLogger) Debugf(format string, args ...interface{}) { l.entry.Debugf(format, args...) }
+func (l logrusLogger) Infof(format string, args ...interface{})  { l.entry.Infof(format, args...) }
+func (l logrusLogger) Warnf(format string, args ...interface{})  { l.entry.Warnf(format, args...) }
+func (l logrusLogger) Errorf(format string, args ...interface{}) { l.entry.Errorf(format, args...) }
+
+// Option configures a runner, a resource manager or a run log
+type Option func(*options)
+
+type options struct {
+	logger          Logger
+	containerLogger Logger
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger:          NopLogger(),
+		containerLogger: NopLogger(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLogger logs netz's own messages to the logger
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithContainerLogger logs the output of the task containers to the logger,
+// one message per log event
+func WithContainerLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.containerLogger = logger
+		}
+	}
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context that carries the logger to the AWS calls and
+// waiters made with it
+func withLogger(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger carried by the context, or a no-op logger
+func loggerFrom(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return NopLogger()
+}
+
+// orNop returns the logger, or a no-op logger when it's nil
+func orNop(logger Logger) Logger {
+	if logger == nil {
+		return NopLogger()
+	}
+	return logger
+}
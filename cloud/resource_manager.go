@@ -1,167 +1,295 @@
 package cloud
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/iam"
-
-	log "github.com/cmpxchg16/netz/logger"
 )
 
 type ResourceManagerInterface interface {
-	CreateResources(region string, numOfNic int, instanceType string, keyName string, securityGroup string, subnetId string, roleName string, rolePolicyName string, instanceProfileName string) error
+	CreateResources(ctx context.Context, region string, numOfNic int, instanceTypes []string, keyName string, securityGroup string, subnetIds []string, roleName string, rolePolicyName string, instanceProfileName string, ecsCluster string) error
 	DestroyResources(skipDestroy bool)
 }
 
+// ec2Interface is the part of the EC2 API the instance is created and
+// terminated with
+type ec2Interface interface {
+	RunInstancesWithContext(ctx aws.Context, input *ec2.RunInstancesInput, opts ...request.Option) (*ec2.Reservation, error)
+	DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error)
+}
+
 type AWSResourceManager struct {
 	ResourceManagerInterface cloudwatchLogsInterface
-	networkInterfaces        []string
-	allocationAddresses      []string
-	instanceId               *string
-	ecsCluster               *string
-	region                   string
-	guard                    sync.Mutex
+	// Waiter controls waiting for the instance and its container instance
+	Waiter WaiterConfig
+	// IPv6 assigns an IPv6 address to the instance and every network
+	// interface, their subnets must have an IPv6 CIDR block
+	IPv6 bool
+	// Checkpoint is where the scan container checkpoints its scan, the role
+	// can read and write the objects under it when it's an S3 location
+	Checkpoint string
+	// RunID names the checkpoint policy of the run on the role
+	RunID string
+
+	networkInterfaces    []string
+	allocationAddresses  []string
+	ipv6Addresses        []string
+	instanceId           *string
+	containerInstanceArn *string
+	instanceType         string
+	subnetId             string
+	availabilityZone     string
+	ecsCluster           *string
+	region               string
+	roleName             string
+	rolePolicy           string
+	// guard is taken on every write of the resources, they are read by
+	// Resources while they're created or destroyed
+	guard sync.Mutex
+	// destroying serializes the destroys, they call AWS without the guard
+	destroying sync.Mutex
+	opts       options
+}
+
+func NewResourceManager(opts ...Option) *AWSResourceManager {
+	return &AWSResourceManager{
+		Waiter: DefaultWaiterConfig(),
+		opts:   newOptions(opts),
+	}
+}
+
+// NewResourceManagerFromResources returns a resource manager that owns
+// resources created by a previous invocation, so they can be destroyed
+func NewResourceManagerFromResources(resources Resources, opts ...Option) *AWSResourceManager {
+	rm := &AWSResourceManager{
+		Waiter:              DefaultWaiterConfig(),
+		opts:                newOptions(opts),
+		region:              resources.Region,
+		instanceType:        resources.InstanceType,
+		subnetId:            resources.SubnetID,
+		availabilityZone:    resources.AvailabilityZone,
+		networkInterfaces:   resources.NetworkInterfaces,
+		allocationAddresses: resources.AllocationAddresses,
+		ipv6Addresses:       resources.IPv6Addresses,
+		roleName:            resources.RoleName,
+		rolePolicy:          resources.RolePolicy,
+	}
+	if resources.InstanceID != "" {
+		rm.instanceId = aws.String(resources.InstanceID)
+	}
+	if resources.ContainerInstanceARN != "" {
+		rm.containerInstanceArn = aws.String(resources.ContainerInstanceARN)
+	}
+	if resources.Cluster != "" {
+		rm.ecsCluster = aws.String(resources.Cluster)
+	}
+	return rm
+}
+
+// logger returns the child logger of the resource manager, with the region
+// and the instance of its resources
+func (rm *AWSResourceManager) logger() Logger {
+	rm.guard.Lock()
+	defer rm.guard.Unlock()
+	fields := Fields{"component": "resources"}
+	if rm.region != "" {
+		fields["region"] = rm.region
+	}
+	if rm.instanceId != nil {
+		fields["instance_id"] = *rm.instanceId
+	}
+	return rm.opts.logger.WithFields(fields)
 }
 
-func NewResourceManager() *AWSResourceManager {
-	return &AWSResourceManager{}
+// Resources returns the cloud resources created so far
+func (rm *AWSResourceManager) Resources() Resources {
+	rm.guard.Lock()
+	defer rm.guard.Unlock()
+
+	resources := Resources{
+		Region:              rm.region,
+		InstanceType:        rm.instanceType,
+		SubnetID:            rm.subnetId,
+		AvailabilityZone:    rm.availabilityZone,
+		NetworkInterfaces:   append([]string(nil), rm.networkInterfaces...),
+		AllocationAddresses: append([]string(nil), rm.allocationAddresses...),
+		IPv6Addresses:       append([]string(nil), rm.ipv6Addresses...),
+		RoleName:            rm.roleName,
+		RolePolicy:          rm.rolePolicy,
+	}
+	if rm.instanceId != nil {
+		resources.InstanceID = *rm.instanceId
+	}
+	if rm.containerInstanceArn != nil {
+		resources.ContainerInstanceARN = *rm.containerInstanceArn
+	}
+	if rm.ecsCluster != nil {
+		resources.Cluster = *rm.ecsCluster
+	}
+	return resources
 }
 
-func (rm *AWSResourceManager) ecsDeleteCluster(session *session.Session, clusterName string) error {
+func (rm *AWSResourceManager) ecsDeleteCluster(ctx context.Context, session *session.Session, clusterName string) error {
 	svc := ecs.New(session)
 	input := &ecs.DeleteClusterInput{
 		Cluster: aws.String(clusterName),
 	}
 
-	result, err := svc.DeleteCluster(input)
+	var result *ecs.DeleteClusterOutput
+	err := callAWS(ctx, "ecs DeleteCluster", func(ctx context.Context) (err error) {
+		result, err = svc.DeleteClusterWithContext(ctx, input)
+		return err
+	}, ErrDependencyViolation)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ecsCreateCluster(session *session.Session, clusterName string) error {
+func (rm *AWSResourceManager) ecsCreateCluster(ctx context.Context, session *session.Session, clusterName string) error {
 	svc := ecs.New(session)
 	input := &ecs.CreateClusterInput{
 		ClusterName: aws.String(clusterName),
 	}
 
-	result, err := svc.CreateCluster(input)
+	var result *ecs.CreateClusterOutput
+	err := callAWS(ctx, "ecs CreateCluster", func(ctx context.Context) (err error) {
+		result, err = svc.CreateClusterWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ecsListContainerInstances(session *session.Session, clusterName string) ([]*string, error) {
+// ecsListContainerInstances lists the container instances of the cluster
+// running on the given ec2 instance
+func (rm *AWSResourceManager) ecsListContainerInstances(ctx context.Context, session *session.Session, clusterName string, instanceId string) ([]*string, error) {
 	svc := ecs.New(session)
 	input := &ecs.ListContainerInstancesInput{
 		Cluster: aws.String(clusterName),
+		Filter:  aws.String(fmt.Sprintf("ec2InstanceId == %s", instanceId)),
 	}
 
-	result, err := svc.ListContainerInstances(input)
+	var result *ecs.ListContainerInstancesOutput
+	err := callAWS(ctx, "ecs ListContainerInstances", func(ctx context.Context) (err error) {
+		result, err = svc.ListContainerInstancesWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return nil, err
 	}
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return result.ContainerInstanceArns, nil
 }
 
-func (rm *AWSResourceManager) ecsWaitForContainerInstances(session *session.Session, clusterName string) error {
-	log.Logger.Info("waiting until ecs cluster will have container instances..")
-	count := 1
-	for {
-		list, err := rm.ecsListContainerInstances(session, clusterName)
+func (rm *AWSResourceManager) ecsWaitForContainerInstances(ctx context.Context, session *session.Session, clusterName string, instanceId string) error {
+	w := newWaiter(fmt.Sprintf("ecs cluster to have container instance of %s", instanceId), rm.Waiter)
+	return w.Wait(ctx, func(ctx context.Context) (bool, error) {
+		list, err := rm.ecsListContainerInstances(ctx, session, clusterName, instanceId)
 		if err != nil {
-			return err
+			return false, err
 		}
-		if list == nil || len(list) == 0 {
-			time.Sleep(time.Second)
-			log.Logger.Infof("still waiting (%d seconds)...", count)
-		} else {
-			log.Logger.Info("succeed, ecs cluster now have container instances")
-			return nil
+		if len(list) == 0 {
+			return false, nil
+		}
+		rm.guard.Lock()
+		rm.containerInstanceArn = list[0]
+		rm.guard.Unlock()
+		rm.logger().Infof("succeed, ecs cluster now have container instance %s", *list[0])
+		return true, nil
+	})
+}
+
+// ec2WaitForInstanceState waits until the instance reaches the given state,
+// failing early when it reaches one of the unexpected states instead. That
+// error is classified by the state reason, such as ErrInsufficientCapacity
+func (rm *AWSResourceManager) ec2WaitForInstanceState(ctx context.Context, svc ec2Interface, instanceId string, state string, unexpected ...string) error {
+	w := newWaiter(fmt.Sprintf("aws ec2 instance %s to be %s", instanceId, state), rm.Waiter)
+	return w.Wait(ctx, func(ctx context.Context) (bool, error) {
+		var result *ec2.DescribeInstancesOutput
+		err := callAWS(ctx, "ec2 DescribeInstances", func(ctx context.Context) (err error) {
+			result, err = svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+				InstanceIds: []*string{aws.String(instanceId)},
+			})
+			return err
+		}, ErrNotFound)
+		if err != nil {
+			return false, err
 		}
-		count++
-		if count > 30 {
-			return errors.New("too much time to wait for ecs container instances")
+		for _, reservation := range result.Reservations {
+			for _, instance := range reservation.Instances {
+				current := aws.StringValue(instance.State.Name)
+				if current == state {
+					return true, nil
+				}
+				for _, u := range unexpected {
+					if current == u {
+						return false, instanceStateError(instanceId, instance)
+					}
+				}
+			}
 		}
+		return false, nil
+	})
+}
+
+// instanceStateError is the error of an instance that reached an unexpected
+// state, classified by the code of its state reason such as
+// Server.InsufficientInstanceCapacity
+func instanceStateError(instanceId string, instance *ec2.Instance) error {
+	err := fmt.Errorf("aws ec2 instance %s is %s", instanceId, aws.StringValue(instance.State.Name))
+	if instance.StateReason == nil {
+		return err
+	}
+	code := aws.StringValue(instance.StateReason.Code)
+	if i := strings.IndexByte(code, '.'); i >= 0 {
+		code = code[i+1:]
+	}
+	return &Error{
+		Op:    "ec2 instance state",
+		Code:  code,
+		Class: errorClasses[code],
+		Err:   fmt.Errorf("%s: %s", err.Error(), aws.StringValue(instance.StateReason.Message)),
 	}
 }
 
-func (rm *AWSResourceManager) ec2TerminateInstance(session *session.Session, instanceId string) error {
-	svc := ec2.New(session)
+func (rm *AWSResourceManager) ec2TerminateInstance(ctx context.Context, svc ec2Interface, instanceId string) error {
 	input := &ec2.TerminateInstancesInput{
 		InstanceIds: []*string{
 			aws.String(instanceId),
 		},
 	}
 
-	result, err := svc.TerminateInstances(input)
+	var result *ec2.TerminateInstancesOutput
+	err := callAWS(ctx, "ec2 TerminateInstances", func(ctx context.Context) (err error) {
+		result, err = svc.TerminateInstancesWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
-	svc.WaitUntilInstanceTerminated(&ec2.DescribeInstancesInput{
-		InstanceIds: []*string{aws.String(instanceId)},
-	})
-	log.Logger.Trace(result)
-	return nil
+	rm.logger().Tracef("%v", result)
+	return rm.ec2WaitForInstanceState(ctx, svc, instanceId, ec2.InstanceStateNameTerminated)
 }
 
-func (rm *AWSResourceManager) ec2CreateInstance(session *session.Session, instanceType string, keyName string, securityGroup string, subnetId string, iamInstanceProfile string, ecsCluster string) (*string, error) {
+func (rm *AWSResourceManager) ec2CreateInstance(ctx context.Context, svc ec2Interface, instanceType string, keyName string, securityGroup string, subnetId string, iamInstanceProfile string, ecsCluster string) (*string, error) {
 	userdata := `
 	#!/bin/bash
 	echo ECS_CLUSTER=%s >> /etc/ecs/ecs.config
@@ -169,8 +297,6 @@ func (rm *AWSResourceManager) ec2CreateInstance(session *session.Session, instan
 	userdata = fmt.Sprintf(userdata, ecsCluster)
 	userdata64 := base64.StdEncoding.EncodeToString([]byte(userdata))
 
-	svc := ec2.New(session)
-
 	input := &ec2.RunInstancesInput{
 		ImageId:      aws.String("ami-02649d71054b25d22"),
 		InstanceType: aws.String(instanceType),
@@ -186,32 +312,85 @@ func (rm *AWSResourceManager) ec2CreateInstance(session *session.Session, instan
 		},
 		SubnetId: aws.String(subnetId),
 	}
+	if rm.IPv6 {
+		input.Ipv6AddressCount = aws.Int64(1)
+	}
 
-	result, err := svc.RunInstances(input)
+	var result *ec2.Reservation
+	err := callAWS(ctx, "ec2 RunInstances", func(ctx context.Context) (err error) {
+		result, err = svc.RunInstancesWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return nil, err
 	}
+	rm.guard.Lock()
 	rm.instanceId = result.Instances[0].InstanceId
+	rm.instanceType = instanceType
+	rm.subnetId = subnetId
+	if placement := result.Instances[0].Placement; placement != nil {
+		rm.availabilityZone = aws.StringValue(placement.AvailabilityZone)
+	}
+	for _, eni := range result.Instances[0].NetworkInterfaces {
+		for _, address := range eni.Ipv6Addresses {
+			rm.ipv6Addresses = append(rm.ipv6Addresses, aws.StringValue(address.Ipv6Address))
+		}
+	}
+	rm.guard.Unlock()
+	rm.logger().Tracef("%v", result)
 
-	log.Logger.Info("wait until aws ec2 instance running..")
-	svc.WaitUntilInstanceRunning(&ec2.DescribeInstancesInput{
-		InstanceIds: []*string{aws.String(*result.Instances[0].InstanceId)},
-	})
-	log.Logger.Trace(result)
+	err = rm.ec2WaitForInstanceState(ctx, svc, aws.StringValue(result.Instances[0].InstanceId), ec2.InstanceStateNameRunning,
+		ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated)
+	if err != nil {
+		return nil, err
+	}
 	return result.Instances[0].InstanceId, nil
 }
 
-func (rm *AWSResourceManager) iamPutRolePolicy(session *session.Session, roleName string, rolePolicyName string) error {
+// ec2CreateInstanceWithFallback tries every instance type in every subnet in
+// order, moving on to the next pair when the current one has no capacity or
+// isn't supported in that availability zone. An instance that fails that way
+// after it was created is terminated first
+func (rm *AWSResourceManager) ec2CreateInstanceWithFallback(ctx context.Context, svc ec2Interface, instanceTypes []string, keyName string, securityGroup string, subnetIds []string, iamInstanceProfile string, ecsCluster string) (*string, string, error) {
+	if len(instanceTypes) == 0 || len(subnetIds) == 0 {
+		return nil, "", errors.New("at least one instance type and one subnet are required")
+	}
+
+	var lastErr error
+	for _, instanceType := range instanceTypes {
+		for _, subnetId := range subnetIds {
+			rm.logger().Infof("aws going to create ec2 instance %s in subnet %s", instanceType, subnetId)
+			instanceId, err := rm.ec2CreateInstance(ctx, svc, instanceType, keyName, securityGroup, subnetId, iamInstanceProfile, ecsCluster)
+			if err == nil {
+				rm.logger().Infof("aws created ec2 instance %s in subnet %s (%s)", instanceType, subnetId, rm.Resources().AvailabilityZone)
+				return instanceId, subnetId, nil
+			}
+			if !errors.Is(err, ErrInsufficientCapacity) && !errors.Is(err, ErrUnsupported) {
+				return nil, "", err
+			}
+			rm.logger().Warnf("aws can't create ec2 instance %s in subnet %s: %s", instanceType, subnetId, err.Error())
+			lastErr = err
+
+			if failed := rm.Resources().InstanceID; failed != "" {
+				// the instance is kept in the resources when it can't be
+				// terminated, so destroying the resources retries it
+				if err := rm.ec2TerminateInstance(ctx, svc, failed); err != nil && !errors.Is(err, ErrNotFound) {
+					return nil, "", fmt.Errorf("failed to terminate ec2 instance %s: %w", failed, err)
+				}
+				rm.guard.Lock()
+				rm.instanceId = nil
+				rm.instanceType = ""
+				rm.subnetId = ""
+				rm.availabilityZone = ""
+				rm.ipv6Addresses = nil
+				rm.guard.Unlock()
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("no instance type and subnet pair has capacity: %w", lastErr)
+}
+
+func (rm *AWSResourceManager) iamPutRolePolicy(ctx context.Context, session *session.Session, roleName string, rolePolicyName string) error {
 	rolePolicy := `{
 		"Version": "2012-10-17",
 		"Statement": [
@@ -259,26 +438,76 @@ func (rm *AWSResourceManager) iamPutRolePolicy(session *session.Session, roleNam
 		RoleName:       aws.String(roleName),
 	}
 
-	result, err := svc.PutRolePolicy(input)
+	var result *iam.PutRolePolicyOutput
+	err := callAWS(ctx, "iam PutRolePolicy", func(ctx context.Context) (err error) {
+		result, err = svc.PutRolePolicyWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) iamCreateRole(session *session.Session, roleName string) error {
+// iamPutCheckpointPolicy lets the role reach the S3 checkpoint location of the
+// run, in a policy of the run so the other runs sharing the role keep theirs
+func (rm *AWSResourceManager) iamPutCheckpointPolicy(ctx context.Context, session *session.Session, roleName string, rolePolicyName string) error {
+	checkpointPolicy, err := checkpointPolicy(rm.Checkpoint)
+	if err != nil || checkpointPolicy == "" {
+		return err
+	}
+	if rm.RunID == "" {
+		return errors.New("the checkpoint policy of the role needs a run id")
+	}
+	policyName := checkpointPolicyName(rolePolicyName, rm.RunID)
+
+	svc := iam.New(session)
+	input := &iam.PutRolePolicyInput{
+		PolicyDocument: aws.String(checkpointPolicy),
+		PolicyName:     aws.String(policyName),
+		RoleName:       aws.String(roleName),
+	}
+
+	var result *iam.PutRolePolicyOutput
+	err = callAWS(ctx, "iam PutRolePolicy", func(ctx context.Context) (err error) {
+		result, err = svc.PutRolePolicyWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	rm.guard.Lock()
+	rm.roleName = roleName
+	rm.rolePolicy = policyName
+	rm.guard.Unlock()
+
+	rm.logger().Tracef("%v", result)
+	return nil
+}
+
+func (rm *AWSResourceManager) iamDeleteRolePolicy(ctx context.Context, session *session.Session, roleName string, rolePolicyName string) error {
+	svc := iam.New(session)
+	input := &iam.DeleteRolePolicyInput{
+		PolicyName: aws.String(rolePolicyName),
+		RoleName:   aws.String(roleName),
+	}
+
+	var result *iam.DeleteRolePolicyOutput
+	err := callAWS(ctx, "iam DeleteRolePolicy", func(ctx context.Context) (err error) {
+		result, err = svc.DeleteRolePolicyWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	rm.logger().Tracef("%v", result)
+	return nil
+}
+
+func (rm *AWSResourceManager) iamCreateRole(ctx context.Context, session *session.Session, roleName string) error {
 	ecsPolicy := `{
 		"Version": "2012-10-17",
 		"Statement": [
@@ -299,33 +528,24 @@ func (rm *AWSResourceManager) iamCreateRole(session *session.Session, roleName s
 		RoleName:                 aws.String(roleName),
 	}
 
-	result, err := svc.CreateRole(input)
-	ignore := false
+	var result *iam.CreateRoleOutput
+	err := callAWS(ctx, "iam CreateRole", func(ctx context.Context) (err error) {
+		result, err = svc.CreateRoleWithContext(ctx, input)
+		return err
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		rm.logger().Infof("iam role already exist")
+		return nil
+	}
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case iam.ErrCodeEntityAlreadyExistsException:
-				log.Logger.Info("iam role already exist")
-				ignore = true
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
-		if ignore {
-			return nil
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ec2CreateNetworkInterface(session *session.Session, securityGroup string, subnetId string) (*string, error) {
+func (rm *AWSResourceManager) ec2CreateNetworkInterface(ctx context.Context, session *session.Session, securityGroup string, subnetId string) (*string, error) {
 	svc := ec2.New(session)
 	input := &ec2.CreateNetworkInterfaceInput{
 		Description: aws.String("netz"),
@@ -334,27 +554,29 @@ func (rm *AWSResourceManager) ec2CreateNetworkInterface(session *session.Session
 		},
 		SubnetId: aws.String(subnetId),
 	}
+	if rm.IPv6 {
+		input.Ipv6AddressCount = aws.Int64(1)
+	}
 
-	result, err := svc.CreateNetworkInterface(input)
+	var result *ec2.CreateNetworkInterfaceOutput
+	err := callAWS(ctx, "ec2 CreateNetworkInterface", func(ctx context.Context) (err error) {
+		result, err = svc.CreateNetworkInterfaceWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return nil, err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
+	rm.guard.Lock()
+	for _, address := range result.NetworkInterface.Ipv6Addresses {
+		rm.ipv6Addresses = append(rm.ipv6Addresses, aws.StringValue(address.Ipv6Address))
+	}
+	rm.guard.Unlock()
 	return result.NetworkInterface.NetworkInterfaceId, nil
 }
 
-func (rm *AWSResourceManager) ec2AttachNetworkInterface(session *session.Session, networkInterfaceId string, instanceId string, deviceIndex int64) error {
+func (rm *AWSResourceManager) ec2AttachNetworkInterface(ctx context.Context, session *session.Session, networkInterfaceId string, instanceId string, deviceIndex int64) error {
 	svc := ec2.New(session)
 	input := &ec2.AttachNetworkInterfaceInput{
 		DeviceIndex:        aws.Int64(deviceIndex),
@@ -362,26 +584,20 @@ func (rm *AWSResourceManager) ec2AttachNetworkInterface(session *session.Session
 		NetworkInterfaceId: aws.String(networkInterfaceId),
 	}
 
-	result, err := svc.AttachNetworkInterface(input)
+	var result *ec2.AttachNetworkInterfaceOutput
+	err := callAWS(ctx, "ec2 AttachNetworkInterface", func(ctx context.Context) (err error) {
+		result, err = svc.AttachNetworkInterfaceWithContext(ctx, input)
+		return err
+	}, ErrNotFound)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ec2AssociateIamInstanceProfile(session *session.Session, instanceId string, instanceProfileName string) error {
+func (rm *AWSResourceManager) ec2AssociateIamInstanceProfile(ctx context.Context, session *session.Session, instanceId string, instanceProfileName string) error {
 	svc := ec2.New(session)
 	input := &ec2.AssociateIamInstanceProfileInput{
 		IamInstanceProfile: &ec2.IamInstanceProfileSpecification{
@@ -390,275 +606,243 @@ func (rm *AWSResourceManager) ec2AssociateIamInstanceProfile(session *session.Se
 		InstanceId: aws.String(instanceId),
 	}
 
-	result, err := svc.AssociateIamInstanceProfile(input)
+	var result *ec2.AssociateIamInstanceProfileOutput
+	err := callAWS(ctx, "ec2 AssociateIamInstanceProfile", func(ctx context.Context) (err error) {
+		result, err = svc.AssociateIamInstanceProfileWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) iamAddRoleToInstanceProfile(session *session.Session, roleName string, instanceProfileName string) error {
+func (rm *AWSResourceManager) iamAddRoleToInstanceProfile(ctx context.Context, session *session.Session, roleName string, instanceProfileName string) error {
 	svc := iam.New(session)
 	input := &iam.AddRoleToInstanceProfileInput{
 		InstanceProfileName: aws.String(instanceProfileName),
 		RoleName:            aws.String(roleName),
 	}
 
-	result, err := svc.AddRoleToInstanceProfile(input)
-	ignore := false
+	var result *iam.AddRoleToInstanceProfileOutput
+	err := callAWS(ctx, "iam AddRoleToInstanceProfile", func(ctx context.Context) (err error) {
+		result, err = svc.AddRoleToInstanceProfileWithContext(ctx, input)
+		return err
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		rm.logger().Warnf("iam role already associated with instance profile")
+		return nil
+	}
+	if awsErrorCode(err) == iam.ErrCodeLimitExceededException {
+		return nil
+	}
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case iam.ErrCodeEntityAlreadyExistsException:
-				log.Logger.Warn("iam role already associated with instance profile")
-				ignore = true
-			case iam.ErrCodeLimitExceededException:
-				ignore = true
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
-		if ignore {
-			return nil
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) iamCreateInstanceProfile(session *session.Session, instanceProfileName string) error {
+func (rm *AWSResourceManager) iamCreateInstanceProfile(ctx context.Context, session *session.Session, instanceProfileName string) error {
 	svc := iam.New(session)
 	input := &iam.CreateInstanceProfileInput{
 		InstanceProfileName: aws.String(instanceProfileName),
 	}
 
-	result, err := svc.CreateInstanceProfile(input)
-	ignore := false
+	var result *iam.CreateInstanceProfileOutput
+	err := callAWS(ctx, "iam CreateInstanceProfile", func(ctx context.Context) (err error) {
+		result, err = svc.CreateInstanceProfileWithContext(ctx, input)
+		return err
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		rm.logger().Infof("instance profile already exist")
+		return nil
+	}
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case iam.ErrCodeEntityAlreadyExistsException:
-				ignore = true
-				log.Logger.Info("instance profile already exist")
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
-		if ignore {
-			return nil
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ec2DeleteNetworkInterface(session *session.Session, networkInterfaceId string) error {
+func (rm *AWSResourceManager) ec2DeleteNetworkInterface(ctx context.Context, session *session.Session, networkInterfaceId string) error {
 	svc := ec2.New(session)
 	input := &ec2.DeleteNetworkInterfaceInput{
 		NetworkInterfaceId: aws.String(networkInterfaceId),
 	}
 
-	result, err := svc.DeleteNetworkInterface(input)
+	var result *ec2.DeleteNetworkInterfaceOutput
+	err := callAWS(ctx, "ec2 DeleteNetworkInterface", func(ctx context.Context) (err error) {
+		result, err = svc.DeleteNetworkInterfaceWithContext(ctx, input)
+		return err
+	}, ErrDependencyViolation)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ec2ReleaseAddress(session *session.Session, allocationId string) error {
+func (rm *AWSResourceManager) ec2ReleaseAddress(ctx context.Context, session *session.Session, allocationId string) error {
 	svc := ec2.New(session)
 	input := &ec2.ReleaseAddressInput{
 		AllocationId: aws.String(allocationId),
 	}
 
-	result, err := svc.ReleaseAddress(input)
+	var result *ec2.ReleaseAddressOutput
+	err := callAWS(ctx, "ec2 ReleaseAddress", func(ctx context.Context) (err error) {
+		result, err = svc.ReleaseAddressWithContext(ctx, input)
+		return err
+	}, ErrDependencyViolation)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) ec2AllocateAddress(session *session.Session) (*string, error) {
+func (rm *AWSResourceManager) ec2AllocateAddress(ctx context.Context, session *session.Session) (*string, error) {
 	svc := ec2.New(session)
 	input := &ec2.AllocateAddressInput{
 		Domain: aws.String("vpc"),
 	}
 
-	result, err := svc.AllocateAddress(input)
+	var result *ec2.AllocateAddressOutput
+	err := callAWS(ctx, "ec2 AllocateAddress", func(ctx context.Context) (err error) {
+		result, err = svc.AllocateAddressWithContext(ctx, input)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return nil, err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return result.AllocationId, nil
 }
 
-func (rm *AWSResourceManager) ec2AssociateAddress(session *session.Session, allocationId string, networkInterfaceId string) error {
+func (rm *AWSResourceManager) ec2AssociateAddress(ctx context.Context, session *session.Session, allocationId string, networkInterfaceId string) error {
 	svc := ec2.New(session)
 	input := &ec2.AssociateAddressInput{
 		AllocationId:       aws.String(allocationId),
 		NetworkInterfaceId: aws.String(networkInterfaceId),
 	}
 
-	result, err := svc.AssociateAddress(input)
+	var result *ec2.AssociateAddressOutput
+	err := callAWS(ctx, "ec2 AssociateAddress", func(ctx context.Context) (err error) {
+		result, err = svc.AssociateAddressWithContext(ctx, input)
+		return err
+	}, ErrNotFound)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				log.Logger.Error(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Logger.Error(err.Error())
-		}
 		return err
 	}
 
-	log.Logger.Trace(result)
+	rm.logger().Tracef("%v", result)
 	return nil
 }
 
-func (rm *AWSResourceManager) CreateResources(region string, numOfNic int, instanceType string, keyName string, securityGroup string, subnetId string, roleName string, rolePolicyName string, instanceProfileName string, ecsCluster string) error {
-	log.Logger.Info("going to create aws cloud resources")
-
+// CreateResources creates the instance with its network interfaces, the
+// instance types and subnets are tried in order until one has capacity
+func (rm *AWSResourceManager) CreateResources(ctx context.Context, region string, numOfNic int, instanceTypes []string, keyName string, securityGroup string, subnetIds []string, roleName string, rolePolicyName string, instanceProfileName string, ecsCluster string) error {
+	ctx = withLogger(ctx, rm.logger())
+	rm.guard.Lock()
 	rm.region = region
-	rm.ecsCluster = &ecsCluster
+	rm.guard.Unlock()
+	rm.logger().Infof("going to create aws cloud resources")
 
-	session := session.New(&aws.Config{Region: aws.String(region)})
-	log.Logger.Debug("aws going to create iam role")
-	err := rm.iamCreateRole(session, roleName)
+	session := session.New(withoutSDKRetries(aws.NewConfig()).WithRegion(region))
+	rm.logger().Debugf("aws going to create iam role")
+	err := rm.iamCreateRole(ctx, session, roleName)
 	if err != nil {
 		return err
 	}
-	log.Logger.Info("aws iam role succeed")
+	rm.logger().Infof("aws iam role succeed")
 
-	log.Logger.Debug("aws going to put role policy")
-	err = rm.iamPutRolePolicy(session, roleName, rolePolicyName)
+	rm.logger().Debugf("aws going to put role policy")
+	err = rm.iamPutRolePolicy(ctx, session, roleName, rolePolicyName)
 	if err != nil {
 		return err
 	}
-	log.Logger.Info("aws put role policy succeed")
+	rm.logger().Infof("aws put role policy succeed")
 
-	log.Logger.Debug("aws going to create instance profile")
-	err = rm.iamCreateInstanceProfile(session, instanceProfileName)
+	rm.logger().Debugf("aws going to put checkpoint policy")
+	err = rm.iamPutCheckpointPolicy(ctx, session, roleName, rolePolicyName)
 	if err != nil {
 		return err
 	}
-	log.Logger.Info("aws instance profile succeed")
+	rm.logger().Infof("aws put checkpoint policy succeed")
 
-	log.Logger.Debug("aws going to add role to instance profile")
-	err = rm.iamAddRoleToInstanceProfile(session, roleName, instanceProfileName)
+	rm.logger().Debugf("aws going to create instance profile")
+	err = rm.iamCreateInstanceProfile(ctx, session, instanceProfileName)
 	if err != nil {
 		return err
 	}
-	log.Logger.Info("add iam to instance profile succeed")
+	rm.logger().Infof("aws instance profile succeed")
 
-	log.Logger.Debug("aws going to create ecs cluster")
-	err = rm.ecsCreateCluster(session, ecsCluster)
+	rm.logger().Debugf("aws going to add role to instance profile")
+	err = rm.iamAddRoleToInstanceProfile(ctx, session, roleName, instanceProfileName)
 	if err != nil {
 		return err
 	}
-	log.Logger.Info("aws create ecs cluster succeed")
+	rm.logger().Infof("add iam to instance profile succeed")
 
-	log.Logger.Debug("aws going to create ec2 instance")
-	instanceId, errInstance := rm.ec2CreateInstance(session, instanceType, keyName, securityGroup, subnetId, instanceProfileName, ecsCluster)
+	rm.logger().Debugf("aws going to create ecs cluster")
+	err = rm.ecsCreateCluster(ctx, session, ecsCluster)
+	if err != nil {
+		return err
+	}
+	rm.guard.Lock()
+	rm.ecsCluster = &ecsCluster
+	rm.guard.Unlock()
+	rm.logger().Infof("aws create ecs cluster succeed")
+
+	rm.logger().Debugf("aws going to create ec2 instance")
+	instanceId, subnetId, errInstance := rm.ec2CreateInstanceWithFallback(ctx, ec2.New(session), instanceTypes, keyName, securityGroup, subnetIds, instanceProfileName, ecsCluster)
 	if errInstance != nil {
 		return errInstance
 	}
-	log.Logger.Debug("aws create ec2 instance succeed")
+	rm.logger().Debugf("aws create ec2 instance succeed")
 
 	for i := 1; i <= numOfNic; i++ {
-		log.Logger.Debugf("aws going to create network interface: #%d", i)
-		networkInterfaceId, err1 := rm.ec2CreateNetworkInterface(session, securityGroup, subnetId)
+		rm.logger().Debugf("aws going to create network interface: #%d", i)
+		networkInterfaceId, err1 := rm.ec2CreateNetworkInterface(ctx, session, securityGroup, subnetId)
 		if err1 != nil {
 			return err1
 		}
-		log.Logger.Infof("aws create network interface succeed: #%d", i)
+		rm.logger().WithFields(Fields{"eni": *networkInterfaceId}).Infof("aws create network interface succeed: #%d", i)
 
-		log.Logger.Debugf("aws going to allocate elastic ip: #%d", i)
-		allocationId, err2 := rm.ec2AllocateAddress(session)
+		rm.logger().Debugf("aws going to allocate elastic ip: #%d", i)
+		allocationId, err2 := rm.ec2AllocateAddress(ctx, session)
 		if err2 != nil {
 			return err2
 		}
-		log.Logger.Infof("aws allocate elastic ip succeed: #%d", i)
+		rm.logger().WithFields(Fields{"eni": *networkInterfaceId}).Infof("aws allocate elastic ip succeed: #%d", i)
 
+		rm.guard.Lock()
 		rm.networkInterfaces = append(rm.networkInterfaces, *networkInterfaceId)
 		rm.allocationAddresses = append(rm.allocationAddresses, *allocationId)
+		rm.guard.Unlock()
 
-		log.Logger.Debugf("aws going to associate elastic ip to network interface: #%d", i)
-		err3 := rm.ec2AssociateAddress(session, *allocationId, *networkInterfaceId)
+		rm.logger().WithFields(Fields{"eni": *networkInterfaceId}).Debugf("aws going to associate elastic ip to network interface: #%d", i)
+		err3 := rm.ec2AssociateAddress(ctx, session, *allocationId, *networkInterfaceId)
 		if err3 != nil {
 			return err3
 		}
-		log.Logger.Infof("aws associate elastic ip to network interface succeed: #%d", i)
+		rm.logger().WithFields(Fields{"eni": *networkInterfaceId}).Infof("aws associate elastic ip to network interface succeed: #%d", i)
 
-		log.Logger.Debugf("aws going to attach network interface to instance: #%d", i)
-		err4 := rm.ec2AttachNetworkInterface(session, *networkInterfaceId, *instanceId, int64(i))
+		rm.logger().WithFields(Fields{"eni": *networkInterfaceId}).Debugf("aws going to attach network interface to instance: #%d", i)
+		err4 := rm.ec2AttachNetworkInterface(ctx, session, *networkInterfaceId, *instanceId, int64(i))
 		if err4 != nil {
 			return err4
 		}
-		log.Logger.Infof("aws attach network interface to instance succeed: #%d", i)
+		rm.logger().WithFields(Fields{"eni": *networkInterfaceId}).Infof("aws attach network interface to instance succeed: #%d", i)
 	}
 
-	err = rm.ecsWaitForContainerInstances(session, ecsCluster)
+	err = rm.ecsWaitForContainerInstances(ctx, session, ecsCluster, *instanceId)
 	if err != nil {
 		return err
 	}
@@ -666,48 +850,84 @@ func (rm *AWSResourceManager) CreateResources(region string, numOfNic int, insta
 	return nil
 }
 
+// DestroyResources destroys the resources created so far, the ones that fail
+// to be destroyed are kept so that destroying again retries them
 func (rm *AWSResourceManager) DestroyResources(skipDestroy bool) {
-	rm.guard.Lock()
-	defer rm.guard.Unlock()
-	if rm.instanceId == nil {
+	rm.destroying.Lock()
+	defer rm.destroying.Unlock()
+	resources := rm.Resources()
+	if resources.Empty() {
 		return
 	}
 	if skipDestroy {
-		log.Logger.Warn("skipping destroy resources as you asked")
+		rm.logger().Warnf("skipping destroy resources as you asked")
 		return
 	}
 
-	log.Logger.Warn("destroying resources, it could take a minute so please don't kill me...")
+	rm.logger().Warnf("destroying resources, it could take a minute so please don't kill me...")
 
-	session := session.New(&aws.Config{Region: aws.String(rm.region)})
-	if rm.instanceId != nil {
-		err := rm.ec2TerminateInstance(session, *rm.instanceId)
-		if err != nil {
-			log.Logger.Error("failed to terminate ec2 instance")
+	ctx := withLogger(context.Background(), rm.logger())
+	session := session.New(withoutSDKRetries(aws.NewConfig()).WithRegion(resources.Region))
+	if resources.InstanceID != "" {
+		err := rm.ec2TerminateInstance(ctx, ec2.New(session), resources.InstanceID)
+		// a resource that's gone was destroyed by a previous attempt
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			rm.logger().Errorf("failed to terminate ec2 instance: %s", err.Error())
+		} else {
+			rm.guard.Lock()
+			rm.instanceId = nil
+			rm.containerInstanceArn = nil
+			rm.guard.Unlock()
 		}
-		rm.instanceId = nil
 	}
 
-	for _, allocationId := range rm.allocationAddresses {
-		err := rm.ec2ReleaseAddress(session, allocationId)
-		if err != nil {
-			log.Logger.Errorf("failed to release elastic ip with id: %s", allocationId)
+	var allocationAddresses []string
+	for _, allocationId := range resources.AllocationAddresses {
+		err := rm.ec2ReleaseAddress(ctx, session, allocationId)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			rm.logger().Errorf("failed to release elastic ip with id: %s: %s", allocationId, err.Error())
+			allocationAddresses = append(allocationAddresses, allocationId)
 		}
 	}
 
-	for _, networkInterfaceId := range rm.networkInterfaces {
-		err := rm.ec2DeleteNetworkInterface(session, networkInterfaceId)
-		if err != nil {
-			log.Logger.Errorf("failed to delete network interface with id: %s", networkInterfaceId)
+	var networkInterfaces []string
+	for _, networkInterfaceId := range resources.NetworkInterfaces {
+		err := rm.ec2DeleteNetworkInterface(ctx, session, networkInterfaceId)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			rm.logger().WithFields(Fields{"eni": networkInterfaceId}).Errorf("failed to delete network interface with id: %s: %s", networkInterfaceId, err.Error())
+			networkInterfaces = append(networkInterfaces, networkInterfaceId)
 		}
 	}
 
-	if rm.ecsCluster != nil {
-		err := rm.ecsDeleteCluster(session, *rm.ecsCluster)
-		if err != nil {
-			log.Logger.Errorf("failed to delete ecs cluster: %s", *rm.ecsCluster)
+	rm.guard.Lock()
+	rm.allocationAddresses = allocationAddresses
+	rm.networkInterfaces = networkInterfaces
+	if len(rm.networkInterfaces) == 0 {
+		rm.ipv6Addresses = nil
+	}
+	rm.guard.Unlock()
+
+	if resources.Cluster != "" {
+		err := rm.ecsDeleteCluster(ctx, session, resources.Cluster)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			rm.logger().Errorf("failed to delete ecs cluster: %s: %s", resources.Cluster, err.Error())
+		} else {
+			rm.guard.Lock()
+			rm.ecsCluster = nil
+			rm.guard.Unlock()
+		}
+	}
+
+	if resources.RolePolicy != "" {
+		err := rm.iamDeleteRolePolicy(ctx, session, resources.RoleName, resources.RolePolicy)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			rm.logger().Errorf("failed to delete role policy: %s: %s", resources.RolePolicy, err.Error())
+		} else {
+			rm.guard.Lock()
+			rm.roleName = ""
+			rm.rolePolicy = ""
+			rm.guard.Unlock()
 		}
-		rm.ecsCluster = nil
 	}
-	log.Logger.Info("done to destroy resources.")
+	rm.logger().Infof("done to destroy resources.")
 }
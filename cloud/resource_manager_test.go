@@ -0,0 +1,157 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// fakeEC2 creates instances of the types in running, the types in rejected
+// fail RunInstances with their error code and the types in stopped are
+// created but shut down with their state reason
+type fakeEC2 struct {
+	running  map[string]bool
+	rejected map[string]string
+	stopped  map[string]string
+
+	mu         sync.Mutex
+	instances  map[string]*ec2.Instance
+	runs       []string
+	terminated []string
+}
+
+func (f *fakeEC2) RunInstancesWithContext(ctx aws.Context, input *ec2.RunInstancesInput, opts ...request.Option) (*ec2.Reservation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instanceType := aws.StringValue(input.InstanceType)
+	f.runs = append(f.runs, instanceType+"/"+aws.StringValue(input.SubnetId))
+	if code, ok := f.rejected[instanceType]; ok {
+		return nil, awserr.New(code, "rejected", nil)
+	}
+
+	instance := &ec2.Instance{
+		InstanceId: aws.String(fmt.Sprintf("i-%d", len(f.runs))),
+		State:      &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNamePending)},
+		Placement:  &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+	}
+	if f.running[instanceType] {
+		instance.State.Name = aws.String(ec2.InstanceStateNameRunning)
+	}
+	if code, ok := f.stopped[instanceType]; ok {
+		instance.State.Name = aws.String(ec2.InstanceStateNameTerminated)
+		instance.StateReason = &ec2.StateReason{Code: aws.String(code), Message: aws.String(code + ": shut down")}
+	}
+	if f.instances == nil {
+		f.instances = make(map[string]*ec2.Instance)
+	}
+	f.instances[*instance.InstanceId] = instance
+	return &ec2.Reservation{Instances: []*ec2.Instance{instance}}, nil
+}
+
+func (f *fakeEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reservation := &ec2.Reservation{}
+	for _, id := range input.InstanceIds {
+		if instance, ok := f.instances[aws.StringValue(id)]; ok {
+			reservation.Instances = append(reservation.Instances, instance)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+}
+
+func (f *fakeEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range input.InstanceIds {
+		f.terminated = append(f.terminated, aws.StringValue(id))
+		if instance, ok := f.instances[aws.StringValue(id)]; ok {
+			instance.State.Name = aws.String(ec2.InstanceStateNameTerminated)
+		}
+	}
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func TestCreateInstanceWithFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		ec2        *fakeEC2
+		instanceID string
+		subnet     string
+		runs       string
+		terminated string
+		err        error
+	}{
+		{
+			name:       "rejected by RunInstances",
+			ec2:        &fakeEC2{rejected: map[string]string{"c5n.9xlarge": "InsufficientInstanceCapacity"}, running: map[string]bool{"c4.8xlarge": true}},
+			instanceID: "i-3",
+			subnet:     "subnet-a",
+			runs:       "[c5n.9xlarge/subnet-a c5n.9xlarge/subnet-b c4.8xlarge/subnet-a]",
+			terminated: "[]",
+		},
+		{
+			name:       "shut down while waiting",
+			ec2:        &fakeEC2{stopped: map[string]string{"c5n.9xlarge": "Server.InsufficientInstanceCapacity"}, running: map[string]bool{"c4.8xlarge": true}},
+			instanceID: "i-3",
+			subnet:     "subnet-a",
+			runs:       "[c5n.9xlarge/subnet-a c5n.9xlarge/subnet-b c4.8xlarge/subnet-a]",
+			terminated: "[i-1 i-2]",
+		},
+		{
+			name:       "other failure while waiting",
+			ec2:        &fakeEC2{stopped: map[string]string{"c5n.9xlarge": "Server.InternalError"}, running: map[string]bool{"c4.8xlarge": true}},
+			runs:       "[c5n.9xlarge/subnet-a]",
+			terminated: "[]",
+		},
+		{
+			name:       "no capacity anywhere",
+			ec2:        &fakeEC2{stopped: map[string]string{"c5n.9xlarge": "Server.InsufficientInstanceCapacity", "c4.8xlarge": "Server.InsufficientInstanceCapacity"}},
+			runs:       "[c5n.9xlarge/subnet-a c5n.9xlarge/subnet-b c4.8xlarge/subnet-a c4.8xlarge/subnet-b]",
+			terminated: "[i-1 i-2 i-3 i-4]",
+			err:        ErrInsufficientCapacity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rm := NewResourceManager()
+			rm.Waiter = WaiterConfig{Timeout: 10 * time.Second, MinDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+			instanceID, subnet, err := rm.ec2CreateInstanceWithFallback(context.Background(), tt.ec2,
+				[]string{"c5n.9xlarge", "c4.8xlarge"}, "key", "sg", []string{"subnet-a", "subnet-b"}, "profile", "cluster")
+			if tt.instanceID == "" {
+				if err == nil {
+					t.Fatalf("created instance %s", aws.StringValue(instanceID))
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Errorf("got error %v, want %v", err, tt.err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if aws.StringValue(instanceID) != tt.instanceID || subnet != tt.subnet {
+					t.Errorf("created %s in %s, want %s in %s", aws.StringValue(instanceID), subnet, tt.instanceID, tt.subnet)
+				}
+				resources := rm.Resources()
+				if resources.InstanceID != tt.instanceID || resources.InstanceType != "c4.8xlarge" {
+					t.Errorf("resources have %s %s", resources.InstanceID, resources.InstanceType)
+				}
+			}
+			if got := fmt.Sprint(tt.ec2.runs); got != tt.runs {
+				t.Errorf("ran %s, want %s", got, tt.runs)
+			}
+			if got := fmt.Sprint(tt.ec2.terminated); got != tt.terminated {
+				t.Errorf("terminated %s, want %s", got, tt.terminated)
+			}
+		})
+	}
+}
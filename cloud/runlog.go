@@ -0,0 +1,116 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// Markers written to the audit stream of a run
+const (
+	MarkerRunStarted       = "run_started"
+	MarkerResourcesCreated = "resources_created"
+	MarkerTaskStarted      = "task_started"
+	MarkerTaskStopped      = "task_stopped"
+	MarkerTimeout          = "timeout"
+	MarkerDestroyStarted   = "destroy_started"
+	MarkerDestroyFinished  = "destroy_finished"
+	MarkerNote             = "note"
+)
+
+// RunLogStream returns the name of the audit stream of a run
+func RunLogStream(runID string) string {
+	return fmt.Sprintf("netz_run/%s", runID)
+}
+
+// Marker is an event of a run, written to its audit stream as JSON
+type Marker struct {
+	Marker  string      `json:"marker"`
+	RunID   string      `json:"run_id"`
+	Time    time.Time   `json:"time"`
+	User    string      `json:"user,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// RunLog writes the markers of a run to its own stream in the log group, next
+// to the streams of its tasks, so the log group is an audit trail of the run
+type RunLog struct {
+	RunID        string
+	LogGroupName string
+	Region       string
+	Config       *aws.Config
+	// LogRetentionDays and LogKMSKeyID are set on the log group when it's
+	// created by the run log
+	LogRetentionDays int
+	LogKMSKeyID      string
+
+	writer *logWriter
+	opts   options
+}
+
+func NewRunLog(runID string, logGroupName string, region string, opts ...Option) *RunLog {
+	return &RunLog{
+		opts:         newOptions(opts),
+		RunID:        runID,
+		LogGroupName: logGroupName,
+		Region:       region,
+		Config:       aws.NewConfig(),
+	}
+}
+
+// Open creates the log group and the audit stream of the run unless they exist
+func (rl *RunLog) Open(ctx context.Context) error {
+	sess, err := session.NewSession(withoutSDKRetries(rl.Config).WithRegion(rl.Region))
+	if err != nil {
+		return err
+	}
+	cwl := cloudwatchlogs.New(sess)
+	ctx = withLogger(ctx, rl.opts.logger)
+
+	if err := createLogGroup(ctx, cwl, rl.LogGroupName, rl.LogRetentionDays, rl.LogKMSKeyID); err != nil {
+		return err
+	}
+
+	writer := &logWriter{
+		CloudWatchLogs: cwl,
+		Logger:         rl.opts.logger,
+		LogGroupName:   rl.LogGroupName,
+		LogStreamName:  RunLogStream(rl.RunID),
+		Timeout:        time.Minute,
+	}
+	if err := writer.CreateStream(ctx); err != nil {
+		return fmt.Errorf("unable to create log stream %s: %s", writer.LogStreamName, err.Error())
+	}
+	rl.writer = writer
+	return nil
+}
+
+// Mark writes a marker to the audit stream, data is marshalled as JSON
+func (rl *RunLog) Mark(ctx context.Context, marker string, message string, data interface{}) error {
+	if rl.writer == nil {
+		return fmt.Errorf("run log of %s is not open", rl.RunID)
+	}
+
+	m := Marker{
+		Marker:  marker,
+		RunID:   rl.RunID,
+		Time:    time.Now().UTC(),
+		User:    os.Getenv("USER"),
+		Message: message,
+		Data:    data,
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	rl.writer.logger().Debugf("writing %s marker", marker)
+	return rl.writer.WriteString(ctx, string(body))
+}
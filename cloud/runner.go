@@ -7,18 +7,30 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
-	"strings"
+	"sort"
+	"sync"
 	"time"
 
-	log "github.com/cmpxchg16/netz/logger"
-
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/ecs"
 )
 
+const (
+	defaultTaskPollMinDelay = time.Second * 5
+	defaultTaskPollMaxDelay = time.Second * 30
+	// defaultTaskPollMaxErrors keeps a wait of hours from failing on a
+	// transient DescribeTasks error
+	defaultTaskPollMaxErrors = 5
+
+	// resultsDir is where docker/discover.sh writes its results in the
+	// container, the files are named after the TASK_DEFINITION variable
+	resultsDir = "/opt/out"
+)
+
+var resultFileFormats = []string{"masscan-%s.out", "zgrab2-%s.out", "adapters-%s.json"}
+
 func parse(file string) (*ecs.RegisterTaskDefinitionInput, error) {
 	body, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -34,47 +46,99 @@ func parse(file string) (*ecs.RegisterTaskDefinitionInput, error) {
 }
 
 type Runner struct {
-	TaskDefinitionFile  string
-	Cluster             string
-	LogGroupName        string
-	Region              string
-	Config              *aws.Config
-	SecurityGroups      []string
-	Subnets             []string
-	NumOfNic            int
-	InstanceType        string
-	KeyName             string
-	RoleName            string
-	RolePolicyName      string
-	InstanceProfileName string
-	TaskTimeout         int
-	SkipDestroy         bool
-}
-
-func NewRunner() *Runner {
+	TaskDefinitionFile string
+	Cluster            string
+	// ContainerInstance is the ARN of the container instance the task is
+	// pinned to, when empty ECS places the task anywhere in the cluster
+	ContainerInstance string
+	LogGroupName      string
+	// LogRetentionDays and LogKMSKeyID are set on the log group when it's
+	// created, zero retention keeps the events forever
+	LogRetentionDays int
+	LogKMSKeyID      string
+	Region           string
+	Config           *aws.Config
+	TaskTimeout      int
+	// LiveTail streams logs through CloudWatch Logs live tail sessions,
+	// falling back to polling when they're unavailable
+	LiveTail bool
+	// ContainerLog mirrors the container log events to a local file, the
+	// watchers resume after the events it already has
+	ContainerLog *ContainerLog
+	// OnLogEvent is called with every container log event as it's streamed,
+	// from the goroutine watching the stream of the container
+	OnLogEvent func(event LoggedEvent)
+	// Waiter controls polling for the task to stop, its timeout is taken
+	// from the task timeout
+	Waiter WaiterConfig
+	// Environment is added to the environment of the first container of the
+	// task, next to TASK_DEFINITION
+	Environment map[string]string
+
+	opts options
+}
+
+func NewRunner(opts ...Option) *Runner {
 	return &Runner{
+		opts:   newOptions(opts),
 		Region: os.Getenv("AWS_REGION"),
 		Config: aws.NewConfig(),
+		Waiter: WaiterConfig{
+			MinDelay:  defaultTaskPollMinDelay,
+			MaxDelay:  defaultTaskPollMaxDelay,
+			MaxErrors: defaultTaskPollMaxErrors,
+		},
 	}
 }
 
+// Run starts the task, streams its logs and waits until it stops
 func (r *Runner) Run(ctx context.Context, taskTimeout int) error {
-	taskDefinitionInput, err := parse(r.TaskDefinitionFile)
+	task, err := r.StartTask(ctx)
 	if err != nil {
 		return err
 	}
+
+	watch := r.WatchLogs(ctx, task)
+	if err := r.WaitTask(ctx, task, taskTimeout); err != nil {
+		watch.Stop()
+		return err
+	}
+	watch.Drain()
+	return nil
+}
+
+// logger returns the child logger of the runner, with its region and cluster
+func (r *Runner) logger() Logger {
+	return r.opts.logger.WithFields(Fields{
+		"component": "runner",
+		"region":    r.Region,
+		"cluster":   r.Cluster,
+	})
+}
+
+func (r *Runner) session() *session.Session {
+	return session.Must(session.NewSession(withoutSDKRetries(r.Config).WithRegion(r.Region)))
+}
+
+// StartTask registers the task definition and runs it on the cluster
+func (r *Runner) StartTask(ctx context.Context) (*Task, error) {
+	ctx = withLogger(ctx, r.logger())
+	taskDefinitionInput, err := parse(r.TaskDefinitionFile)
+	if err != nil {
+		return nil, err
+	}
 	taskDefinitionInput.NetworkMode = aws.String(ecs.NetworkModeHost)
-	log.Logger.Trace(taskDefinitionInput)
+	r.logger().Tracef("%v", taskDefinitionInput)
 
 	streamPrefix := fmt.Sprintf("netz_task_%d", time.Now().Nanosecond())
 
-	sess := session.Must(session.NewSession(r.Config.WithRegion(r.Region)))
+	sess := r.session()
 
-	if err := createLogGroup(sess, r.LogGroupName); err != nil {
-		return err
+	if err := createLogGroup(ctx, cloudwatchlogs.New(sess), r.LogGroupName, r.LogRetentionDays, r.LogKMSKeyID); err != nil {
+		return nil, err
 	}
 
-	log.Logger.Infof("setting tasks to use log group %s", r.LogGroupName)
+	r.logger().Infof("setting tasks to use log group %s", r.LogGroupName)
 	for _, def := range taskDefinitionInput.ContainerDefinitions {
 		def.LogConfiguration = &ecs.LogConfiguration{
 			LogDriver: aws.String("awslogs"),
@@ -91,91 +155,361 @@ func (r *Runner) Run(ctx context.Context, taskTimeout int) error {
 			Name:  aws.String("TASK_DEFINITION"),
 			Value: aws.String(streamPrefix),
 		})
+	names := make([]string, 0, len(r.Environment))
+	for name := range r.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		taskDefinitionInput.ContainerDefinitions[0].Environment = append(taskDefinitionInput.ContainerDefinitions[0].Environment,
+			&ecs.KeyValuePair{
+				Name:  aws.String(name),
+				Value: aws.String(r.Environment[name]),
+			})
+	}
 
 	svc := ecs.New(sess)
 
-	log.Logger.Infof("registering a task for %s", *taskDefinitionInput.Family)
-	resp, err := svc.RegisterTaskDefinition(taskDefinitionInput)
-	if err != nil {
+	r.logger().Infof("registering a task for %s", *taskDefinitionInput.Family)
+	var resp *ecs.RegisterTaskDefinitionOutput
+	err = callAWS(ctx, "ecs RegisterTaskDefinition", func(ctx context.Context) (err error) {
+		resp, err = svc.RegisterTaskDefinitionWithContext(ctx, taskDefinitionInput)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	taskDefinition := fmt.Sprintf("%s:%d",
 		*resp.TaskDefinition.Family, *resp.TaskDefinition.Revision)
 
-	runTaskInput := &ecs.RunTaskInput{
-		TaskDefinition: aws.String(taskDefinition),
-		Cluster:        aws.String(r.Cluster),
-		Count:          aws.Int64(1),
-		Overrides: &ecs.TaskOverride{
-			ContainerOverrides: []*ecs.ContainerOverride{},
-		},
+	tasks, err := r.runTask(ctx, svc, taskDefinition)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Logger.Infof("running task %s", taskDefinition)
-	runResp, err := svc.RunTask(runTaskInput)
-	if err != nil {
-		return fmt.Errorf("unable to run task: %s", err.Error())
+	task := &Task{
+		TaskDefinition: taskDefinition,
+		StreamPrefix:   streamPrefix,
+		LogGroupName:   r.LogGroupName,
+		ResultFiles:    resultFiles(taskDefinitionInput, streamPrefix),
+		StartedAt:      time.Now().UTC(),
+	}
+	for _, t := range tasks {
+		task.TaskARNs = append(task.TaskARNs, *t.TaskArn)
+		for _, container := range t.Containers {
+			task.Containers = append(task.Containers, TaskContainer{
+				ID:        path.Base(*container.ContainerArn),
+				Name:      aws.StringValue(container.Name),
+				LogStream: logStreamName(streamPrefix, container, t),
+			})
+		}
 	}
 
-	cwl := cloudwatchlogs.New(sess)
+	return task, nil
+}
 
-	for _, task := range runResp.Tasks {
-		for _, container := range task.Containers {
-			containerID := path.Base(*container.ContainerArn)
-			watcher := &logWatcher{
-				LogGroupName:   r.LogGroupName,
-				LogStreamName:  logStreamName(streamPrefix, container, task),
-				CloudWatchLogs: cwl,
-
-				Printer: func(ev *cloudwatchlogs.FilteredLogEvent) bool {
-					finishedPrefix := fmt.Sprintf(
-						"container %s exited with",
-						containerID,
-					)
-					if strings.HasPrefix(*ev.Message, finishedPrefix) {
-						log.Logger.Infof("found container finished message for %s: %s",
-							containerID, *ev.Message)
-						return false
-					}
-					log.Logger.Info(*ev.Message)
-					return true
-				},
+// resultFiles returns the files on the instance the results of the task are
+// written to, through the host volume mounted on the results directory
+func resultFiles(def *ecs.RegisterTaskDefinitionInput, streamPrefix string) []string {
+	var hostDir string
+	for _, mount := range def.ContainerDefinitions[0].MountPoints {
+		if path.Clean(aws.StringValue(mount.ContainerPath)) != resultsDir {
+			continue
+		}
+		for _, volume := range def.Volumes {
+			if aws.StringValue(volume.Name) == aws.StringValue(mount.SourceVolume) && volume.Host != nil {
+				hostDir = aws.StringValue(volume.Host.SourcePath)
 			}
+		}
+	}
+	if hostDir == "" {
+		return nil
+	}
 
-			go func() {
-				if err := watcher.Watch(ctx); err != nil {
-					log.Logger.Tracef("log watcher returned error: %v", err)
-				}
-			}()
+	var files []string
+	for _, format := range resultFileFormats {
+		files = append(files, path.Join(hostDir, fmt.Sprintf(format, streamPrefix)))
+	}
+	return files
+}
+
+// runTask starts the task, on the pinned container instance when there is one
+func (r *Runner) runTask(ctx context.Context, svc *ecs.ECS, taskDefinition string) ([]*ecs.Task, error) {
+	overrides := &ecs.TaskOverride{
+		ContainerOverrides: []*ecs.ContainerOverride{},
+	}
+
+	var tasks []*ecs.Task
+	var failures []*ecs.Failure
+	if r.ContainerInstance == "" {
+		r.logger().Infof("running task %s", taskDefinition)
+		var runResp *ecs.RunTaskOutput
+		err := callAWS(ctx, "ecs RunTask", func(ctx context.Context) (err error) {
+			runResp, err = svc.RunTaskWithContext(ctx, &ecs.RunTaskInput{
+				TaskDefinition: aws.String(taskDefinition),
+				Cluster:        aws.String(r.Cluster),
+				Count:          aws.Int64(1),
+				Overrides:      overrides,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to run task: %s", err.Error())
+		}
+		tasks, failures = runResp.Tasks, runResp.Failures
+	} else {
+		r.logger().Infof("starting task %s on container instance %s", taskDefinition, r.ContainerInstance)
+		var startResp *ecs.StartTaskOutput
+		err := callAWS(ctx, "ecs StartTask", func(ctx context.Context) (err error) {
+			startResp, err = svc.StartTaskWithContext(ctx, &ecs.StartTaskInput{
+				TaskDefinition:     aws.String(taskDefinition),
+				Cluster:            aws.String(r.Cluster),
+				ContainerInstances: aws.StringSlice([]string{r.ContainerInstance}),
+				Overrides:          overrides,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to start task: %s", err.Error())
 		}
+		tasks, failures = startResp.Tasks, startResp.Failures
 	}
 
-	var taskARNs []*string
-	for _, task := range runResp.Tasks {
-		log.Logger.Infof("waiting until task has stopped")
-		taskARNs = append(taskARNs, task.TaskArn)
+	for _, failure := range failures {
+		r.logger().Errorf("task failed to start on %s: %s",
+			aws.StringValue(failure.Arn), aws.StringValue(failure.Reason))
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("unable to run task %s: no task was started", taskDefinition)
 	}
 
-	delay := time.Second * 10
-	ctx, cancelFn := context.WithTimeout(aws.BackgroundContext(), time.Duration(taskTimeout)*time.Minute)
-	defer cancelFn()
+	if r.ContainerInstance != "" {
+		for _, task := range tasks {
+			if aws.StringValue(task.ContainerInstanceArn) != r.ContainerInstance {
+				err := fmt.Errorf("task %s started on container instance %s instead of %s",
+					path.Base(*task.TaskArn), aws.StringValue(task.ContainerInstanceArn), r.ContainerInstance)
+				// the tasks would keep running on an instance netz doesn't manage
+				r.stopTasks(ctx, svc, tasks, "started on a container instance netz does not manage")
+				return nil, err
+			}
+		}
+	}
 
-	err = svc.WaitUntilTasksStoppedWithContext(
-		ctx,
-		&ecs.DescribeTasksInput{
-			Cluster: &r.Cluster,
-			Tasks:   taskARNs,
-		},
-		request.WithWaiterDelay(request.ConstantWaiterDelay(delay)),
-		request.WithWaiterMaxAttempts(0),
-	)
+	return tasks, nil
+}
+
+// stopTasks stops the tasks, the failures are only logged
+func (r *Runner) stopTasks(ctx context.Context, svc *ecs.ECS, tasks []*ecs.Task, reason string) {
+	for _, task := range tasks {
+		r.logger().Warnf("stopping task %s", path.Base(*task.TaskArn))
+		err := callAWS(ctx, "ecs StopTask", func(ctx context.Context) error {
+			_, err := svc.StopTaskWithContext(ctx, &ecs.StopTaskInput{
+				Cluster: aws.String(r.Cluster),
+				Task:    task.TaskArn,
+				Reason:  aws.String(reason),
+			})
+			return err
+		})
+		if err != nil {
+			r.logger().Errorf("failed to stop task %s: %s", path.Base(*task.TaskArn), err.Error())
+		}
+	}
+}
+
+// LogWatch is the log watchers of the containers of a task
+type LogWatch struct {
+	watchers []*logWatcher
+	wg       sync.WaitGroup
+}
+
+// Drain delivers the events that are still being ingested after the task
+// stopped and waits until every watcher is done
+func (w *LogWatch) Drain() {
+	for _, watcher := range w.watchers {
+		watcher.Finish()
+	}
+	w.wg.Wait()
+}
+
+// Stop stops the watchers without waiting for events still being ingested
+func (w *LogWatch) Stop() {
+	for _, watcher := range w.watchers {
+		watcher.Stop()
+		watcher.Finish()
+	}
+	w.wg.Wait()
+}
+
+// WatchLogs streams the logs of every container of the task in the
+// background, until the returned watch is drained or stopped
+func (r *Runner) WatchLogs(ctx context.Context, task *Task) *LogWatch {
+	cwl := cloudwatchlogs.New(r.session())
+
+	watch := &LogWatch{}
+	for _, container := range task.Containers {
+		stream := container.LogStream
+		watcher := &logWatcher{
+			LogGroupName:   task.LogGroupName,
+			LogStreamName:  container.LogStream,
+			CloudWatchLogs: cwl,
+			Logger:         r.opts.logger,
+			LiveTail:       r.LiveTail,
+
+			Printer: func(ev *cloudwatchlogs.FilteredLogEvent) bool {
+				if r.ContainerLog != nil {
+					if err := r.ContainerLog.Write(stream, ev); err != nil {
+						r.logger().Errorf("failed to write container log: %s", err.Error())
+					}
+				}
+				r.opts.containerLogger.Infof("%s", *ev.Message)
+				if r.OnLogEvent != nil {
+					r.OnLogEvent(newLoggedEvent(stream, ev))
+				}
+				return true
+			},
+		}
+
+		if r.ContainerLog != nil {
+			if pos := r.ContainerLog.position(stream); pos != nil {
+				watcher.resume(pos.last, pos.seen)
+			}
+		}
+
+		watch.watchers = append(watch.watchers, watcher)
+		watch.wg.Add(1)
+		go func() {
+			defer watch.wg.Done()
+			if err := watcher.Watch(ctx); err != nil {
+				r.logger().Tracef("log watcher returned error: %v", err)
+			}
+		}()
+	}
+	return watch
+}
+
+// WaitTask waits until the task has stopped or the timeout (in minutes)
+// expired, a zero timeout waits until the context is done. The status
+// transitions of the containers are logged as they are polled
+func (r *Runner) WaitTask(ctx context.Context, task *Task, taskTimeout int) error {
+	ctx = withLogger(ctx, r.logger())
+	config := r.Waiter
+	config.Timeout = time.Duration(taskTimeout) * time.Minute
+
+	svc := ecs.New(r.session())
+	statuses := make(map[string]string)
+	w := newWaiter("task to stop", config)
+	err := w.Wait(ctx, func(ctx context.Context) (bool, error) {
+		var result *ecs.DescribeTasksOutput
+		err := callAWS(ctx, "ecs DescribeTasks", func(ctx context.Context) (err error) {
+			result, err = svc.DescribeTasksWithContext(ctx, &ecs.DescribeTasksInput{
+				Cluster: aws.String(r.Cluster),
+				Tasks:   aws.StringSlice(task.TaskARNs),
+			})
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+		for _, failure := range result.Failures {
+			return false, fmt.Errorf("unable to describe task %s: %s",
+				aws.StringValue(failure.Arn), aws.StringValue(failure.Reason))
+		}
+
+		stopped := true
+		for _, t := range result.Tasks {
+			for _, container := range t.Containers {
+				logContainerStatus(r.logger(), statuses, container)
+			}
+			if aws.StringValue(t.LastStatus) != ecs.DesiredStatusStopped {
+				r.logger().Debugf("task %s is %s", path.Base(*t.TaskArn), aws.StringValue(t.LastStatus))
+				stopped = false
+				continue
+			}
+			if t.StoppedReason != nil {
+				r.logger().Infof("task %s stopped: %s", path.Base(*t.TaskArn), *t.StoppedReason)
+			}
+			recordStopped(task, t)
+		}
+		return stopped, nil
+	})
 
 	if err != nil {
 		return err
 	}
 
-	log.Logger.Info("task was stopped")
+	r.logger().Infof("task was stopped")
+	return nil
+}
+
+// recordStopped records when and how the ecs task stopped and the exit codes
+// of its containers
+func recordStopped(task *Task, t *ecs.Task) {
+	task.StoppedAt = aws.TimeValue(t.StoppedAt)
+	if task.StoppedAt.IsZero() {
+		task.StoppedAt = time.Now().UTC()
+	}
+	task.StoppedReason = aws.StringValue(t.StoppedReason)
+	for _, container := range t.Containers {
+		id := path.Base(aws.StringValue(container.ContainerArn))
+		for i := range task.Containers {
+			if task.Containers[i].ID != id {
+				continue
+			}
+			task.Containers[i].ExitCode = container.ExitCode
+			task.Containers[i].Reason = aws.StringValue(container.Reason)
+		}
+	}
+}
+
+// logContainerStatus logs the status of the container when it changed since
+// it was last seen
+func logContainerStatus(logger Logger, statuses map[string]string, container *ecs.Container) {
+	arn := aws.StringValue(container.ContainerArn)
+	status := aws.StringValue(container.LastStatus)
+	if statuses[arn] == status {
+		return
+	}
+	statuses[arn] = status
+
+	name := aws.StringValue(container.Name)
+	if status != ecs.DesiredStatusStopped {
+		logger.Infof("container %s (%s) is %s", name, path.Base(arn), status)
+		return
+	}
+
+	msg := fmt.Sprintf("container %s (%s) exited", name, path.Base(arn))
+	if container.ExitCode != nil {
+		msg = fmt.Sprintf("%s with code %d", msg, *container.ExitCode)
+	}
+	if container.Reason != nil {
+		msg = fmt.Sprintf("%s: %s", msg, *container.Reason)
+	}
+	if aws.Int64Value(container.ExitCode) != 0 || container.Reason != nil {
+		logger.Warnf("%s", msg)
+		return
+	}
+	logger.Infof("%s", msg)
+}
+
+// DeleteLogStreams deletes the log streams of the containers of the tasks
+func (r *Runner) DeleteLogStreams(ctx context.Context, tasks ...*Task) error {
+	ctx = withLogger(ctx, r.logger())
+	cwl := cloudwatchlogs.New(r.session())
+
+	var failed int
+	for _, task := range tasks {
+		for _, container := range task.Containers {
+			r.logger().Infof("deleting log stream %s", container.LogStream)
+			if err := deleteLogStream(ctx, cwl, task.LogGroupName, container.LogStream); err != nil {
+				r.logger().Errorf("failed to delete log stream %s: %s", container.LogStream, err.Error())
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("unable to delete %d log streams", failed)
+	}
 	return nil
 }
 
@@ -0,0 +1,208 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const stateFileExt = ".json"
+
+// Resources describes the cloud resources created for a run
+type Resources struct {
+	Region               string   `json:"region"`
+	Cluster              string   `json:"cluster,omitempty"`
+	InstanceID           string   `json:"instance_id,omitempty"`
+	ContainerInstanceARN string   `json:"container_instance_arn,omitempty"`
+	InstanceType         string   `json:"instance_type,omitempty"`
+	SubnetID             string   `json:"subnet_id,omitempty"`
+	AvailabilityZone     string   `json:"availability_zone,omitempty"`
+	NetworkInterfaces    []string `json:"network_interfaces,omitempty"`
+	AllocationAddresses  []string `json:"allocation_addresses,omitempty"`
+	IPv6Addresses        []string `json:"ipv6_addresses,omitempty"`
+	// RolePolicy is the checkpoint policy of the run on the role of RoleName,
+	// the runs share the role
+	RoleName   string `json:"role_name,omitempty"`
+	RolePolicy string `json:"role_policy,omitempty"`
+}
+
+// Empty reports whether there's nothing left to destroy
+func (r Resources) Empty() bool {
+	return r.InstanceID == "" && r.Cluster == "" && len(r.NetworkInterfaces) == 0 && len(r.AllocationAddresses) == 0 && r.RolePolicy == ""
+}
+
+// TaskContainer describes a container of a started task and its log stream,
+// the exit code is set once the container stopped
+type TaskContainer struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	LogStream string `json:"log_stream"`
+	ExitCode  *int64 `json:"exit_code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Task describes a task started by the runner
+type Task struct {
+	TaskDefinition string          `json:"task_definition"`
+	StreamPrefix   string          `json:"stream_prefix"`
+	LogGroupName   string          `json:"log_group"`
+	TaskARNs       []string        `json:"task_arns"`
+	Containers     []TaskContainer `json:"containers"`
+	// ResultFiles are the files the task writes its results to, on the
+	// instance it ran on
+	ResultFiles   []string  `json:"result_files,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	StoppedAt     time.Time `json:"stopped_at,omitempty"`
+	StoppedReason string    `json:"stopped_reason,omitempty"`
+}
+
+// Succeeded reports whether every container of the task exited with 0
+func (t *Task) Succeeded() bool {
+	if len(t.Containers) == 0 {
+		return false
+	}
+	for _, container := range t.Containers {
+		if container.ExitCode == nil || *container.ExitCode != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RunState is persisted between netz invocations so that resources created
+// by `netz up` can be used by `netz run`, `netz logs` and `netz down`
+type RunState struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	SkipDestroy bool      `json:"skip_destroy"`
+	// LogGroupName has the audit stream of the run
+	LogGroupName string `json:"log_group,omitempty"`
+	// CheckpointURL is where the scan container checkpoints the scans of the
+	// run, the role of its instance can only reach that S3 location
+	CheckpointURL string    `json:"checkpoint_url,omitempty"`
+	Resources     Resources `json:"resources"`
+	Tasks         []*Task   `json:"tasks,omitempty"`
+}
+
+// NewRunState returns a state with a fresh run id, the random suffix keeps
+// the runs started in the same second apart
+func NewRunState() *RunState {
+	now := time.Now().UTC()
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return &RunState{
+		ID:        fmt.Sprintf("netz-%s-%x", now.Format("20060102-150405"), suffix),
+		CreatedAt: now,
+	}
+}
+
+// LastTask returns the most recently started task of the run
+func (s *RunState) LastTask() (*Task, error) {
+	if len(s.Tasks) == 0 {
+		return nil, fmt.Errorf("run %s has no tasks", s.ID)
+	}
+	return s.Tasks[len(s.Tasks)-1], nil
+}
+
+// StateStore keeps run states as JSON files in a directory
+type StateStore struct {
+	Dir string
+}
+
+// DefaultStateDir returns ~/.netz/runs, or a relative directory when the
+// home directory can't be resolved
+func DefaultStateDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".netz", "runs")
+	}
+	return filepath.Join(home, ".netz", "runs")
+}
+
+func (s *StateStore) path(id string) string {
+	return filepath.Join(s.Dir, id+stateFileExt)
+}
+
+// Save writes the run state, replacing any previous version atomically
+func (s *StateStore) Save(state *RunState) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path(state.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(state.ID))
+}
+
+// Load reads the run state with the given id
+func (s *StateStore) Load(id string) (*RunState, error) {
+	body, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("run %s not found in %s", id, s.Dir)
+		}
+		return nil, err
+	}
+
+	var state RunState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("unable to parse state of run %s: %s", id, err.Error())
+	}
+	return &state, nil
+}
+
+// Latest reads the most recently created run state
+func (s *StateStore) Latest() (*RunState, error) {
+	ids, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no runs found, create one with `netz up`")
+	}
+	return s.Load(ids[len(ids)-1])
+}
+
+// List returns the ids of all stored runs, oldest first
+func (s *StateStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ids []string
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), stateFileExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(f.Name(), stateFileExt))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Remove deletes the run state with the given id
+func (s *StateStore) Remove(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultWaitTimeout  = time.Minute * 10
+	defaultWaitMinDelay = time.Second
+	defaultWaitMaxDelay = time.Second * 30
+)
+
+// ErrWaitTimeout is returned when a waiter gives up before its condition is met
+var ErrWaitTimeout = errors.New("timed out")
+
+// WaiterConfig controls how long and how often a waiter polls
+type WaiterConfig struct {
+	// Timeout is the total time to wait, zero waits until the context is done
+	Timeout time.Duration
+	// MinDelay is the delay after the first attempt, it doubles after every
+	// attempt up to MaxDelay
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxErrors is how many consecutive errors of the condition are retried
+	// before the last one is reported, zero reports the first error
+	MaxErrors int
+}
+
+// DefaultWaiterConfig returns the config used for cloud resources waiters
+func DefaultWaiterConfig() WaiterConfig {
+	return WaiterConfig{
+		Timeout:  defaultWaitTimeout,
+		MinDelay: defaultWaitMinDelay,
+		MaxDelay: defaultWaitMaxDelay,
+	}
+}
+
+// waitCondition reports whether the waited for state was reached, an error
+// stops the waiter
+type waitCondition func(ctx context.Context) (bool, error)
+
+// waiter polls a condition with exponential backoff and jitter until it is
+// met, the timeout expired or the context is done
+type waiter struct {
+	WaiterConfig
+
+	// Name describes what is waited for in log messages and errors
+	Name string
+}
+
+func newWaiter(name string, config WaiterConfig) *waiter {
+	return &waiter{WaiterConfig: config, Name: name}
+}
+
+func (w *waiter) Wait(ctx context.Context, condition waitCondition) error {
+	if w.Timeout > 0 {
+		var cancelFn context.CancelFunc
+		ctx, cancelFn = context.WithTimeout(ctx, w.Timeout)
+		defer cancelFn()
+	}
+
+	minDelay := w.MinDelay
+	if minDelay <= 0 {
+		minDelay = defaultWaitMinDelay
+	}
+	maxDelay := w.MaxDelay
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+
+	logger := loggerFrom(ctx)
+	logger.Infof("waiting for %s..", w.Name)
+	start := time.Now()
+	delay := minDelay
+	errorsInRow := 0
+
+	for {
+		done, err := condition(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return w.contextError(ctx, start)
+			}
+			errorsInRow++
+			if errorsInRow > w.MaxErrors {
+				return fmt.Errorf("waiting for %s: %w", w.Name, err)
+			}
+			logger.Debugf("error %d/%d while waiting for %s, retrying: %s", errorsInRow, w.MaxErrors, w.Name, err.Error())
+		} else {
+			errorsInRow = 0
+		}
+		if done {
+			logger.Infof("done waiting for %s after %v", w.Name, time.Since(start).Round(time.Second))
+			return nil
+		}
+
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return w.contextError(ctx, start)
+		}
+		logger.Debugf("still waiting for %s (%v)...", w.Name, time.Since(start).Round(time.Second))
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+func (w *waiter) contextError(ctx context.Context, start time.Time) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w waiting for %s after %v", ErrWaitTimeout, w.Name, time.Since(start).Round(time.Second))
+	}
+	return ctx.Err()
+}
+
+// jitter returns a random duration between half of delay and delay
+func jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
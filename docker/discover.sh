@@ -1,5 +1,16 @@
 #!/bin/sh
-go run /opt/massconfigure.go > /opt/masscan.conf
+# IPv6 space can't be brute forced, its targets come from a hitlist
+if [ -n "$HITLIST_URL" ]; then
+    curl -sSfL "$HITLIST_URL" -o /opt/hitlist || exit 1
+    case "$HITLIST_URL" in
+        *.xz) xz -dc /opt/hitlist > /opt/hitlist.txt ;;
+        *) mv /opt/hitlist /opt/hitlist.txt ;;
+    esac
+    HITLIST_FILE=${HITLIST_FILE:+$HITLIST_FILE,}/opt/hitlist.txt
+    export HITLIST_FILE
+fi
+
+massconfigure -adapters-json /opt/out/adapters-$TASK_DEFINITION.json > /opt/masscan.conf || exit 1
 
 envsubst < zgrab2-template.ini > zgrab2.ini
 
@@ -20,10 +31,57 @@ sleep 5
 
 OUT=/opt/out/masscan-$TASK_DEFINITION.out
 
-masscan -p$PORT_TO_SCAN $SUBNET_TO_SCAN --exclude 255.255.255.255 --rate 10000000 -c /opt/masscan.conf | tee $OUT 2>&1
+# SCANNER picks the port scanner, masscan, zmap or native, masscan when it's
+# not set. PROBER probes the open ports while the scan runs, with zgrab2 or the
+# http prober of massconfigure. CHECKPOINT_URL and RUN_ID, set by netz,
+# checkpoint the scan so `netz run --resume` continues it, CHECKPOINT_RESUME
+# is the id of the run whose scan is continued. They're passed to
+# massconfigure only here so writing the config above never runs a scan
+scan() {
+    set -- -scanner "${SCANNER:-masscan}" -config /opt/masscan.conf
+    if [ -n "$PROBER" ]; then
+        set -- "$@" -prober "$PROBER" -probe-output /opt/probe.json
+    fi
+    if [ -n "$CHECKPOINT_URL" ]; then
+        set -- "$@" -checkpoint "$CHECKPOINT_URL" -run-id "$RUN_ID"
+    fi
+    if [ -n "$CHECKPOINT_RESUME" ]; then
+        set -- "$@" -resume "$CHECKPOINT_RESUME"
+    fi
+    massconfigure "$@"
+}
+
+# the scan runs in the background so stopping the task reaches massconfigure,
+# which saves the checkpoint before the task is killed. Its output goes to the
+# file and is followed separately, so $! is the scan and its status is kept
+scan > $OUT &
+SCAN_PID=$!
+tail -n +1 -f --pid=$SCAN_PID $OUT &
+TAIL_PID=$!
+trap 'STOPPED=1; pkill -TERM -x massconfigure' TERM INT
+wait $SCAN_PID
+STATUS=$?
+if [ -n "$STOPPED" ]; then
+    wait $SCAN_PID
+    wait $TAIL_PID
+    exit 1
+fi
+wait $TAIL_PID
+if [ $STATUS -ne 0 ]; then
+    echo "scan failed with status $STATUS"
+    exit $STATUS
+fi
+
+if [ -n "$PROBER" ]; then
+    echo zgrab2 ips:
+    echo
+    jq -r '. | select(.data.http.result.response.body != null) | select(.data.http.status == "success") | .ip' /opt/probe.json | tee /opt/out/zgrab2-$TASK_DEFINITION.out
+    exit
+fi
+
 echo masscan ips:
 echo
-cat $OUT | awk '{print $6}'
+cat $OUT | awk '{print $6}' | tr -d '[]'
 echo zgrab2 ips:
 echo
-cat $OUT | awk '{print $6}' | zgrab2 multiple -c zgrab2.ini | jq -r '. | select(.data.http.result.response.body != null) | select(.data.http.status == "success") | .ip' | tee /opt/out/zgrab2-$TASK_DEFINITION.out
+cat $OUT | awk '{print $6}' | tr -d '[]' | zgrab2 multiple -c zgrab2.ini | jq -r '. | select(.data.http.result.response.body != null) | select(.data.http.status == "success") | .ip' | tee /opt/out/zgrab2-$TASK_DEFINITION.out
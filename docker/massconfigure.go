@@ -1,88 +1,438 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"net"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cmpxchg16/netz/agent"
+	"github.com/cmpxchg16/netz/masscan"
+	"github.com/cmpxchg16/netz/massconfigure"
 )
 
 const (
-	f_IPAddr int = iota
-	f_HWType
-	f_Flags
-	f_HWAddr
-	f_Mask
-	f_Device
+	zcAuto = "auto"
+	zcOff  = "off"
 )
 
-func getRouterARP() string {
-	f, err := os.Open("/proc/net/arp")
+// scanFlags are the masscan options, their defaults come from the
+// environment of the task definition
+type scanFlags struct {
+	rate           *string
+	ports          *string
+	ranges         *string
+	hitlists       *string
+	excludes       *string
+	excludeFile    *string
+	outputFormat   *string
+	outputFilename *string
+	seed           *string
+	shard          *string
+	retries        *string
+}
+
+func newScanFlags() scanFlags {
+	return scanFlags{
+		rate:           flag.String("rate", envOr("MASSCAN_RATE", strconv.Itoa(masscan.DefaultRate)), "packets per second"),
+		ports:          flag.String("ports", os.Getenv("PORT_TO_SCAN"), "ports to scan, e.g. 80,443,8000-8100"),
+		ranges:         flag.String("range", os.Getenv("SUBNET_TO_SCAN"), "comma separated ranges to scan"),
+		hitlists:       flag.String("hitlist", os.Getenv("HITLIST_FILE"), "comma separated files of targets, such as IPv6 hitlists"),
+		excludes:       flag.String("exclude-range", envOr("MASSCAN_EXCLUDE", masscan.DefaultExclude), "comma separated ranges to leave out"),
+		excludeFile:    flag.String("exclude-file", os.Getenv("MASSCAN_EXCLUDE_FILE"), "file of ranges to leave out"),
+		outputFormat:   flag.String("output-format", os.Getenv("MASSCAN_OUTPUT_FORMAT"), "format of the output file"),
+		outputFilename: flag.String("output-filename", os.Getenv("MASSCAN_OUTPUT_FILENAME"), "file to write the results to"),
+		seed:           flag.String("seed", os.Getenv("MASSCAN_SEED"), "seed of the scan order, the same for every shard"),
+		shard:          flag.String("shard", os.Getenv("MASSCAN_SHARD"), "shard of the scan, id/total"),
+		retries:        flag.String("retries", os.Getenv("MASSCAN_RETRIES"), "retries of every probe"),
+	}
+}
+
+// probeFlags stream the open ports of the scan to a prober
+type probeFlags struct {
+	prober          *string
+	output          *string
+	queue           *string
+	workers         *string
+	zgrab2Config    *string
+	endpoint        *string
+	metricsInterval *string
+}
 
+func newProbeFlags() probeFlags {
+	return probeFlags{
+		prober:          flag.String("prober", "", "probe the open ports with zgrab2 or http while the scan runs"),
+		output:          flag.String("probe-output", "", "file the results of the prober are written to, as JSON lines"),
+		queue:           flag.String("probe-queue", envOr("PROBE_QUEUE", strconv.Itoa(agent.DefaultQueueSize)), "open ports waiting for the prober, the scan waits when it's full"),
+		workers:         flag.String("probe-workers", os.Getenv("PROBE_WORKERS"), "ports the http prober probes at once"),
+		zgrab2Config:    flag.String("zgrab2-config", "zgrab2.ini", "ini of the zgrab2 modules"),
+		endpoint:        flag.String("endpoint", os.Getenv("ZGRAB2_ENDPOINT"), "path the http prober requests"),
+		metricsInterval: flag.String("metrics-interval", envOr("PROBE_METRICS_INTERVAL", "10s"), "how often the back-pressure metrics are printed"),
+	}
+}
+
+// pipeline returns the pipeline of the flags around the scanner
+func (f probeFlags) pipeline(scanner agent.PortScanner) (*agent.Pipeline, error) {
+	prober, err := agent.NewProber(*f.prober)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	switch p := prober.(type) {
+	case *agent.ZGrab2:
+		p.ConfigPath = *f.zgrab2Config
+		p.Stderr = os.Stderr
+	case *agent.HTTPProber:
+		p.Endpoint = *f.endpoint
+		if *f.workers != "" {
+			if p.Workers, err = strconv.Atoi(*f.workers); err != nil {
+				return nil, fmt.Errorf("invalid probe-workers %q", *f.workers)
+			}
+		}
 	}
 
-	defer f.Close()
+	pipeline := &agent.Pipeline{Scanner: scanner, Prober: prober, Metrics: os.Stderr}
+	if pipeline.QueueSize, err = strconv.Atoi(*f.queue); err != nil || pipeline.QueueSize < 1 {
+		return nil, fmt.Errorf("invalid probe-queue %q", *f.queue)
+	}
+	if pipeline.MetricsInterval, err = time.ParseDuration(*f.metricsInterval); err != nil || pipeline.MetricsInterval <= 0 {
+		return nil, fmt.Errorf("invalid metrics-interval %q", *f.metricsInterval)
+	}
+	return pipeline, nil
+}
 
-	s := bufio.NewScanner(f)
-	s.Scan() // skip the field descriptions
-	arp := ""
-	for s.Scan() {
-		line := s.Text()
-		fields := strings.Fields(line)
-		arp = fields[f_HWAddr]
+// checkpointFlags save the progress of the scan so an interrupted scan
+// resumes where it stopped
+type checkpointFlags struct {
+	location *string
+	runID    *string
+	resume   *string
+	interval *string
+}
+
+func newCheckpointFlags() checkpointFlags {
+	return checkpointFlags{
+		location: flag.String("checkpoint", "", "s3://bucket/prefix or directory the scan is checkpointed to, under the run id"),
+		runID:    flag.String("run-id", "", "id of the netz run the scan belongs to"),
+		resume:   flag.String("resume", "", "id of the run whose checkpointed scan is resumed instead of starting a new one, the run itself or a previous one"),
+		interval: flag.String("checkpoint-interval", envOr("CHECKPOINT_INTERVAL", "1m"), "how often the open ports and probe results are checkpointed"),
 	}
+}
 
-	return arp
+// checkpointer returns the checkpointer of the flags, nil without a location
+func (f checkpointFlags) checkpointer() (*agent.Checkpointer, error) {
+	if *f.location == "" {
+		if *f.resume != "" {
+			return nil, errors.New("resume needs a checkpoint location")
+		}
+		return nil, nil
+	}
+	if *f.runID == "" {
+		return nil, errors.New("run-id is required to checkpoint the scan")
+	}
+	// a resumed scan stays checkpointed under the run it started in
+	runID := *f.runID
+	if *f.resume != "" {
+		runID = *f.resume
+	}
+	store, err := agent.NewRunCheckpointStore(*f.location, runID)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := time.ParseDuration(*f.interval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid checkpoint-interval %q", *f.interval)
+	}
+	return &agent.Checkpointer{
+		Store:    store,
+		RunID:    runID,
+		Resume:   *f.resume != "",
+		Interval: interval,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, "checkpoint: "+format+"\n", args...)
+		},
+	}, nil
 }
 
-const MASSCAN_CONF = `adapter[%s] = %s
-router-mac[%s] = %s
-adapter-ip[%s] = %s
-adapter-mac[%s] = %s
-`
+// apply sets the flags on the config, only those in set when it isn't nil
+func (f scanFlags) apply(conf *masscan.Config, set map[string]bool) error {
+	apply := func(name string, value string, fn func(string) error) error {
+		if set != nil && !set[name] {
+			return nil
+		}
+		if err := fn(value); err != nil {
+			return fmt.Errorf("invalid %s %q: %s", name, value, err.Error())
+		}
+		return nil
+	}
+	list := func(value string) []string {
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	}
 
-func main() {
-	conf := ""
-	routerMAC := getRouterARP()
-	interfaces, _ := net.Interfaces()
-	currentIP := ""
-	var macAddress net.HardwareAddr
-	adapterName := ""
-	index := 0
-
-	for _, interf := range interfaces {
-		found := false
-		if addrs, err := interf.Addrs(); err == nil {
-			for _, addr := range addrs {
-				if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-					if ipnet.IP.To4() != nil {
-						currentIP = ipnet.IP.String()
-					}
-				}
-
-				netInterface, err := net.InterfaceByName(interf.Name)
-
-				if err != nil {
-					fmt.Println(err)
-				}
-
-				adapterName = netInterface.Name
-				if currentIP != "" && (strings.HasPrefix(adapterName, "eth") || strings.HasPrefix(adapterName, "ens")) {
-					found = true
-				}
-				macAddress = netInterface.HardwareAddr
+	return firstError(
+		apply("rate", *f.rate, func(v string) (err error) {
+			conf.Rate, err = strconv.Atoi(v)
+			return err
+		}),
+		apply("ports", *f.ports, func(v string) error {
+			conf.Ports = v
+			return nil
+		}),
+		apply("range", *f.ranges, func(v string) error {
+			conf.Ranges = list(v)
+			return nil
+		}),
+		apply("hitlist", *f.hitlists, func(v string) error {
+			conf.IncludeFiles = list(v)
+			return nil
+		}),
+		apply("exclude-range", *f.excludes, func(v string) error {
+			conf.Excludes = list(v)
+			return nil
+		}),
+		apply("exclude-file", *f.excludeFile, func(v string) error {
+			conf.ExcludeFile = v
+			return nil
+		}),
+		apply("output-format", *f.outputFormat, func(v string) error {
+			conf.OutputFormat = v
+			return nil
+		}),
+		apply("output-filename", *f.outputFilename, func(v string) error {
+			conf.OutputFilename = v
+			return nil
+		}),
+		apply("seed", *f.seed, func(v string) (err error) {
+			if v == "" {
+				conf.Seed = 0
+				return nil
 			}
-			if found {
-				indexStr := strconv.Itoa(index)
-				conf += fmt.Sprintf(MASSCAN_CONF, indexStr, adapterName, indexStr, routerMAC, indexStr, currentIP, indexStr, macAddress)
-				index++
+			conf.Seed, err = strconv.ParseInt(v, 10, 64)
+			return err
+		}),
+		apply("shard", *f.shard, func(v string) error {
+			if v == "" {
+				conf.Shard = nil
+				return nil
+			}
+			shard, err := masscan.ParseShard(v)
+			conf.Shard = &shard
+			return err
+		}),
+		apply("retries", *f.retries, func(v string) (err error) {
+			if v == "" {
+				conf.Retries = 0
+				return nil
+			}
+			conf.Retries, err = strconv.Atoi(v)
+			return err
+		}),
+	)
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// masscanConfig returns the masscan config of the flags and the profile, the
+// flags given on the command line override the profile which overrides the
+// environment
+func masscanConfig(f scanFlags, profile string) (*masscan.Config, error) {
+	conf := masscan.NewConfig()
+	if err := f.apply(conf, nil); err != nil {
+		return nil, err
+	}
+	if profile == "" {
+		return conf, nil
+	}
+
+	body, err := ioutil.ReadFile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, conf); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %s", profile, err.Error())
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	if err := f.apply(conf, set); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func compile(name string, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s regex: %s", name, err.Error())
+	}
+	return re, nil
+}
+
+func run() error {
+	include := flag.String("include", envOr("MASSCAN_INCLUDE_INTERFACES", massconfigure.DefaultInclude), "regex of the interfaces to use")
+	exclude := flag.String("exclude", os.Getenv("MASSCAN_EXCLUDE_INTERFACES"), "regex of the interfaces to leave out")
+	management := flag.String("management", os.Getenv("MANAGEMENT_INTERFACE"), "interface kept for management (SSH), it's never used")
+	zc := flag.String("zc", envOr("PF_RING_ZC", zcAuto), "auto opens the adapters bound to a PF_RING ZC driver with zc:, off never does")
+	adaptersJSON := flag.String("adapters-json", "", "write the chosen adapters as JSON to the file, - for stdout instead of the config")
+	profile := flag.String("profile", os.Getenv("MASSCAN_PROFILE"), "JSON file of the masscan config, the flags override it")
+	scanner := flag.String("scanner", "", "run the scan with masscan, zmap or native instead of writing the masscan config, masscan when a prober is set")
+	configPath := flag.String("config", "", "file the masscan config is written to when running the scan with masscan")
+	scan := newScanFlags()
+	probe := newProbeFlags()
+	checkpoint := newCheckpointFlags()
+	flag.Parse()
+
+	conf, err := masscanConfig(scan, *profile)
+	if err != nil {
+		return err
+	}
+
+	opts := massconfigure.DefaultOptions()
+	if opts.Include, err = compile("include", *include); err != nil {
+		return err
+	}
+	if opts.Exclude, err = compile("exclude", *exclude); err != nil {
+		return err
+	}
+	opts.Management = *management
+	if *zc != zcAuto && *zc != zcOff {
+		return fmt.Errorf("invalid zc %q, must be %s or %s", *zc, zcAuto, zcOff)
+	}
+	opts.ZC = *zc == zcAuto
+
+	report, err := massconfigure.Discover(massconfigure.SystemSources(), opts)
+	if err != nil {
+		return err
+	}
+	for _, warning := range report.Warnings {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+	}
+
+	if *adaptersJSON == "-" {
+		return json.NewEncoder(os.Stdout).Encode(report.Adapters)
+	}
+	if *adaptersJSON != "" {
+		body, err := json.MarshalIndent(report.Adapters, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*adaptersJSON, append(body, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	// the adapters of a profile are kept when no interface matched
+	if len(report.Adapters) > 0 || len(conf.Adapters) == 0 {
+		conf.Adapters = massconfigure.MasscanAdapters(report.Adapters)
+	}
+	if *scanner != "" || *probe.prober != "" || *checkpoint.location != "" {
+		return runScan(orDefault(*scanner, "masscan"), *configPath, probe, checkpoint, agent.SpecFromConfig(conf))
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	_, err = conf.WriteTo(os.Stdout)
+	return err
+}
+
+// runScan runs the scan with the backend and prints the open ports the way
+// masscan does, until the scan is done or interrupted. With a prober the open
+// ports are probed while the scan runs, with a checkpoint location the scan
+// is checkpointed and the results of the previous attempts come first
+func runScan(name string, configPath string, probe probeFlags, checkpoint checkpointFlags, spec agent.Spec) error {
+	scanner, err := agent.NewPortScanner(name)
+	if err != nil {
+		return err
+	}
+	checkpointer, err := checkpoint.checkpointer()
+	if err != nil {
+		return err
+	}
+	switch s := scanner.(type) {
+	case *agent.Masscan:
+		s.ConfigPath = configPath
+		s.Stderr = os.Stderr
+		if checkpointer != nil {
+			// masscan writes paused.conf where it runs
+			if s.Dir, err = ioutil.TempDir("", "masscan"); err != nil {
+				return err
 			}
+			defer os.RemoveAll(s.Dir)
+		}
+	case *agent.ZMap:
+		s.Stderr = os.Stderr
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	open := func(port agent.OpenPort) {
+		fmt.Printf("Discovered open port %d/%s on %s\n", port.Port, port.Proto, port.IP)
+	}
+
+	var pipeline *agent.Pipeline
+	result := func(agent.ProbeResult) {}
+	if *probe.prober != "" {
+		if pipeline, err = probe.pipeline(scanner); err != nil {
+			return err
+		}
+		if *probe.output == "" {
+			return fmt.Errorf("probe-output is required with the %s prober", *probe.prober)
+		}
+		out, err := os.Create(*probe.output)
+		if err != nil {
+			return err
 		}
+		defer out.Close()
+		result = func(r agent.ProbeResult) {
+			out.Write(append(r.Raw, '\n'))
+		}
+	}
+
+	switch {
+	case checkpointer != nil:
+		return checkpointer.Run(ctx, scanner, pipeline, spec, open, result)
+	case pipeline != nil:
+		return pipeline.Run(ctx, spec, open, result)
+	}
+	return scanner.Scan(ctx, spec, open)
+}
+
+func orDefault(value string, def string) string {
+	if value == "" {
+		return def
 	}
+	return value
+}
+
+func envOr(key string, value string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return value
+}
 
-	fmt.Println(conf)
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -1,14 +1,26 @@
 module github.com/cmpxchg16/netz
 
-go 1.14
+go 1.19
 
 require (
-	github.com/aws/aws-sdk-go v1.30.14
+	github.com/aws/aws-sdk-go v1.55.8
+	github.com/sirupsen/logrus v1.5.0
+	github.com/urfave/cli/v2 v2.2.0
+	github.com/x-cray/logrus-prefixed-formatter v0.5.2
+	golang.org/x/sys v0.0.0-20210112080510-489259a85091
+)
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
 	github.com/mattn/go-colorable v0.1.6 // indirect
+	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
 	github.com/onsi/ginkgo v1.15.0 // indirect
 	github.com/onsi/gomega v1.10.5 // indirect
-	github.com/sirupsen/logrus v1.5.0
-	github.com/urfave/cli/v2 v2.2.0
-	github.com/x-cray/logrus-prefixed-formatter v0.5.2
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/stretchr/testify v1.5.1 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
 )
@@ -1,27 +1,158 @@
 package log
 
 import (
+	"fmt"
 	"os"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
 var Logger *logrus.Logger
 
-func SetLogger(debug bool) {
-	level := logrus.InfoLevel
-	if debug {
-		level = logrus.DebugLevel
+// Container prints the output of the remote containers, it's kept apart from
+// Logger so that the orchestration log file only has netz's own messages
+var Container *logrus.Logger
+
+var (
+	format = FormatText
+	fields = &fieldsHook{fields: logrus.Fields{}}
+)
+
+// the loggers are usable before SetLogger is called
+func init() {
+	Logger = newLogger(logrus.InfoLevel)
+	Container = newLogger(logrus.InfoLevel)
+}
+
+// SetLogger replaces the loggers with ones of the given level ("trace",
+// "debug", "info", "warn" or "error") and format ("text" or "json")
+func SetLogger(levelName string, formatName string) error {
+	level, err := logrus.ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	if formatName != FormatText && formatName != FormatJSON {
+		return fmt.Errorf("unknown log format %q, must be %s or %s", formatName, FormatText, FormatJSON)
+	}
+
+	format = formatName
+	Logger = newLogger(level)
+	Container = newLogger(level)
+	return nil
+}
+
+func newLogger(level logrus.Level) *logrus.Logger {
+	logger := &logrus.Logger{
+		Out:       os.Stderr,
+		Level:     level,
+		Hooks:     make(logrus.LevelHooks),
+		Formatter: newFormatter(true),
+	}
+	// the common fields are added before any other hook sees the entry
+	logger.AddHook(fields)
+	return logger
+}
+
+func newFormatter(terminal bool) logrus.Formatter {
+	if format == FormatJSON {
+		return &logrus.JSONFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+		}
+	}
+	if !terminal {
+		return &logrus.TextFormatter{
+			TimestampFormat:  "2006-01-02T15:04:05.000Z07:00",
+			FullTimestamp:    true,
+			DisableColors:    true,
+			QuoteEmptyFields: true,
+		}
+	}
+	return &prefixed.TextFormatter{
+		TimestampFormat: "2006-01-02 15:04:05",
+		FullTimestamp:   true,
+		ForceFormatting: true,
+	}
+}
+
+// Component returns a child logger of Logger for a component of netz, its
+// messages have the component as a field
+func Component(name string) *logrus.Entry {
+	return Logger.WithField("component", name)
+}
+
+// SetField adds the field to every message of Logger and Container, such as
+// the id of the run
+func SetField(key string, value interface{}) {
+	fields.set(key, value)
+}
+
+type fieldsHook struct {
+	mu     sync.RWMutex
+	fields logrus.Fields
+}
+
+func (h *fieldsHook) set(key string, value interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fields[key] = value
+}
+
+func (h *fieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fieldsHook) Fire(entry *logrus.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for key, value := range h.fields {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
 	}
+	return nil
+}
+
+// AddFile appends every message of Logger to the file as well, in the log
+// format without colors
+func AddFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	Logger.AddHook(&fileHook{
+		file:      f,
+		formatter: newFormatter(false),
+	})
+	return nil
+}
 
-	Logger = &logrus.Logger{
-		Out:   os.Stderr,
-		Level: level,
-		Formatter: &prefixed.TextFormatter{
-			TimestampFormat: "2006-01-02 15:04:05",
-			FullTimestamp:   true,
-			ForceFormatting: true,
-		},
+type fileHook struct {
+	mu        sync.Mutex
+	file      *os.File
+	formatter logrus.Formatter
+}
+
+func (h *fileHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fileHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
 	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err = h.file.Write(line)
+	return err
 }
@@ -2,12 +2,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/cmpxchg16/netz/agent"
 	"github.com/cmpxchg16/netz/cloud"
 	log "github.com/cmpxchg16/netz/logger"
+	"github.com/cmpxchg16/netz/masscan"
+	"github.com/cmpxchg16/netz/massconfigure"
+	"github.com/cmpxchg16/netz/scan"
 
 	"github.com/urfave/cli/v2"
 )
@@ -17,152 +28,935 @@ var (
 	resourceManager *cloud.AWSResourceManager
 )
 
+var resourceFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "cluster, c",
+		Value: "netz",
+		Usage: "ECS cluster name",
+	},
+	&cli.StringSliceFlag{
+		Name:     "security-group",
+		Usage:    "Security groups to launch task. Can be specified multiple times",
+		Required: true,
+	},
+	&cli.StringSliceFlag{
+		Name:     "subnet",
+		Usage:    "Subnet to launch task. Can be specified multiple times with subnets in different availability zones, tried in order",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "region, r",
+		Usage:    "AWS Region",
+		Required: true,
+	},
+	&cli.IntFlag{
+		Name:     "number-of-nic, o",
+		Usage:    "Number of network interfaces to create and attach to instance.",
+		Required: true,
+	},
+	&cli.StringSliceFlag{
+		Name:     "instance-type, t",
+		Usage:    "Instance type. Can be specified multiple times or comma separated, tried in order when there is no capacity",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:     "instance-key-name, k",
+		Usage:    "Instance key name to for ssh.",
+		Required: true,
+	},
+	&cli.StringFlag{
+		Name:  "role-name, rn",
+		Value: "netzRole",
+		Usage: "Role name for netz.",
+	},
+	&cli.StringFlag{
+		Name:  "role-policy-name, rp",
+		Value: "netzPolicy",
+		Usage: "Role policy name for netz.",
+	},
+	&cli.StringFlag{
+		Name:  "instance-profile-name, i",
+		Value: "netzInstanceProfile",
+		Usage: "Instance profile name to attach to instance.",
+	},
+	&cli.BoolFlag{
+		Name:  "skip-destroy, sd",
+		Value: false,
+		Usage: "Skip destroy of cloud resources when done.",
+	},
+	&cli.DurationFlag{
+		Name:  "wait-timeout",
+		Value: cloud.DefaultWaiterConfig().Timeout,
+		Usage: "How long to wait for the instance to run and register with the ECS cluster.",
+	},
+	&cli.DurationFlag{
+		Name:  "wait-max-delay",
+		Value: cloud.DefaultWaiterConfig().MaxDelay,
+		Usage: "Maximum delay between polls while waiting for cloud resources.",
+	},
+	&cli.BoolFlag{
+		Name:  "ipv6",
+		Usage: "Assign an IPv6 address to the instance and every network interface, the subnets need an IPv6 CIDR block.",
+	},
+}
+
+// checkpointFlag is a flag of up as well, the role of the instance can only
+// reach the checkpoints of an S3 location it was created with
+var checkpointFlag = &cli.StringFlag{
+	Name:  "checkpoint",
+	Value: cloud.DefaultCheckpointLocation,
+	Usage: "Where the scan container checkpoints the scan: s3://bucket/prefix, or a directory of the container kept on the instance.",
+}
+
+var taskFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:     "file, f",
+		Usage:    "Task definition file in JSON or YAML",
+		Required: true,
+	},
+	&cli.IntFlag{
+		Name:  "task-timeout, tt",
+		Usage: "Task timeout (in minutes), stop everything after that.",
+		Value: 120,
+	},
+	checkpointFlag,
+}
+
+var logGroupFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "log-group, l",
+		Value: "netz-runner",
+		Usage: "Cloudwatch Log Group Name to write logs to",
+	},
+	&cli.IntFlag{
+		Name:  "log-retention-days",
+		Usage: "Retention (in days) of the log group when netz creates it, 0 keeps the logs forever.",
+	},
+	&cli.StringFlag{
+		Name:  "log-kms-key-id",
+		Usage: "KMS key ARN to encrypt the log group with when netz creates it.",
+	},
+}
+
+var teardownFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "delete-log-streams",
+		Usage: "Delete the log streams of the tasks of the run when destroying its resources, the local logs are kept.",
+	},
+}
+
+var doctorFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "include",
+		Value: massconfigure.DefaultInclude,
+		Usage: "Regex of the interfaces to use as adapters.",
+	},
+	&cli.StringFlag{
+		Name:  "exclude",
+		Usage: "Regex of the interfaces to leave out.",
+	},
+	&cli.StringFlag{
+		Name:  "management",
+		Usage: "Interface kept for management (SSH), it's never an adapter.",
+	},
+	&cli.BoolFlag{
+		Name:  "no-zc",
+		Usage: "Don't open the adapters bound to a PF_RING ZC driver with ZC.",
+	},
+	&cli.IntFlag{
+		Name:  "rate",
+		Value: masscan.DefaultRate,
+		Usage: "Rate in packets per second to check against the adapters.",
+	},
+	&cli.BoolFlag{
+		Name:  "json",
+		Usage: "Print the report as JSON.",
+	},
+}
+
+var logFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "live-tail",
+		Usage: "Stream logs with CloudWatch Logs live tail instead of polling, falls back to polling when unavailable.",
+	},
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "netz"
 	app.Usage = "netz cloud runner"
-	app.UsageText = "netz [options]"
+	app.UsageText = "netz [options] command [command options] [run-id]"
 	app.Version = Version
 
 	app.Flags = []cli.Flag{
 		&cli.BoolFlag{
 			Name:  "debug",
-			Usage: "Show debugging information",
+			Usage: "Show debugging information, same as --log-level debug",
 		},
 		&cli.StringFlag{
-			Name:     "file, f",
-			Usage:    "Task definition file in JSON or YAML",
-			Required: true,
+			Name:  "log-level",
+			Value: "info",
+			Usage: "Log level: trace, debug, info, warn or error",
 		},
 		&cli.StringFlag{
-			Name:  "cluster, c",
-			Value: "netz",
-			Usage: "ECS cluster name",
+			Name:  "log-format",
+			Value: log.FormatText,
+			Usage: "Log format: text or json",
 		},
 		&cli.StringFlag{
-			Name:  "log-group, l",
-			Value: "netz-runner",
-			Usage: "Cloudwatch Log Group Name to write logs to",
-		},
-		&cli.StringSliceFlag{
-			Name:     "security-group",
-			Usage:    "Security groups to launch task. Can be specified multiple times",
-			Required: true,
+			Name:  "log-file",
+			Usage: "File to append netz's log messages to, in addition to the output directory of the run",
 		},
-		&cli.StringSliceFlag{
-			Name:     "subnet",
-			Usage:    "Subnet to launch task.",
-			Required: true,
+		&cli.StringFlag{
+			Name:  "state-dir",
+			Value: cloud.DefaultStateDir(),
+			Usage: "Directory to keep run state in",
 		},
 		&cli.StringFlag{
-			Name:     "region, r",
-			Usage:    "AWS Region",
-			Required: true,
+			Name:  "output-dir",
+			Value: cloud.DefaultOutputDir(),
+			Usage: "Directory to keep the container and netz logs of every run in",
 		},
-		&cli.IntFlag{
-			Name:     "number-of-nic, o",
-			Usage:    "Number of network interfaces to create and attach to instance.",
-			Required: true,
+	}
+
+	app.Before = func(ctx *cli.Context) error {
+		level := ctx.String("log-level")
+		if ctx.Bool("debug") && !ctx.IsSet("log-level") {
+			level = "debug"
+		}
+		if err := log.SetLogger(level, ctx.String("log-format")); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if ctx.String("log-format") == log.FormatText {
+			fmt.Println()
+		}
+		if path := ctx.String("log-file"); path != "" {
+			if err := log.AddFile(path); err != nil {
+				return cli.NewExitError(err, 1)
+			}
+		}
+		return nil
+	}
+
+	app.Commands = []*cli.Command{
+		{
+			Name:   "up",
+			Usage:  "Create cloud resources and save them as a new run",
+			Flags:  append(append([]cli.Flag{checkpointFlag}, resourceFlags...), logGroupFlags...),
+			Action: upAction,
 		},
-		&cli.StringFlag{
-			Name:     "instance-type, t",
-			Usage:    "Instance type.",
-			Required: true,
+		{
+			Name:      "run",
+			Usage:     "Run a task on the resources of a run and stream its logs",
+			ArgsUsage: "[run-id]",
+			Flags: append(append(append([]cli.Flag{
+				&cli.StringFlag{
+					Name:  "resume",
+					Usage: "Resume the interrupted scan of the run with the given id from its checkpoint, with the same seed and shard, that run or a previous one",
+				},
+			}, taskFlags...), logGroupFlags...), logFlags...),
+			Action: runAction,
 		},
-		&cli.StringFlag{
-			Name:     "instance-key-name, k",
-			Usage:    "Instance key name to for ssh.",
-			Required: true,
+		{
+			Name:      "logs",
+			Usage:     "Print the logs of a run kept locally, then stream the missing ones of its last task",
+			ArgsUsage: "[run-id]",
+			Flags: append([]cli.Flag{
+				&cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Only print the logs kept locally",
+				},
+			}, logFlags...),
+			Action: logsAction,
 		},
-		&cli.StringFlag{
-			Name:  "role-name, rn",
-			Value: "netzRole",
-			Usage: "Role name for netz.",
+		{
+			Name:      "down",
+			Usage:     "Destroy the cloud resources of a run",
+			ArgsUsage: "[run-id]",
+			Flags:     teardownFlags,
+			Action:    downAction,
 		},
-		&cli.StringFlag{
-			Name:  "role-policy-name, rp",
-			Value: "netzPolicy",
-			Usage: "Role policy name for netz.",
+		{
+			Name:   "all",
+			Usage:  "Create resources, run a task and destroy everything when done",
+			Flags:  append(append(append(append(append([]cli.Flag{}, resourceFlags...), taskFlags...), logGroupFlags...), logFlags...), teardownFlags...),
+			Action: allAction,
 		},
-		&cli.StringFlag{
-			Name:  "instance-profile-name, i",
-			Value: "netzInstanceProfile",
-			Usage: "Instance profile name to attach to instance.",
+		{
+			Name:   "doctor",
+			Usage:  "Check the NICs of this host the way the scan container configures masscan",
+			Flags:  doctorFlags,
+			Action: doctorAction,
 		},
-		&cli.IntFlag{
-			Name:  "task-timeout, tt",
-			Usage: "Task timeout (in minutes), stop everything after that.",
-			Value: 120,
+		{
+			Name:      "annotate",
+			Usage:     "Write a note to the audit stream of a run",
+			ArgsUsage: "[run-id] message",
+			Action:    annotateAction,
 		},
-		&cli.BoolFlag{
-			Name:  "skip-destroy, sd",
-			Value: false,
-			Usage: "Skip destroy of cloud resources when done.",
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// cloudOptions makes the cloud package log to netz's loggers
+func cloudOptions() []cloud.Option {
+	return []cloud.Option{
+		cloud.WithLogger(cloud.NewLogrusLogger(log.Logger)),
+		cloud.WithContainerLogger(cloud.NewLogrusLogger(log.Container)),
+	}
+}
+
+func stateStore(ctx *cli.Context) *cloud.StateStore {
+	return &cloud.StateStore{Dir: ctx.String("state-dir")}
+}
+
+// loadState loads the run given as the first argument, or the latest run
+func loadState(ctx *cli.Context) (*cloud.RunState, error) {
+	store := stateStore(ctx)
+	if id := ctx.Args().First(); id != "" {
+		return store.Load(id)
+	}
+	return store.Latest()
+}
+
+// logToRunFile writes netz's own log messages to the output directory of the
+// run, every message has the run id
+func logToRunFile(ctx *cli.Context, runID string) {
+	log.SetField("run_id", runID)
+
+	dir := cloud.RunOutputDir(ctx.String("output-dir"), runID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Logger.Errorf("failed to create output directory of run %s: %s", runID, err.Error())
+		return
+	}
+	if err := log.AddFile(filepath.Join(dir, cloud.NetzLogFile)); err != nil {
+		log.Logger.Errorf("failed to open log file of run %s: %s", runID, err.Error())
+	}
+}
+
+func containerLogPath(ctx *cli.Context, runID string) string {
+	return filepath.Join(cloud.RunOutputDir(ctx.String("output-dir"), runID), cloud.ContainerLogFile)
+}
+
+func checkTaskFlags(ctx *cli.Context) error {
+	if _, err := os.Stat(ctx.String("file")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return checkLogGroupFlags(ctx)
+}
+
+func checkLogGroupFlags(ctx *cli.Context) error {
+	if err := cloud.CheckLogRetentionDays(ctx.Int("log-retention-days")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return nil
+}
+
+// openRunLog opens the audit stream of the run, markers are skipped when it
+// can't be opened
+func openRunLog(ctx *cli.Context, runID string, logGroup string, region string) *cloud.RunLog {
+	runLog := cloud.NewRunLog(runID, logGroup, region, cloudOptions()...)
+	runLog.LogRetentionDays = ctx.Int("log-retention-days")
+	runLog.LogKMSKeyID = ctx.String("log-kms-key-id")
+	if err := runLog.Open(context.Background()); err != nil {
+		log.Logger.Warnf("failed to open audit stream of run %s, markers are not written: %s", runID, err.Error())
+		return nil
+	}
+	return runLog
+}
+
+// mark writes a marker to the audit stream of the run
+func mark(runLog *cloud.RunLog, marker string, message string, data interface{}) {
+	if runLog == nil {
+		return
+	}
+	if err := runLog.Mark(context.Background(), marker, message, data); err != nil {
+		log.Logger.Warnf("failed to write %s marker: %s", marker, err.Error())
+	}
+}
+
+// commandConfig returns the values of every flag of the command
+func commandConfig(ctx *cli.Context) map[string]interface{} {
+	config := map[string]interface{}{
+		"command": ctx.Command.Name,
+		"version": Version,
+	}
+	for _, flag := range ctx.Command.Flags {
+		name := flag.Names()[0]
+		if name == "help" {
+			continue
+		}
+		switch value := ctx.Value(name).(type) {
+		case *cli.StringSlice:
+			config[name] = value.Value()
+		case time.Duration:
+			config[name] = value.String()
+		default:
+			config[name] = value
+		}
+	}
+	return config
+}
+
+// destroyResources destroys the resources of the run between destroy markers
+func destroyResources(runLog *cloud.RunLog, skipDestroy bool) {
+	if skipDestroy {
+		resourceManager.DestroyResources(skipDestroy)
+		return
+	}
+	mark(runLog, cloud.MarkerDestroyStarted, "", resourceManager.Resources())
+	resourceManager.DestroyResources(skipDestroy)
+	// the resources left are the ones that failed to be destroyed
+	mark(runLog, cloud.MarkerDestroyFinished, "", resourceManager.Resources())
+}
+
+// newResourceManager returns the resource manager of the resource flags for
+// the run
+func newResourceManager(ctx *cli.Context, runID string) *cloud.AWSResourceManager {
+	rm := cloud.NewResourceManager(cloudOptions()...)
+	rm.Waiter.Timeout = ctx.Duration("wait-timeout")
+	rm.Waiter.MaxDelay = ctx.Duration("wait-max-delay")
+	rm.IPv6 = ctx.Bool("ipv6")
+	rm.Checkpoint = ctx.String("checkpoint")
+	rm.RunID = runID
+	return rm
+}
+
+// instanceTypes returns the instance types of the flag in order, a value can
+// have a few of them comma separated
+func instanceTypes(ctx *cli.Context) []string {
+	return splitList(ctx.StringSlice("instance-type"))
+}
+
+// splitList splits the comma separated values, leaving out empty ones
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+func createResources(ctx *cli.Context) error {
+	return resourceManager.CreateResources(context.Background(), ctx.String("region"), ctx.Int("number-of-nic"), instanceTypes(ctx), ctx.String("instance-key-name"), ctx.StringSlice("security-group")[0], ctx.StringSlice("subnet"), ctx.String("role-name"), ctx.String("role-policy-name"), ctx.String("instance-profile-name"), ctx.String("cluster"))
+}
+
+// deleteLogStreams deletes the log streams of the tasks when asked to
+func deleteLogStreams(ctx *cli.Context, region string, tasks []*cloud.Task) {
+	if !ctx.Bool("delete-log-streams") || len(tasks) == 0 {
+		return
+	}
+	runner := cloud.NewRunner(cloudOptions()...)
+	if region != "" {
+		runner.Region = region
+	}
+	if err := runner.DeleteLogStreams(context.Background(), tasks...); err != nil {
+		log.Logger.Error(err.Error())
+	}
+}
+
+// destroyOnSignal destroys the resources of the run when interrupted
+func destroyOnSignal(runLog *cloud.RunLog, skipDestroy bool, onDestroyed func()) {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+
+	go func() {
+		<-quit
+		log.Component("signal").Warn("signal caught, exiting...")
+		if resourceManager != nil {
+			destroyResources(runLog, skipDestroy)
+		}
+		onDestroyed()
+		os.Exit(0)
+	}()
+}
+
+// cancelOnSignal cancels the returned context when interrupted, leaving the
+// resources of the run in place
+func cancelOnSignal() (context.Context, context.CancelFunc) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+
+	go func() {
+		select {
+		case <-quit:
+			log.Component("signal").Warn("signal caught, exiting...")
+			cancelFn()
+		case <-ctx.Done():
+		}
+		signal.Stop(quit)
+	}()
+
+	return ctx, cancelFn
+}
+
+func upAction(ctx *cli.Context) error {
+	if err := checkLogGroupFlags(ctx); err != nil {
+		return err
+	}
+
+	store := stateStore(ctx)
+	state := cloud.NewRunState()
+	state.SkipDestroy = ctx.Bool("skip-destroy")
+	state.LogGroupName = ctx.String("log-group")
+	state.CheckpointURL = ctx.String("checkpoint")
+	logToRunFile(ctx, state.ID)
+
+	runLog := openRunLog(ctx, state.ID, state.LogGroupName, ctx.String("region"))
+	mark(runLog, cloud.MarkerRunStarted, "", commandConfig(ctx))
+
+	saveOrRemove := func() {
+		// resourceManager is nil until the resource manager is created
+		if resourceManager != nil {
+			state.Resources = resourceManager.Resources()
+		}
+		if state.Resources.Empty() {
+			store.Remove(state.ID)
+			return
+		}
+		if err := store.Save(state); err != nil {
+			log.Logger.Errorf("failed to save state of run %s: %s", state.ID, err.Error())
+		}
+	}
+	// the resource manager is set before the signal can read it
+	resourceManager = newResourceManager(ctx, state.ID)
+	destroyOnSignal(runLog, state.SkipDestroy, saveOrRemove)
+
+	err := createResources(ctx)
+	if err != nil {
+		log.Logger.Error(err.Error())
+		destroyResources(runLog, state.SkipDestroy)
+		saveOrRemove()
+		os.Exit(1)
+	}
+
+	state.Resources = resourceManager.Resources()
+	mark(runLog, cloud.MarkerResourcesCreated, "", state.Resources)
+	if err := store.Save(state); err != nil {
+		return err
+	}
+
+	log.Logger.Infof("resources of run %s are up, use `netz run %s` to run a task", state.ID, state.ID)
+	fmt.Println(state.ID)
+	return nil
+}
+
+func runAction(ctx *cli.Context) error {
+	if err := checkTaskFlags(ctx); err != nil {
+		return err
+	}
+
+	// the state of the resumed run is gone once its resources are destroyed
+	resume := ctx.String("resume")
+	var resumed *cloud.RunState
+	if resume != "" {
+		resumed, _ = stateStore(ctx).Load(resume)
+	}
+	var state *cloud.RunState
+	var err error
+	if ctx.Args().First() == "" && resumed != nil {
+		state = resumed
+	} else {
+		state, err = loadState(ctx)
+	}
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	logToRunFile(ctx, state.ID)
+
+	checkpoint, err := checkpointLocation(ctx, state)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if resume != "" {
+		if err := checkResume(state, checkpoint, resume, resumed); err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
+
+	if state.LogGroupName == "" {
+		state.LogGroupName = ctx.String("log-group")
+	}
+
+	runCtx, cancelFn := cancelOnSignal()
+	defer cancelFn()
+
+	config := scan.Config{
+		RunID:              state.ID,
+		TaskDefinitionFile: ctx.String("file"),
+		TaskTimeout:        ctx.Int("task-timeout"),
+		Checkpoint:         checkpoint,
+		Resume:             resume,
+		LogGroupName:       state.LogGroupName,
+		LogRetentionDays:   ctx.Int("log-retention-days"),
+		LogKMSKeyID:        ctx.String("log-kms-key-id"),
+		LiveTail:           ctx.Bool("live-tail"),
+		OutputDir:          ctx.String("output-dir"),
+		Logger:             cloud.NewLogrusLogger(log.Logger),
+		OnLogEvent: func(event cloud.LoggedEvent) {
+			log.Container.Info(event.Message)
 		},
 	}
+	result, err := scan.RunTask(runCtx, config, state.Resources, func(task *cloud.Task) {
+		state.Tasks = append(state.Tasks, task)
+		if err := stateStore(ctx).Save(state); err != nil {
+			log.Logger.Errorf("failed to save state of run %s: %s", state.ID, err.Error())
+		}
+	})
+	if result != nil && result.Task != nil {
+		// the stopped task and the exit codes of its containers
+		if err := stateStore(ctx).Save(state); err != nil {
+			log.Logger.Errorf("failed to save state of run %s: %s", state.ID, err.Error())
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return nil
+}
+
+// checkpointLocation returns where the task of the run checkpoints its scan,
+// the location of the run unless the flag is set. The role of the instance
+// can only reach the S3 location of the run
+func checkpointLocation(ctx *cli.Context, state *cloud.RunState) (string, error) {
+	location := ctx.String("checkpoint")
+	if !ctx.IsSet("checkpoint") && state.CheckpointURL != "" {
+		location = state.CheckpointURL
+	}
+	if strings.HasPrefix(location, "s3://") && state.CheckpointURL != "" && location != state.CheckpointURL {
+		return "", fmt.Errorf("the instance role of run %s can only reach the checkpoints in %s, not %s", state.ID, state.CheckpointURL, location)
+	}
+	return location, nil
+}
+
+// checkResume checks the checkpoint of the resumed run is where the task of
+// the run can resume it, resumed is the state of that run when it's kept
+func checkResume(state *cloud.RunState, location string, resume string, resumed *cloud.RunState) error {
+	if resumed != nil && resumed.CheckpointURL != "" && resumed.CheckpointURL != location {
+		return fmt.Errorf("run %s checkpointed its scan in %s, run %s checkpoints in %s", resume, resumed.CheckpointURL, state.ID, location)
+	}
+	if !strings.HasPrefix(location, "s3://") {
+		// the checkpoints are on the instance, the container checks them
+		if resume != state.ID {
+			return fmt.Errorf("the checkpoint of run %s is kept on its instance, checkpoint to S3 to resume a scan on new resources", resume)
+		}
+		return nil
+	}
 
-	app.Action = func(ctx *cli.Context) error {
-		fmt.Println()
+	store, err := agent.NewRunCheckpointStore(location, resume)
+	if err != nil {
+		return err
+	}
+	found, err := agent.HasCheckpoint(context.Background(), store)
+	if err != nil {
+		return fmt.Errorf("failed to read the checkpoint of run %s: %s", resume, err.Error())
+	}
+	if !found {
+		return fmt.Errorf("run %s has no checkpoint in %s", resume, location)
+	}
+	return nil
+}
 
-		if _, err := os.Stat(ctx.String("file")); err != nil {
+func logsAction(ctx *cli.Context) error {
+	state, err := loadState(ctx)
+	runID := ctx.Args().First()
+	if err != nil {
+		// the state of a destroyed run is gone, its local logs are not
+		if runID == "" {
 			return cli.NewExitError(err, 1)
 		}
+		log.Logger.Debugf("%s, printing local logs only", err.Error())
+	} else {
+		runID = state.ID
+	}
+
+	path := containerLogPath(ctx, runID)
+	err = cloud.ReadContainerLog(path, func(event cloud.LoggedEvent) {
+		fmt.Printf("[%s] %s\n", event.Time().Local().Format("2006-01-02 15:04:05"), event.Message)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return cli.NewExitError(err, 1)
+	}
+	if state == nil || ctx.Bool("offline") {
+		return nil
+	}
+
+	if len(state.Tasks) == 0 {
+		return cli.NewExitError(fmt.Sprintf("run %s has no tasks", state.ID), 1)
+	}
 
-		log.SetLogger(ctx.Bool("debug"))
+	containerLog, err := cloud.OpenContainerLog(path)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer containerLog.Close()
 
-		runner := cloud.NewRunner()
-		runner.TaskDefinitionFile = ctx.String("file")
-		runner.Cluster = ctx.String("cluster")
-		runner.LogGroupName = ctx.String("log-group")
-		runner.SecurityGroups = ctx.StringSlice("security-group")
-		runner.Subnets = ctx.StringSlice("subnet")
-		runner.NumOfNic = ctx.Int("number-of-nic")
-		runner.InstanceType = ctx.String("instance-type")
-		runner.KeyName = ctx.String("instance-key-name")
-		runner.RoleName = ctx.String("role-name")
-		runner.RolePolicyName = ctx.String("role-policy-name")
-		runner.InstanceProfileName = ctx.String("instance-profile-name")
-		runner.TaskTimeout = ctx.Int("task-timeout")
-		runner.SkipDestroy = ctx.Bool("skip-destroy")
+	runCtx, cancelFn := cancelOnSignal()
+	defer cancelFn()
 
-		if runner.Region == "" {
-			runner.Region = ctx.String("region")
+	runner := cloud.NewRunner(cloudOptions()...)
+	runner.Cluster = state.Resources.Cluster
+	runner.Region = state.Resources.Region
+	runner.LiveTail = ctx.Bool("live-tail")
+	runner.ContainerLog = containerLog
+
+	// the events every task logged since the container log was last written,
+	// the last task is followed until it stops
+	for i, task := range state.Tasks {
+		watch := runner.WatchLogs(runCtx, task)
+		if i < len(state.Tasks)-1 || !task.StoppedAt.IsZero() {
+			watch.Drain()
+			if runCtx.Err() != nil {
+				return nil
+			}
+			continue
 		}
+		if err := runner.WaitTask(runCtx, task, 0); err != nil {
+			watch.Stop()
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return cli.NewExitError(err, 1)
+		}
+		watch.Drain()
+	}
+	return nil
+}
 
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, os.Interrupt)
+func downAction(ctx *cli.Context) error {
+	state, err := loadState(ctx)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	logToRunFile(ctx, state.ID)
 
-		go func(destroyResources bool) {
-			<-quit
-			log.Logger.Warn("signal caught, exiting...")
-			resourceManager.DestroyResources(destroyResources)
-			os.Exit(0)
-		}(runner.SkipDestroy)
+	var runLog *cloud.RunLog
+	if state.LogGroupName != "" {
+		runLog = openRunLog(ctx, state.ID, state.LogGroupName, state.Resources.Region)
+	}
+
+	resourceManager = cloud.NewResourceManagerFromResources(state.Resources, cloudOptions()...)
+	destroyResources(runLog, false)
+	deleteLogStreams(ctx, state.Resources.Region, state.Tasks)
+
+	state.Resources = resourceManager.Resources()
+	if state.Resources.Empty() {
+		return stateStore(ctx).Remove(state.ID)
+	}
+	log.Logger.Warnf("some resources of run %s are left, run `netz down %s` again", state.ID, state.ID)
+	return stateStore(ctx).Save(state)
+}
+
+func allAction(ctx *cli.Context) error {
+	if err := checkTaskFlags(ctx); err != nil {
+		return err
+	}
+
+	// a one shot run is only saved when its resources are left, its id names
+	// its output directory and its audit stream
+	runID := cloud.NewRunState().ID
+	logToRunFile(ctx, runID)
+	log.Logger.Infof("logs of run %s are kept in %s", runID, cloud.RunOutputDir(ctx.String("output-dir"), runID))
+
+	waiter := cloud.DefaultWaiterConfig()
+	waiter.Timeout = ctx.Duration("wait-timeout")
+	waiter.MaxDelay = ctx.Duration("wait-max-delay")
+
+	config := scan.Config{
+		RunID:               runID,
+		Region:              ctx.String("region"),
+		Cluster:             ctx.String("cluster"),
+		SecurityGroups:      ctx.StringSlice("security-group"),
+		Subnets:             ctx.StringSlice("subnet"),
+		NumOfNic:            ctx.Int("number-of-nic"),
+		InstanceTypes:       instanceTypes(ctx),
+		KeyName:             ctx.String("instance-key-name"),
+		RoleName:            ctx.String("role-name"),
+		RolePolicyName:      ctx.String("role-policy-name"),
+		InstanceProfileName: ctx.String("instance-profile-name"),
+		Waiter:              waiter,
+		IPv6:                ctx.Bool("ipv6"),
+		TaskDefinitionFile:  ctx.String("file"),
+		TaskTimeout:         ctx.Int("task-timeout"),
+		Checkpoint:          ctx.String("checkpoint"),
+		LogGroupName:        ctx.String("log-group"),
+		LogRetentionDays:    ctx.Int("log-retention-days"),
+		LogKMSKeyID:         ctx.String("log-kms-key-id"),
+		LiveTail:            ctx.Bool("live-tail"),
+		OutputDir:           ctx.String("output-dir"),
+		SkipDestroy:         ctx.Bool("skip-destroy"),
+		DeleteLogStreams:    ctx.Bool("delete-log-streams"),
+		Logger:              cloud.NewLogrusLogger(log.Logger),
+		OnLogEvent: func(event cloud.LoggedEvent) {
+			log.Container.Info(event.Message)
+		},
+	}
+
+	runCtx, cancelFn := cancelOnSignal()
+	defer cancelFn()
+
+	result, err := scan.Scan(runCtx, config)
+	if result != nil && !result.Remaining.Empty() {
+		saveRemaining(ctx, config, result)
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
 
-		resourceManager = cloud.NewResourceManager()
-		err := resourceManager.CreateResources(runner.Region, runner.NumOfNic, runner.InstanceType, runner.KeyName, runner.SecurityGroups[0], runner.Subnets[0], runner.RoleName, runner.RolePolicyName, runner.InstanceProfileName, runner.Cluster)
+	timings := result.Timings
+	log.Logger.Infof("run %s took %v, the task ran for %v", result.RunID,
+		timings.Finished.Sub(timings.Started).Round(time.Second), timings.TaskStopped.Sub(timings.TaskStarted).Round(time.Second))
+	if result.Remaining.InstanceID != "" {
+		for _, file := range result.ResultFiles() {
+			log.Logger.Infof("results were written to %s on instance %s", file, result.Remaining.InstanceID)
+		}
+	} else if result.ContainerLog != "" {
+		// the result files went with the instance
+		log.Logger.Infof("the results printed by the task are in %s", result.ContainerLog)
+	}
+	if !result.Succeeded() {
+		log.Logger.Warnf("task of run %s didn't succeed", result.RunID)
+	}
+	return nil
+}
+
+// saveRemaining saves the run of all with the resources it left, kept or
+// failed to be destroyed, so run, logs and down take them
+func saveRemaining(ctx *cli.Context, config scan.Config, result *scan.Result) {
+	state := &cloud.RunState{
+		ID:            result.RunID,
+		CreatedAt:     result.Timings.Started,
+		SkipDestroy:   config.SkipDestroy,
+		LogGroupName:  config.LogGroupName,
+		CheckpointURL: config.Checkpoint,
+		Resources:     result.Remaining,
+	}
+	if result.Task != nil {
+		state.Tasks = []*cloud.Task{result.Task}
+	}
+	if err := stateStore(ctx).Save(state); err != nil {
+		log.Logger.Errorf("failed to save state of run %s: %s", state.ID, err.Error())
+		return
+	}
+	log.Logger.Infof("resources of run %s are left, use `netz down %s` to destroy them", state.ID, state.ID)
+}
+
+func annotateAction(ctx *cli.Context) error {
+	var state *cloud.RunState
+	var err error
+	switch ctx.NArg() {
+	case 1:
+		state, err = stateStore(ctx).Latest()
+	case 2:
+		state, err = stateStore(ctx).Load(ctx.Args().First())
+	default:
+		return cli.NewExitError("usage: netz annotate [run-id] message", 1)
+	}
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if state.LogGroupName == "" {
+		return cli.NewExitError(fmt.Sprintf("run %s has no audit stream", state.ID), 1)
+	}
+
+	runLog := cloud.NewRunLog(state.ID, state.LogGroupName, state.Resources.Region, cloudOptions()...)
+	if err := runLog.Open(context.Background()); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if err := runLog.Mark(context.Background(), cloud.MarkerNote, ctx.Args().Get(ctx.NArg()-1), nil); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	log.Logger.Infof("note written to %s of log group %s", cloud.RunLogStream(state.ID), state.LogGroupName)
+	return nil
+}
+
+func doctorAction(ctx *cli.Context) error {
+	opts := massconfigure.DefaultOptions()
+	opts.Management = ctx.String("management")
+	opts.ZC = !ctx.Bool("no-zc")
+	var err error
+	if opts.Include, err = compileFlag(ctx, "include"); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if opts.Exclude, err = compileFlag(ctx, "exclude"); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	report, err := massconfigure.Discover(massconfigure.SystemSources(), opts)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	conf := masscan.Config{
+		Adapters: massconfigure.MasscanAdapters(report.Adapters),
+		Rate:     ctx.Int("rate"),
+	}
+	if ctx.Int("rate") > conf.MaxRate() {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("rate %d is above %d, the line rate of the adapters", ctx.Int("rate"), conf.MaxRate()))
+	}
+
+	if ctx.Bool("json") {
+		body, err := json.MarshalIndent(report, "", "  ")
 		if err != nil {
-			log.Logger.Error(err.Error())
-			resourceManager.DestroyResources(runner.SkipDestroy)
-			os.Exit(1)
+			return cli.NewExitError(err, 1)
 		}
+		fmt.Println(string(body))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INTERFACE\tUP\tMAC\tADDRESSES")
+	for _, link := range report.Links {
+		var addrs []string
+		for _, addr := range link.Addrs {
+			addrs = append(addrs, addr.String())
+		}
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", link.Name, link.Up, link.MAC, strings.Join(addrs, ","))
+	}
+	w.Flush()
+	fmt.Println()
 
-		if err := runner.Run(context.Background(), runner.TaskTimeout); err != nil {
-			if ec, ok := err.(cli.ExitCoder); ok {
-				return ec
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADAPTER\tIP\tIPV6\tGATEWAY\tROUTER MAC\tZC")
+	for _, a := range report.Adapters {
+		zc := "no"
+		if a.ZC {
+			zc = "yes, licensed"
+			if a.ZCLicense != nil && !*a.ZCLicense {
+				zc = "yes, demo mode"
 			}
-			log.Logger.Error(err.Error())
-			resourceManager.DestroyResources(runner.SkipDestroy)
-			os.Exit(1)
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", a.ConfName(), a.IP, a.IPv6, a.Gateway, a.RouterMAC, zc)
+	}
+	w.Flush()
 
-		resourceManager.DestroyResources(runner.SkipDestroy)
-		return nil
+	for _, warning := range report.Warnings {
+		log.Logger.Warnf("%s", warning)
 	}
+	return nil
+}
 
-	err := app.Run(os.Args)
+// compileFlag compiles the regex of a flag, nil when it's empty
+func compileFlag(ctx *cli.Context, name string) (*regexp.Regexp, error) {
+	if ctx.String(name) == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(ctx.String(name))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("invalid %s regex: %s", name, err.Error())
 	}
+	return re, nil
 }
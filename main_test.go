@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cmpxchg16/netz/cloud"
+	"github.com/urfave/cli/v2"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{values: nil, want: "[]"},
+		{values: []string{"c5n.9xlarge"}, want: "[c5n.9xlarge]"},
+		{values: []string{"c5n.9xlarge,c4.8xlarge"}, want: "[c5n.9xlarge c4.8xlarge]"},
+		{values: []string{"c5n.9xlarge, c4.8xlarge,", "m5.large"}, want: "[c5n.9xlarge c4.8xlarge m5.large]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(splitList(tt.values)); got != tt.want {
+			t.Errorf("splitList(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestInstanceTypesFlag(t *testing.T) {
+	var got []string
+	app := &cli.App{
+		Flags: []cli.Flag{resourceFlag(t, "instance-type")},
+		Action: func(ctx *cli.Context) error {
+			got = instanceTypes(ctx)
+			return nil
+		},
+	}
+	err := app.Run([]string{"netz", "--instance-type", "c5n.9xlarge,c4.8xlarge", "--instance-type", "m5.large"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[c5n.9xlarge c4.8xlarge m5.large]" {
+		t.Errorf("got instance types %q", got)
+	}
+}
+
+func TestCheckpointLocation(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		args  []string
+		want  string
+		err   string
+	}{
+		{name: "default", want: cloud.DefaultCheckpointLocation},
+		{name: "flag", args: []string{"--checkpoint", "s3://bucket/netz"}, want: "s3://bucket/netz"},
+		{name: "run", state: "s3://bucket/netz", want: "s3://bucket/netz"},
+		{name: "same as the run", state: "s3://bucket/netz", args: []string{"--checkpoint", "s3://bucket/netz"}, want: "s3://bucket/netz"},
+		{name: "on the instance", state: "s3://bucket/netz", args: []string{"--checkpoint", "/opt/results/checkpoints"}, want: "/opt/results/checkpoints"},
+		{name: "out of reach of the role", state: "s3://bucket/netz", args: []string{"--checkpoint", "s3://other/netz"}, err: "can only reach the checkpoints in s3://bucket/netz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var err error
+			app := &cli.App{
+				Flags: []cli.Flag{checkpointFlag},
+				Action: func(ctx *cli.Context) error {
+					got, err = checkpointLocation(ctx, &cloud.RunState{ID: "run-2", CheckpointURL: tt.state})
+					return nil
+				},
+			}
+			if err := app.Run(append([]string{"netz"}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			case tt.err == "" && (err != nil || got != tt.want):
+				t.Errorf("got location %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResume(t *testing.T) {
+	state := &cloud.RunState{ID: "run-2", CheckpointURL: "s3://bucket/netz"}
+	tests := []struct {
+		name     string
+		location string
+		resume   string
+		resumed  *cloud.RunState
+		err      string
+	}{
+		{name: "itself on the instance", location: cloud.DefaultCheckpointLocation, resume: "run-2"},
+		{name: "another run on the instance", location: cloud.DefaultCheckpointLocation, resume: "run-1", err: "the checkpoint of run run-1 is kept on its instance"},
+		{
+			name:     "another location",
+			location: "s3://bucket/netz",
+			resume:   "run-1",
+			resumed:  &cloud.RunState{ID: "run-1", CheckpointURL: "s3://other/netz"},
+			err:      "run run-1 checkpointed its scan in s3://other/netz, run run-2 checkpoints in s3://bucket/netz",
+		},
+	}
+	for _, tt := range tests {
+		err := checkResume(state, tt.location, tt.resume, tt.resumed)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: got error %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// resourceFlag returns the flag of the resource flags with the name
+func resourceFlag(t *testing.T, name string) cli.Flag {
+	for _, flag := range resourceFlags {
+		for _, n := range flag.Names() {
+			if n == name {
+				return flag
+			}
+		}
+	}
+	t.Fatalf("no resource flag %s", name)
+	return nil
+}
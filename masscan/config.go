@@ -0,0 +1,379 @@
+// Package masscan models a masscan configuration and renders it as the file
+// masscan reads with -c
+package masscan
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxRatePerAdapter is the line rate of a 10gbps NIC in packets per
+	// second, with the smallest frames
+	MaxRatePerAdapter = 14880000
+
+	DefaultRate    = 10000000
+	DefaultExclude = "255.255.255.255"
+)
+
+// OutputFormats are the output formats of masscan
+var OutputFormats = []string{"list", "json", "ndjson", "xml", "binary", "grepable", "unicornscan", "certs", "hostonly"}
+
+// Adapter is a NIC masscan sends from, the router MAC is resolved by masscan
+// when empty. IP is its IPv4 address and IPv6 its IPv6 address, the adapter
+// only sends to the targets of the families it has an address of
+type Adapter struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	IPv6      string `json:"ipv6,omitempty"`
+	MAC       string `json:"mac"`
+	RouterMAC string `json:"router_mac,omitempty"`
+}
+
+// Shard is the part of the scan this config runs, ID is 1 based
+type Shard struct {
+	ID    int `json:"id"`
+	Total int `json:"total"`
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%d/%d", s.ID, s.Total)
+}
+
+// ParseShard parses a shard written as "id/total", like masscan's --shard
+func ParseShard(s string) (Shard, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Shard{}, fmt.Errorf("invalid shard %q, must be id/total", s)
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard %q, must be id/total", s)
+	}
+	total, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Shard{}, fmt.Errorf("invalid shard %q, must be id/total", s)
+	}
+	return Shard{ID: id, Total: total}, nil
+}
+
+// ParsePaused returns the resume-index of a paused.conf, which masscan writes
+// when it's interrupted
+func ParsePaused(paused []byte) (uint64, error) {
+	for _, line := range strings.Split(string(paused), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "resume-index" {
+			continue
+		}
+		index, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid resume-index %q", strings.TrimSpace(parts[1]))
+		}
+		return index, nil
+	}
+	return 0, errors.New("no resume-index in paused.conf")
+}
+
+// Config is a complete masscan configuration
+type Config struct {
+	Adapters []Adapter `json:"adapters"`
+	// Rate is in packets per second
+	Rate int `json:"rate"`
+	// Ports is a masscan port list, such as "80,443,8000-8100,U:53"
+	Ports  string   `json:"ports"`
+	Ranges []string `json:"ranges"`
+	// IncludeFiles are files of targets, such as IPv6 hitlists, scanned
+	// with the ranges
+	IncludeFiles []string `json:"include_files,omitempty"`
+	Excludes     []string `json:"excludes,omitempty"`
+	ExcludeFile  string   `json:"exclude_file,omitempty"`
+	// OutputFormat and OutputFilename write the results to a file, masscan
+	// prints them when they aren't set
+	OutputFormat   string `json:"output_format,omitempty"`
+	OutputFilename string `json:"output_filename,omitempty"`
+	// Seed randomizes the order of the scan, masscan picks one when it's 0.
+	// The shards of a scan must have the same seed
+	Seed    int64  `json:"seed,omitempty"`
+	Shard   *Shard `json:"shard,omitempty"`
+	Retries int    `json:"retries,omitempty"`
+	// ResumeIndex is where an interrupted scan continues, from the
+	// resume-index of its paused.conf. The scan must have the same targets,
+	// ports, seed and shard
+	ResumeIndex uint64 `json:"resume_index,omitempty"`
+}
+
+// NewConfig returns a config with the rate and excludes discover.sh used
+func NewConfig() *Config {
+	return &Config{
+		Rate:     DefaultRate,
+		Excludes: []string{DefaultExclude},
+	}
+}
+
+// MaxRate is the highest rate the adapters of the config can send at
+func (c *Config) MaxRate() int {
+	nics := len(c.Adapters)
+	if nics == 0 {
+		nics = 1
+	}
+	return nics * MaxRatePerAdapter
+}
+
+// Validate returns an error when masscan can't run the config
+func (c *Config) Validate() error {
+	indices := make(map[int]string)
+	for _, adapter := range c.Adapters {
+		if adapter.Index < 0 {
+			return fmt.Errorf("adapter %s has a negative index", adapter.Name)
+		}
+		if other, ok := indices[adapter.Index]; ok {
+			return fmt.Errorf("adapters %s and %s have the same index %d", other, adapter.Name, adapter.Index)
+		}
+		indices[adapter.Index] = adapter.Name
+
+		if adapter.Name == "" {
+			return fmt.Errorf("adapter %d has no name", adapter.Index)
+		}
+		if ip := net.ParseIP(adapter.IP); adapter.IP != "" && (ip == nil || ip.To4() == nil) {
+			return fmt.Errorf("adapter %s has an invalid ip %q", adapter.Name, adapter.IP)
+		}
+		if ip := net.ParseIP(adapter.IPv6); adapter.IPv6 != "" && (ip == nil || ip.To4() != nil) {
+			return fmt.Errorf("adapter %s has an invalid ipv6 %q", adapter.Name, adapter.IPv6)
+		}
+		for _, mac := range []string{adapter.MAC, adapter.RouterMAC} {
+			if _, err := net.ParseMAC(mac); mac != "" && err != nil {
+				return fmt.Errorf("adapter %s has an invalid mac %q", adapter.Name, mac)
+			}
+		}
+	}
+
+	if c.Rate < 1 || c.Rate > c.MaxRate() {
+		return fmt.Errorf("rate %d is out of bounds, must be between 1 and %d for %d adapters", c.Rate, c.MaxRate(), len(c.Adapters))
+	}
+	if err := checkPorts(c.Ports); err != nil {
+		return err
+	}
+	if len(c.Ranges) == 0 && len(c.IncludeFiles) == 0 {
+		return errors.New("a range or an include file to scan is required")
+	}
+	for _, r := range c.Ranges {
+		if err := checkRange(r); err != nil {
+			return err
+		}
+		if isIPv6Range(r) && len(c.Adapters) > 0 && !c.hasIPv6() {
+			return fmt.Errorf("range %s is IPv6 but no adapter has an IPv6 address", r)
+		}
+	}
+	for _, file := range c.IncludeFiles {
+		if err := checkFile("include", file); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Excludes {
+		if err := checkRange(r); err != nil {
+			return err
+		}
+	}
+	if c.ExcludeFile != "" {
+		if err := checkFile("exclude", c.ExcludeFile); err != nil {
+			return err
+		}
+	}
+
+	if c.OutputFormat != "" && !contains(OutputFormats, c.OutputFormat) {
+		return fmt.Errorf("unknown output format %q, must be one of %s", c.OutputFormat, strings.Join(OutputFormats, ", "))
+	}
+	if c.OutputFilename != "" && c.OutputFormat == "" {
+		return errors.New("output filename needs an output format")
+	}
+	if c.Shard != nil && (c.Shard.Total < 1 || c.Shard.ID < 1 || c.Shard.ID > c.Shard.Total) {
+		return fmt.Errorf("invalid shard %s, id must be between 1 and total", c.Shard)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	return nil
+}
+
+func (c *Config) hasIPv6() bool {
+	for _, adapter := range c.Adapters {
+		if adapter.IPv6 != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func checkFile(name string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s file: %s", name, err.Error())
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s file %s is a directory", name, path)
+	}
+	return nil
+}
+
+// checkPorts checks a masscan port list
+func checkPorts(ports string) error {
+	if ports == "" {
+		return errors.New("ports to scan are required")
+	}
+	for _, port := range strings.Split(ports, ",") {
+		spec := strings.TrimSpace(port)
+		for _, proto := range []string{"T:", "U:", "S:"} {
+			spec = strings.TrimPrefix(spec, proto)
+		}
+		var bounds []int
+		for _, bound := range strings.SplitN(spec, "-", 2) {
+			n, err := strconv.Atoi(bound)
+			if err != nil || n < 0 || n > 65535 {
+				return fmt.Errorf("invalid port %q", port)
+			}
+			bounds = append(bounds, n)
+		}
+		if len(bounds) == 2 && bounds[0] > bounds[1] {
+			return fmt.Errorf("invalid port range %q", port)
+		}
+	}
+	return nil
+}
+
+// checkRange checks a masscan range: an address, a CIDR or first-last, IPv6
+// addresses may be in brackets
+func checkRange(r string) error {
+	if _, _, err := net.ParseCIDR(unbracket(r)); err == nil {
+		return nil
+	}
+	bounds := strings.SplitN(r, "-", 2)
+	for _, bound := range bounds {
+		if net.ParseIP(unbracket(strings.TrimSpace(bound))) == nil {
+			return fmt.Errorf("invalid range %q", r)
+		}
+	}
+	return nil
+}
+
+// isIPv6Range reports whether a valid range is of IPv6 addresses
+func isIPv6Range(r string) bool {
+	return strings.Contains(r, ":")
+}
+
+// unbracket removes the brackets around an IPv6 address, "[2001:db8::1]" or
+// "[2001:db8::]/32"
+func unbracket(s string) string {
+	if !strings.HasPrefix(s, "[") {
+		return s
+	}
+	end := strings.Index(s, "]")
+	if end < 0 {
+		return s
+	}
+	return s[1:end] + s[end+1:]
+}
+
+func unbracketAll(ranges []string) []string {
+	var out []string
+	for _, r := range ranges {
+		bounds := strings.SplitN(r, "-", 2)
+		for i := range bounds {
+			bounds[i] = unbracket(strings.TrimSpace(bounds[i]))
+		}
+		out = append(out, strings.Join(bounds, "-"))
+	}
+	return out
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTo writes the config in the format of masscan's -c, it doesn't
+// validate the config
+func (c *Config) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	line := func(key string, value interface{}) {
+		fmt.Fprintf(&b, "%s = %v\n", key, value)
+	}
+
+	for _, adapter := range c.Adapters {
+		i := adapter.Index
+		line(fmt.Sprintf("adapter[%d]", i), adapter.Name)
+		if adapter.IP != "" {
+			line(fmt.Sprintf("adapter-ip[%d]", i), adapter.IP)
+		}
+		if adapter.IPv6 != "" {
+			line(fmt.Sprintf("adapter-ip[%d]", i), adapter.IPv6)
+		}
+		if adapter.MAC != "" {
+			line(fmt.Sprintf("adapter-mac[%d]", i), adapter.MAC)
+		}
+		if adapter.RouterMAC != "" {
+			line(fmt.Sprintf("router-mac[%d]", i), adapter.RouterMAC)
+		}
+	}
+
+	line("rate", c.Rate)
+	line("ports", c.Ports)
+	if len(c.Ranges) > 0 {
+		line("range", strings.Join(unbracketAll(c.Ranges), ","))
+	}
+	for _, file := range c.IncludeFiles {
+		line("includefile", file)
+	}
+	if len(c.Excludes) > 0 {
+		line("exclude", strings.Join(unbracketAll(c.Excludes), ","))
+	}
+	if c.ExcludeFile != "" {
+		line("excludefile", c.ExcludeFile)
+	}
+	if c.OutputFormat != "" {
+		line("output-format", c.OutputFormat)
+	}
+	if c.OutputFilename != "" {
+		line("output-filename", c.OutputFilename)
+	}
+	if c.Seed != 0 {
+		line("seed", c.Seed)
+	}
+	if c.Shard != nil {
+		line("shard", c.Shard)
+	}
+	if c.Retries > 0 {
+		line("retries", c.Retries)
+	}
+	if c.ResumeIndex > 0 {
+		line("resume-index", c.ResumeIndex)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// String renders the config
+func (c *Config) String() string {
+	var b strings.Builder
+	c.WriteTo(&b)
+	return b.String()
+}
+
+// WriteFile validates the config and writes it to the file
+func (c *Config) WriteFile(path string) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(c.String()), 0644)
+}
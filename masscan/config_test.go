@@ -0,0 +1,200 @@
+package masscan
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+func validConfig() *Config {
+	conf := NewConfig()
+	conf.Adapters = []Adapter{
+		{Index: 0, Name: "eth0", IP: "10.0.1.10", MAC: "0a:00:00:00:00:01", RouterMAC: "0a:00:00:00:01:01"},
+		{Index: 1, Name: "eth1", IP: "10.0.2.10", IPv6: "2600:1f18::10", MAC: "0a:00:00:00:00:02"},
+	}
+	conf.Ports = "80,443,8000-8100,U:53"
+	conf.Ranges = []string{"0.0.0.0/0"}
+	return conf
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "targets.txt")
+	if err := ioutil.WriteFile(file, []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "no adapters", modify: func(c *Config) { c.Adapters = nil; c.Rate = MaxRatePerAdapter }},
+		{name: "same index", modify: func(c *Config) { c.Adapters[1].Index = 0 }, err: "adapters eth0 and eth1 have the same index 0"},
+		{name: "negative index", modify: func(c *Config) { c.Adapters[1].Index = -1 }, err: "negative index"},
+		{name: "no name", modify: func(c *Config) { c.Adapters[1].Name = "" }, err: "adapter 1 has no name"},
+		{name: "ipv6 as ip", modify: func(c *Config) { c.Adapters[0].IP = "2600:1f18::1" }, err: "invalid ip"},
+		{name: "ipv4 as ipv6", modify: func(c *Config) { c.Adapters[1].IPv6 = "10.0.2.11" }, err: "invalid ipv6"},
+		{name: "invalid mac", modify: func(c *Config) { c.Adapters[0].RouterMAC = "router" }, err: "invalid mac"},
+		{name: "rate of every adapter", modify: func(c *Config) { c.Rate = 2 * MaxRatePerAdapter }},
+		{name: "rate above the adapters", modify: func(c *Config) { c.Rate = 2*MaxRatePerAdapter + 1 }, err: "rate 29760001 is out of bounds, must be between 1 and 29760000 for 2 adapters"},
+		{name: "rate above one nic", modify: func(c *Config) { c.Adapters = nil; c.Rate = MaxRatePerAdapter + 1 }, err: "out of bounds"},
+		{name: "zero rate", modify: func(c *Config) { c.Rate = 0 }, err: "out of bounds"},
+		{name: "no ports", modify: func(c *Config) { c.Ports = "" }, err: "ports to scan are required"},
+		{name: "invalid port", modify: func(c *Config) { c.Ports = "80,http" }, err: `invalid port "http"`},
+		{name: "port out of range", modify: func(c *Config) { c.Ports = "65536" }, err: "invalid port"},
+		{name: "reversed port range", modify: func(c *Config) { c.Ports = "100-80" }, err: "invalid port range"},
+		{name: "no targets", modify: func(c *Config) { c.Ranges = nil }, err: "a range or an include file"},
+		{name: "ranges", modify: func(c *Config) {
+			c.Ranges = []string{"10.0.0.1", "10.0.0.0-10.0.0.255", "[2600:1f18::]/32", "2600:1f18::1-2600:1f18::ff"}
+		}},
+		{name: "invalid range", modify: func(c *Config) { c.Ranges = []string{"10.0.0.0/33"} }, err: `invalid range "10.0.0.0/33"`},
+		{name: "ipv6 range without ipv6 adapter", modify: func(c *Config) { c.Adapters[1].IPv6 = ""; c.Ranges = []string{"2600:1f18::/32"} }, err: "no adapter has an IPv6 address"},
+		{name: "include file", modify: func(c *Config) { c.Ranges = nil; c.IncludeFiles = []string{file} }},
+		{name: "missing include file", modify: func(c *Config) { c.IncludeFiles = []string{filepath.Join(dir, "missing")} }, err: "include file:"},
+		{name: "include directory", modify: func(c *Config) { c.IncludeFiles = []string{dir} }, err: "is a directory"},
+		{name: "invalid exclude", modify: func(c *Config) { c.Excludes = []string{"localhost"} }, err: `invalid range "localhost"`},
+		{name: "missing exclude file", modify: func(c *Config) { c.ExcludeFile = filepath.Join(dir, "missing") }, err: "exclude file:"},
+		{name: "unknown output format", modify: func(c *Config) { c.OutputFormat = "csv" }, err: `unknown output format "csv"`},
+		{name: "output filename without format", modify: func(c *Config) { c.OutputFilename = "out.json" }, err: "needs an output format"},
+		{name: "shard", modify: func(c *Config) { c.Shard = &Shard{ID: 2, Total: 2} }},
+		{name: "shard above total", modify: func(c *Config) { c.Shard = &Shard{ID: 3, Total: 2} }, err: "invalid shard 3/2"},
+		{name: "zero shard", modify: func(c *Config) { c.Shard = &Shard{ID: 0, Total: 2} }, err: "invalid shard 0/2"},
+		{name: "negative retries", modify: func(c *Config) { c.Retries = -1 }, err: "retries must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := validConfig()
+			tt.modify(conf)
+			err := conf.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		shard string
+		want  Shard
+		err   bool
+	}{
+		{shard: "1/1", want: Shard{ID: 1, Total: 1}},
+		{shard: "3/16", want: Shard{ID: 3, Total: 16}},
+		{shard: "3", err: true},
+		{shard: "a/2", err: true},
+		{shard: "1/b", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseShard(tt.shard)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseShard(%q) got error %v", tt.shard, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseShard(%q) = %v, want %v", tt.shard, got, tt.want)
+		}
+		if !tt.err && got.String() != tt.shard {
+			t.Errorf("shard %q is written as %q", tt.shard, got.String())
+		}
+	}
+}
+
+func TestParsePaused(t *testing.T) {
+	tests := []struct {
+		name   string
+		paused string
+		want   uint64
+		err    string
+	}{
+		{
+			name:   "masscan",
+			paused: "# masscan paused.conf\nrate = 10000000.00\nrandomize-hosts = true\nseed = 1234\nshard = 1/2\nresume-index = 123456789\nports = 80\n",
+			want:   123456789,
+		},
+		{name: "no spaces", paused: "resume-index=42", want: 42},
+		{name: "no index", paused: "rate = 100\nports = 80\n", err: "no resume-index"},
+		{name: "invalid index", paused: "resume-index = -1\n", err: `invalid resume-index "-1"`},
+	}
+	for _, tt := range tests {
+		got, err := ParsePaused([]byte(tt.paused))
+		switch {
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: got error %v", tt.name, err)
+		case got != tt.want:
+			t.Errorf("%s: got resume-index %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// the config of a resumed scan has the resume-index its paused.conf had
+func TestPausedRoundTrip(t *testing.T) {
+	conf := validConfig()
+	conf.Seed = 1234
+	conf.Shard = &Shard{ID: 1, Total: 2}
+	conf.ResumeIndex = 987654321
+
+	index, err := ParsePaused([]byte(conf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != conf.ResumeIndex {
+		t.Errorf("got resume-index %d, want %d", index, conf.ResumeIndex)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	conf := validConfig()
+	conf.Ranges = []string{"10.0.0.0/8", "[2600:1f18::]/32", "[2600:1f18::1]-[2600:1f18::ff]"}
+	conf.Excludes = append(conf.Excludes, "10.1.0.0/16")
+	conf.OutputFormat = "json"
+	conf.OutputFilename = "/opt/out/masscan.json"
+	conf.Seed = 1234
+	conf.Shard = &Shard{ID: 2, Total: 4}
+	conf.Retries = 2
+
+	path := filepath.Join(t.TempDir(), "masscan.conf")
+	if err := conf.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "config.golden")
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// an invalid config isn't written
+	conf.Rate = 0
+	invalid := filepath.Join(t.TempDir(), "invalid.conf")
+	if err := conf.WriteFile(invalid); err == nil {
+		t.Error("wrote an invalid config")
+	}
+	if _, err := os.Stat(invalid); !os.IsNotExist(err) {
+		t.Errorf("invalid config file: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package massconfigure
+
+import (
+	"net"
+	"syscall"
+)
+
+// triggerARP makes the kernel resolve the ip on the interface, by sending a
+// datagram to it through the interface
+func triggerARP(ip net.IP, device string) error {
+	dialer := net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := dialer.Dial("udp4", net.JoinHostPort(ip.String(), "9"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte{0})
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package massconfigure
+
+import (
+	"errors"
+	"net"
+)
+
+// triggerARP needs SO_BINDTODEVICE, which only linux has
+func triggerARP(ip net.IP, device string) error {
+	return errors.New("resolving a neighbour on an interface is only supported on linux")
+}
@@ -0,0 +1,289 @@
+// Package massconfigure discovers the NICs masscan sends from: the interfaces
+// to use, their addresses, the MAC of their router and whether they run
+// PF_RING ZC. The host is read through Sources, so the same discovery runs in
+// the scan container, on the operator's host and against fake tables
+package massconfigure
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+const (
+	DefaultInclude = "^(eth|ens)"
+
+	defaultARPRetries  = 10
+	defaultARPInterval = 300 * time.Millisecond
+)
+
+// Options choose the interfaces that are adapters
+type Options struct {
+	// Include and Exclude are regexes of interface names, every interface is
+	// included when Include is nil
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+	// Management is the interface kept for SSH, it's never an adapter
+	Management string
+	// ZC opens the adapters bound to a PF_RING ZC driver with ZC
+	ZC bool
+
+	// ARPRetries and ARPInterval are how long a router that isn't in the
+	// neighbour table is waited for
+	ARPRetries  int
+	ARPInterval time.Duration
+}
+
+// DefaultOptions returns the options massconfigure runs with by default
+func DefaultOptions() Options {
+	return Options{
+		Include:     regexp.MustCompile(DefaultInclude),
+		ZC:          true,
+		ARPRetries:  defaultARPRetries,
+		ARPInterval: defaultARPInterval,
+	}
+}
+
+// Adapter is an interface masscan sends from
+type Adapter struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	IPv6      string `json:"ipv6,omitempty"`
+	MAC       string `json:"mac"`
+	Gateway   string `json:"gateway,omitempty"`
+	RouterMAC string `json:"router_mac,omitempty"`
+	// ZC is set when masscan opens the adapter with PF_RING ZC
+	ZC        bool  `json:"zc"`
+	ZCLicense *bool `json:"zc_license,omitempty"`
+}
+
+// ConfName is the name of the adapter in the masscan config
+func (a Adapter) ConfName() string {
+	if a.ZC {
+		return "zc:" + a.Name
+	}
+	return a.Name
+}
+
+// MasscanAdapters returns the adapters of a masscan config
+func MasscanAdapters(adapters []Adapter) []masscan.Adapter {
+	conf := []masscan.Adapter{}
+	for _, a := range adapters {
+		conf = append(conf, masscan.Adapter{
+			Index:     a.Index,
+			Name:      a.ConfName(),
+			IP:        a.IP,
+			IPv6:      a.IPv6,
+			MAC:       a.MAC,
+			RouterMAC: a.RouterMAC,
+		})
+	}
+	return conf
+}
+
+// Report is what was discovered, the warnings are about adapters that
+// masscan can use but not as well as it could
+type Report struct {
+	Links    []Link    `json:"-"`
+	Adapters []Adapter `json:"adapters"`
+	Warnings []string  `json:"warnings,omitempty"`
+}
+
+func (r *Report) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Discover returns the interfaces that are up, have an IPv4 or a global IPv6
+// address and are chosen by the options, with the MAC of their IPv4 router
+func Discover(src Sources, opts Options) (*Report, error) {
+	links, err := src.Links.Links()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Links: links, Adapters: []Adapter{}}
+
+	routes, err := src.Routes.DefaultRoutes()
+	if err != nil {
+		report.warnf("failed to read routes: %s", err.Error())
+	}
+	gateways := defaultGateways(routes)
+
+	for _, link := range links {
+		if !link.Up || link.Loopback || !opts.match(link.Name) {
+			continue
+		}
+		ipnet := ipv4(link)
+		ipv6net := ipv6(link)
+		if ipnet == nil && ipv6net == nil {
+			continue
+		}
+
+		a := Adapter{
+			Index: len(report.Adapters),
+			Name:  link.Name,
+			MAC:   link.MAC.String(),
+		}
+		if ipv6net != nil {
+			a.IPv6 = ipv6net.IP.String()
+		}
+		if ipnet == nil {
+			// the IPv6 router is resolved by masscan with neighbour discovery
+			report.Adapters = append(report.Adapters, a)
+			continue
+		}
+		a.IP = ipnet.IP.String()
+
+		// without a router mac masscan resolves the router itself
+		gateway := gatewayOf(link.Name, ipnet, gateways)
+		if gateway == nil {
+			report.warnf("no gateway found for %s", link.Name)
+		} else {
+			a.Gateway = gateway.String()
+			if routerMAC, err := routerMAC(src.Neighbours, gateway, link.Name, opts); err != nil {
+				report.warnf("no router mac for %s: %s", link.Name, err.Error())
+			} else {
+				a.RouterMAC = routerMAC.String()
+			}
+		}
+		report.Adapters = append(report.Adapters, a)
+	}
+
+	if len(report.Adapters) == 0 {
+		report.warnf("no interface matched, masscan picks its own adapter")
+	}
+	if opts.ZC && src.PFRing != nil {
+		setZC(report, src.PFRing, opts.Management, gateways)
+	}
+	return report, nil
+}
+
+func (o Options) match(name string) bool {
+	if name == o.Management {
+		return false
+	}
+	if o.Exclude != nil && o.Exclude.MatchString(name) {
+		return false
+	}
+	return o.Include == nil || o.Include.MatchString(name)
+}
+
+// ipv4 returns the first IPv4 address of the link
+func ipv4(link Link) *net.IPNet {
+	for _, ipnet := range link.Addrs {
+		if !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet
+		}
+	}
+	return nil
+}
+
+// ipv6 returns the first global IPv6 address of the link, link local and
+// unique local addresses can't reach the targets
+func ipv6(link Link) *net.IPNet {
+	for _, ipnet := range link.Addrs {
+		if ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() && !ipnet.IP.IsPrivate() {
+			return ipnet
+		}
+	}
+	return nil
+}
+
+// defaultGateways returns the default route with the lowest metric of every
+// interface
+func defaultGateways(routes []Route) map[string]Route {
+	gateways := make(map[string]Route)
+	for _, r := range routes {
+		if g, ok := gateways[r.Iface]; !ok || r.Metric < g.Metric {
+			gateways[r.Iface] = r
+		}
+	}
+	return gateways
+}
+
+// gatewayOf returns the gateway of the interface: its own default route, a
+// default gateway of another interface inside its subnet, or the first
+// address of its subnet which is the router of a VPC subnet
+func gatewayOf(name string, ipnet *net.IPNet, gateways map[string]Route) net.IP {
+	if r, ok := gateways[name]; ok {
+		return r.Gateway
+	}
+	for _, r := range gateways {
+		if ipnet.Contains(r.Gateway) {
+			return r.Gateway
+		}
+	}
+
+	network := ipnet.IP.Mask(ipnet.Mask).To4()
+	if network == nil {
+		return nil
+	}
+	gateway := make(net.IP, 4)
+	binary.BigEndian.PutUint32(gateway, binary.BigEndian.Uint32(network)+1)
+	return gateway
+}
+
+// routerMAC returns the hardware address of the gateway on the interface,
+// resolving it when the neighbour table doesn't have it
+func routerMAC(neighbours NeighbourTable, gateway net.IP, device string, opts Options) (net.HardwareAddr, error) {
+	mac, err := neighbours.Lookup(gateway, device)
+	if err != nil || mac != nil {
+		return mac, err
+	}
+
+	if err := neighbours.Resolve(gateway, device); err != nil {
+		return nil, fmt.Errorf("failed to trigger arp of %s on %s: %s", gateway, device, err.Error())
+	}
+	for i := 0; i < opts.ARPRetries; i++ {
+		time.Sleep(opts.ARPInterval)
+		mac, err = neighbours.Lookup(gateway, device)
+		if err != nil || mac != nil {
+			return mac, err
+		}
+	}
+	return nil, fmt.Errorf("%s didn't answer arp on %s", gateway, device)
+}
+
+// primaryInterface returns the interface of the default route with the lowest
+// metric, which is the one SSH comes in through
+func primaryInterface(gateways map[string]Route) string {
+	primary := ""
+	for name, r := range gateways {
+		if primary == "" || r.Metric < gateways[primary].Metric || (r.Metric == gateways[primary].Metric && name < primary) {
+			primary = name
+		}
+	}
+	return primary
+}
+
+// setZC opens the adapters bound to a ZC driver with ZC. ZC bypasses the
+// kernel, so without a management interface the primary interface is kept
+// off ZC to not lose SSH
+func setZC(report *Report, pfRing PFRing, management string, gateways map[string]Route) {
+	if management == "" {
+		management = primaryInterface(gateways)
+	}
+
+	for i := range report.Adapters {
+		a := &report.Adapters[i]
+		if !pfRing.IsZC(a.Name) {
+			continue
+		}
+		if a.Name == management {
+			report.warnf("%s runs PF_RING ZC but is the management interface, it's used without ZC", a.Name)
+			continue
+		}
+
+		a.ZC = true
+		mac, _ := net.ParseMAC(a.MAC)
+		licensed := pfRing.HasLicense(mac)
+		a.ZCLicense = &licensed
+		if !licensed {
+			report.warnf("no PF_RING ZC licence found for %s (%s), ZC runs in demo mode and stops after 5 minutes", a.Name, a.MAC)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package massconfigure
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/cmpxchg16/netz/masscan"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+type fakeLinks []Link
+
+func (l fakeLinks) Links() ([]Link, error) {
+	return l, nil
+}
+
+type fakeRoutes struct {
+	routes []Route
+	err    error
+}
+
+func (r fakeRoutes) DefaultRoutes() ([]Route, error) {
+	return r.routes, r.err
+}
+
+// fakeNeighbours maps "ip device" to the mac of the neighbour, the others
+// never answer arp
+type fakeNeighbours map[string]string
+
+func (n fakeNeighbours) Lookup(ip net.IP, device string) (net.HardwareAddr, error) {
+	mac, ok := n[ip.String()+" "+device]
+	if !ok {
+		return nil, nil
+	}
+	return net.ParseMAC(mac)
+}
+
+func (fakeNeighbours) Resolve(ip net.IP, device string) error {
+	return nil
+}
+
+type fakePFRing struct {
+	zc       map[string]bool
+	licensed map[string]bool
+}
+
+func (p fakePFRing) IsZC(name string) bool {
+	return p.zc[name]
+}
+
+func (p fakePFRing) HasLicense(mac net.HardwareAddr) bool {
+	return p.licensed[mac.String()]
+}
+
+func link(name string, mac string, addrs ...string) Link {
+	l := Link{Name: name, Up: true}
+	l.MAC, _ = net.ParseMAC(mac)
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			panic(err)
+		}
+		ipnet.IP = ip
+		l.Addrs = append(l.Addrs, ipnet)
+	}
+	return l
+}
+
+func route(iface string, gateway string, metric int) Route {
+	return Route{Iface: iface, Gateway: net.ParseIP(gateway).To4(), Metric: metric}
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources Sources
+	}{
+		{
+			name: "multi-nic",
+			sources: Sources{
+				Links: fakeLinks{
+					{Name: "lo", Up: true, Loopback: true},
+					link("eth0", "0a:00:00:00:00:01", "10.0.1.10/24"),
+					link("eth1", "0a:00:00:00:00:02", "10.0.2.10/24", "2600:1f18::10/64"),
+					link("eth2", "0a:00:00:00:00:03", "10.0.3.10/24"),
+					link("docker0", "02:42:00:00:00:01", "172.17.0.1/16"),
+				},
+				Routes: fakeRoutes{routes: []Route{
+					route("eth0", "10.0.1.1", 0),
+					route("eth1", "10.0.2.1", 10001),
+					route("eth2", "10.0.3.1", 10002),
+				}},
+				Neighbours: fakeNeighbours{
+					"10.0.1.1 eth0": "0a:00:00:00:01:01",
+					"10.0.2.1 eth1": "0a:00:00:00:02:01",
+					"10.0.3.1 eth2": "0a:00:00:00:03:01",
+				},
+			},
+		},
+		{
+			name: "pfring-zc",
+			sources: Sources{
+				Links: fakeLinks{
+					link("eth0", "0a:00:00:00:00:01", "10.0.1.10/24"),
+					link("eth1", "0a:00:00:00:00:02", "10.0.2.10/24"),
+					link("eth2", "0a:00:00:00:00:03", "10.0.3.10/24"),
+				},
+				Routes: fakeRoutes{routes: []Route{
+					route("eth0", "10.0.1.1", 0),
+					route("eth1", "10.0.2.1", 10001),
+					route("eth2", "10.0.3.1", 10002),
+				}},
+				Neighbours: fakeNeighbours{
+					"10.0.1.1 eth0": "0a:00:00:00:01:01",
+					"10.0.2.1 eth1": "0a:00:00:00:02:01",
+					"10.0.3.1 eth2": "0a:00:00:00:03:01",
+				},
+				// the primary interface runs ZC as well, it's kept off ZC
+				PFRing: fakePFRing{
+					zc:       map[string]bool{"eth0": true, "eth1": true, "eth2": true},
+					licensed: map[string]bool{"0a:00:00:00:00:02": true},
+				},
+			},
+		},
+		{
+			name: "missing-gateway",
+			sources: Sources{
+				Links: fakeLinks{
+					link("eth0", "0a:00:00:00:00:01", "10.0.1.10/24"),
+					link("eth1", "0a:00:00:00:00:02", "10.0.2.10/24"),
+					link("ens5", "0a:00:00:00:00:03", "2600:1f18::10/64"),
+				},
+				// no routes can be read, the routers are the first address
+				// of the subnets and eth1's never answers arp
+				Routes: fakeRoutes{err: errors.New("open /proc/net/route: no such file or directory")},
+				Neighbours: fakeNeighbours{
+					"10.0.1.1 eth0": "0a:00:00:00:01:01",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ARPRetries = 1
+			opts.ARPInterval = 0
+			opts.Exclude = regexp.MustCompile("^docker")
+			report, err := Discover(tt.sources, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf := masscan.NewConfig()
+			conf.Ports = "80,443"
+			conf.Adapters = MasscanAdapters(report.Adapters)
+			got = append(append(got, "\n\n"...), conf.String()...)
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package massconfigure
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Link is a network interface of the host
+type Link struct {
+	Name     string
+	Up       bool
+	Loopback bool
+	MAC      net.HardwareAddr
+	Addrs    []*net.IPNet
+}
+
+// Route is a default route of an interface
+type Route struct {
+	Iface   string
+	Gateway net.IP
+	Metric  int
+}
+
+// LinkSource lists the interfaces of the host
+type LinkSource interface {
+	Links() ([]Link, error)
+}
+
+// RouteTable lists the default routes of the host
+type RouteTable interface {
+	DefaultRoutes() ([]Route, error)
+}
+
+// NeighbourTable finds the hardware address of a neighbour on an interface,
+// Lookup returns nil when it isn't resolved and Resolve asks the kernel to
+// resolve it
+type NeighbourTable interface {
+	Lookup(ip net.IP, device string) (net.HardwareAddr, error)
+	Resolve(ip net.IP, device string) error
+}
+
+// PFRing tells which interfaces are bound to a PF_RING ZC driver and which
+// have a ZC licence
+type PFRing interface {
+	IsZC(name string) bool
+	HasLicense(mac net.HardwareAddr) bool
+}
+
+// Sources are what the adapters are discovered from
+type Sources struct {
+	Links      LinkSource
+	Routes     RouteTable
+	Neighbours NeighbourTable
+	PFRing     PFRing
+}
+
+// SystemSources reads the interfaces, /proc and the PF_RING files of the host
+func SystemSources() Sources {
+	return Sources{
+		Links:      NetLinks{},
+		Routes:     ProcRouteTable{Path: "/proc/net/route"},
+		Neighbours: ProcNeighbourTable{Path: "/proc/net/arp"},
+		PFRing: SysPFRing{
+			ProcDir: "/proc/net/pf_ring/dev",
+			SysDir:  "/sys/class/net",
+			ConfDir: "/etc/pf_ring",
+		},
+	}
+}
+
+// NetLinks lists the interfaces with the net package
+type NetLinks struct{}
+
+func (NetLinks) Links() ([]Link, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	links := []Link{}
+	for _, interf := range interfaces {
+		link := Link{
+			Name:     interf.Name,
+			Up:       interf.Flags&net.FlagUp != 0,
+			Loopback: interf.Flags&net.FlagLoopback != 0,
+			MAC:      interf.HardwareAddr,
+		}
+		addrs, err := interf.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get addresses of %s: %s", interf.Name, err.Error())
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				link.Addrs = append(link.Addrs, ipnet)
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+const (
+	r_Iface int = iota
+	r_Destination
+	r_Gateway
+	r_Flags
+	r_RefCnt
+	r_Use
+	r_Metric
+	r_Mask
+)
+
+const (
+	// RTF_UP and RTF_GATEWAY of the route flags
+	rtfUp      = 0x1
+	rtfGateway = 0x2
+)
+
+// ProcRouteTable reads the default routes from a file in the format of
+// /proc/net/route
+type ProcRouteTable struct {
+	Path string
+}
+
+func (t ProcRouteTable) DefaultRoutes() ([]Route, error) {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	routes := []Route{}
+	s := bufio.NewScanner(f)
+	s.Scan() // skip the field descriptions
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) <= r_Mask {
+			continue
+		}
+		if fields[r_Destination] != "00000000" || fields[r_Mask] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[r_Flags], 16, 32)
+		if err != nil || flags&(rtfUp|rtfGateway) != rtfUp|rtfGateway {
+			continue
+		}
+		gateway, err := parseHexIP(fields[r_Gateway])
+		if err != nil {
+			continue
+		}
+		metric, _ := strconv.Atoi(fields[r_Metric])
+		routes = append(routes, Route{Iface: fields[r_Iface], Gateway: gateway, Metric: metric})
+	}
+	return routes, s.Err()
+}
+
+// parseHexIP parses an address of /proc/net/route, in host byte order
+func parseHexIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
+
+const (
+	f_IPAddr int = iota
+	f_HWType
+	f_Flags
+	f_HWAddr
+	f_Mask
+	f_Device
+)
+
+// ATF_COM of the arp flags, the entry is resolved
+const atfComplete = 0x2
+
+// ProcNeighbourTable reads the neighbours from a file in the format of
+// /proc/net/arp, and resolves them by sending to them
+type ProcNeighbourTable struct {
+	Path string
+}
+
+func (t ProcNeighbourTable) Lookup(ip net.IP, device string) (net.HardwareAddr, error) {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Scan() // skip the field descriptions
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) <= f_Device {
+			continue
+		}
+		if fields[f_Device] != device || !net.ParseIP(fields[f_IPAddr]).Equal(ip) {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[f_Flags], "0x"), 16, 32)
+		if err != nil || flags&atfComplete == 0 {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[f_HWAddr])
+		if err != nil || isZeroMAC(mac) {
+			continue
+		}
+		return mac, nil
+	}
+	return nil, s.Err()
+}
+
+func (ProcNeighbourTable) Resolve(ip net.IP, device string) error {
+	return triggerARP(ip, device)
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SysPFRing reads the pf_ring proc files, the driver modules in sysfs and the
+// licences of the PF_RING config dir
+type SysPFRing struct {
+	ProcDir string
+	SysDir  string
+	ConfDir string
+}
+
+// IsZC reports whether the pf_ring proc files or the driver module in sysfs
+// tell that the interface is bound to a ZC driver
+func (p SysPFRing) IsZC(name string) bool {
+	if info, err := ioutil.ReadFile(filepath.Join(p.ProcDir, name, "info")); err == nil {
+		for _, line := range strings.Split(string(info), "\n") {
+			if strings.HasPrefix(line, "Polling Mode:") && strings.Contains(line, "ZC") {
+				return true
+			}
+		}
+	}
+	module, err := os.Readlink(filepath.Join(p.SysDir, name, "device/driver/module"))
+	return err == nil && strings.HasSuffix(filepath.Base(module), "_zc")
+}
+
+// HasLicense reports whether a licence file named after the MAC is installed
+func (p SysPFRing) HasLicense(mac net.HardwareAddr) bool {
+	found := false
+	filepath.Walk(p.ConfDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && strings.EqualFold(info.Name(), mac.String()) {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
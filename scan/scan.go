@@ -0,0 +1,418 @@
+// Package scan runs netz scans from Go programs: it provisions the cloud
+// resources, runs the scan task, streams its logs and tears everything down,
+// the same way `netz all` does
+package scan
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cmpxchg16/netz/cloud"
+)
+
+const (
+	defaultCluster             = "netz"
+	defaultRoleName            = "netzRole"
+	defaultRolePolicyName      = "netzPolicy"
+	defaultInstanceProfileName = "netzInstanceProfile"
+	defaultLogGroupName        = "netz-runner"
+	defaultTaskTimeout         = 120
+)
+
+// Config describes a scan, zero values take the defaults of the netz command
+type Config struct {
+	// RunID names the output directory and the audit stream of the run, a
+	// new id is generated when empty
+	RunID string `json:"run_id,omitempty"`
+
+	Region              string             `json:"region"`
+	Cluster             string             `json:"cluster"`
+	SecurityGroups      []string           `json:"security_groups"`
+	Subnets             []string           `json:"subnets"`
+	NumOfNic            int                `json:"number_of_nic"`
+	InstanceTypes       []string           `json:"instance_types"`
+	KeyName             string             `json:"instance_key_name"`
+	RoleName            string             `json:"role_name"`
+	RolePolicyName      string             `json:"role_policy_name"`
+	InstanceProfileName string             `json:"instance_profile_name"`
+	Waiter              cloud.WaiterConfig `json:"waiter"`
+	// IPv6 assigns IPv6 addresses to the instance and its network interfaces
+	IPv6 bool `json:"ipv6,omitempty"`
+
+	TaskDefinitionFile string `json:"task_definition_file"`
+	// TaskTimeout is in minutes
+	TaskTimeout int `json:"task_timeout"`
+	// Checkpoint is where the scan container checkpoints the scan, see
+	// cloud.DefaultCheckpointLocation
+	Checkpoint string `json:"checkpoint,omitempty"`
+	// Resume continues the checkpointed scan of the run of the id, RunID or
+	// a previous run. Only RunTask resumes a scan
+	Resume string `json:"resume,omitempty"`
+
+	LogGroupName     string `json:"log_group"`
+	LogRetentionDays int    `json:"log_retention_days,omitempty"`
+	LogKMSKeyID      string `json:"log_kms_key_id,omitempty"`
+	LiveTail         bool   `json:"live_tail"`
+
+	// OutputDir keeps the container log of the run when set
+	OutputDir string `json:"output_dir,omitempty"`
+	// SkipDestroy leaves the cloud resources in place when done, the result
+	// files are only kept on the instance with it
+	SkipDestroy bool `json:"skip_destroy"`
+	// DeleteLogStreams deletes the log streams of the task when the
+	// resources are destroyed
+	DeleteLogStreams bool `json:"delete_log_streams"`
+
+	// Logger gets netz's own messages, nothing is logged when nil
+	Logger cloud.Logger `json:"-"`
+	// OnLogEvent is called with every log event of the task containers
+	OnLogEvent func(event cloud.LoggedEvent) `json:"-"`
+}
+
+func (c Config) withDefaults() Config {
+	if c.RunID == "" {
+		c.RunID = cloud.NewRunState().ID
+	}
+	if c.Cluster == "" {
+		c.Cluster = defaultCluster
+	}
+	if c.RoleName == "" {
+		c.RoleName = defaultRoleName
+	}
+	if c.RolePolicyName == "" {
+		c.RolePolicyName = defaultRolePolicyName
+	}
+	if c.InstanceProfileName == "" {
+		c.InstanceProfileName = defaultInstanceProfileName
+	}
+	if c.Waiter == (cloud.WaiterConfig{}) {
+		c.Waiter = cloud.DefaultWaiterConfig()
+	}
+	if c.TaskTimeout == 0 {
+		c.TaskTimeout = defaultTaskTimeout
+	}
+	if c.LogGroupName == "" {
+		c.LogGroupName = defaultLogGroupName
+	}
+	return c
+}
+
+// Validate returns an error when the config can't run a scan
+func (c Config) Validate() error {
+	switch {
+	case c.Region == "":
+		return errors.New("region is required")
+	case len(c.SecurityGroups) == 0:
+		return errors.New("a security group is required")
+	case len(c.Subnets) == 0:
+		return errors.New("a subnet is required")
+	case len(c.InstanceTypes) == 0:
+		return errors.New("an instance type is required")
+	}
+	return c.validateTask()
+}
+
+// validateTask returns an error when the config can't run a task
+func (c Config) validateTask() error {
+	if c.TaskDefinitionFile == "" {
+		return errors.New("task definition file is required")
+	}
+	if _, err := os.Stat(c.TaskDefinitionFile); err != nil {
+		return err
+	}
+	return cloud.CheckLogRetentionDays(c.LogRetentionDays)
+}
+
+// Timings are when the steps of a scan were done, zero when they weren't
+type Timings struct {
+	Started        time.Time `json:"started"`
+	ResourcesReady time.Time `json:"resources_ready,omitempty"`
+	TaskStarted    time.Time `json:"task_started,omitempty"`
+	TaskStopped    time.Time `json:"task_stopped,omitempty"`
+	Finished       time.Time `json:"finished"`
+}
+
+// Result describes a scan, it's returned as far as the scan got when it fails
+type Result struct {
+	RunID string `json:"run_id"`
+	// Resources are the cloud resources created for the scan
+	Resources cloud.Resources `json:"resources"`
+	// Remaining are the resources left after the teardown, because they are
+	// kept or failed to be destroyed
+	Remaining cloud.Resources `json:"remaining"`
+	// Task has the exit codes of the containers once it stopped
+	Task    *cloud.Task `json:"task,omitempty"`
+	Timings Timings     `json:"timings"`
+	// ContainerLog is the local file the container log is kept in
+	ContainerLog string `json:"container_log,omitempty"`
+}
+
+// Succeeded reports whether the task ran and every container exited with 0
+func (r *Result) Succeeded() bool {
+	return r.Task != nil && r.Task.Succeeded()
+}
+
+// ResultFiles returns the files the task wrote its results to on the
+// instance, nil once the instance was terminated: Scan keeps it only with
+// SkipDestroy. The results the task prints are in the container log either
+// way
+func (r *Result) ResultFiles() []string {
+	if r.Task == nil || r.Remaining.InstanceID == "" {
+		return nil
+	}
+	return r.Task.ResultFiles
+}
+
+// Scan provisions the resources, runs the task on them, streams its logs and
+// destroys the resources when the task stopped or failed. Cancelling the
+// context stops the scan and destroys the resources created so far. A task
+// whose containers exited with an error isn't an error of the scan, check
+// Result.Succeeded
+func Scan(ctx context.Context, config Config) (*Result, error) {
+	config = config.withDefaults()
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := newScan(config)
+	err := s.run(ctx)
+	s.result.Timings.Finished = time.Now().UTC()
+	return s.result, err
+}
+
+// resourceManager creates and destroys the resources of a scan
+type resourceManager interface {
+	cloud.ResourceManagerInterface
+	Resources() cloud.Resources
+}
+
+// taskRunner runs the task of a scan and streams its logs
+type taskRunner interface {
+	StartTask(ctx context.Context) (*cloud.Task, error)
+	WatchLogs(ctx context.Context, task *cloud.Task) *cloud.LogWatch
+	WaitTask(ctx context.Context, task *cloud.Task, taskTimeout int) error
+	DeleteLogStreams(ctx context.Context, tasks ...*cloud.Task) error
+}
+
+// runLog writes the markers of the audit stream of the run
+type runLog interface {
+	Open(ctx context.Context) error
+	Mark(ctx context.Context, marker string, message string, data interface{}) error
+}
+
+type scan struct {
+	config Config
+	opts   []cloud.Option
+	result *Result
+
+	// started is called with the task once it started
+	started func(task *cloud.Task)
+	// the AWS clients of the scan, the tests replace them with fakes
+	newResources func() resourceManager
+	newRunner    func() taskRunner
+	newRunLog    func() runLog
+
+	logger       cloud.Logger
+	runLog       runLog
+	containerLog *cloud.ContainerLog
+	resources    resourceManager
+}
+
+func newScan(config Config) *scan {
+	s := &scan{
+		config: config,
+		opts:   []cloud.Option{cloud.WithLogger(config.Logger)},
+		result: &Result{
+			RunID:   config.RunID,
+			Timings: Timings{Started: time.Now().UTC()},
+		},
+	}
+	s.newResources = s.awsResources
+	s.newRunner = s.awsRunner
+	s.newRunLog = s.awsRunLog
+	return s
+}
+
+func (s *scan) awsResources() resourceManager {
+	resources := cloud.NewResourceManager(s.opts...)
+	resources.Waiter = s.config.Waiter
+	resources.IPv6 = s.config.IPv6
+	resources.Checkpoint = s.config.Checkpoint
+	resources.RunID = s.config.RunID
+	return resources
+}
+
+func (s *scan) awsRunner() taskRunner {
+	runner := cloud.NewRunner(s.opts...)
+	runner.TaskDefinitionFile = s.config.TaskDefinitionFile
+	runner.Region = s.config.Region
+	runner.Cluster = s.result.Resources.Cluster
+	runner.ContainerInstance = s.result.Resources.ContainerInstanceARN
+	runner.LogGroupName = s.config.LogGroupName
+	runner.LogRetentionDays = s.config.LogRetentionDays
+	runner.LogKMSKeyID = s.config.LogKMSKeyID
+	runner.TaskTimeout = s.config.TaskTimeout
+	runner.LiveTail = s.config.LiveTail
+	runner.ContainerLog = s.containerLog
+	runner.OnLogEvent = s.config.OnLogEvent
+	runner.Environment = cloud.CheckpointEnvironment(s.config.RunID, s.config.Checkpoint, s.config.Resume)
+	return runner
+}
+
+func (s *scan) awsRunLog() runLog {
+	runLog := cloud.NewRunLog(s.config.RunID, s.config.LogGroupName, s.config.Region, s.opts...)
+	runLog.LogRetentionDays = s.config.LogRetentionDays
+	runLog.LogKMSKeyID = s.config.LogKMSKeyID
+	return runLog
+}
+
+// RunTask runs the task on the resources of a run created before, such as by
+// `netz up`, streams its logs and waits until it stops, the same way `netz
+// run` does. The resources are left in place. started is called with the
+// task once it started, when it's not nil
+func RunTask(ctx context.Context, config Config, resources cloud.Resources, started func(task *cloud.Task)) (*Result, error) {
+	config = config.withDefaults()
+	if resources.Region != "" {
+		config.Region = resources.Region
+	}
+	if err := config.validateTask(); err != nil {
+		return nil, err
+	}
+
+	s := newScan(config)
+	s.started = started
+	err := s.runOn(ctx, resources)
+	s.result.Timings.Finished = time.Now().UTC()
+	return s.result, err
+}
+
+// runOn runs the task on resources created before and leaves them in place
+func (s *scan) runOn(ctx context.Context, resources cloud.Resources) error {
+	s.result.Resources = resources
+	s.result.Remaining = resources
+	closeFn, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	return s.runTask(ctx)
+}
+
+// open sets up the logger, the container log and the audit stream of the
+// run, the returned function closes them
+func (s *scan) open(ctx context.Context) (func(), error) {
+	s.logger = cloud.NopLogger()
+	if s.config.Logger != nil {
+		s.logger = s.config.Logger.WithFields(cloud.Fields{"component": "scan", "run_id": s.config.RunID})
+	}
+
+	closeFn := func() {}
+	if s.config.OutputDir != "" {
+		path := filepath.Join(cloud.RunOutputDir(s.config.OutputDir, s.config.RunID), cloud.ContainerLogFile)
+		containerLog, err := cloud.OpenContainerLog(path)
+		if err != nil {
+			return nil, err
+		}
+		closeFn = func() { containerLog.Close() }
+		s.containerLog = containerLog
+		s.result.ContainerLog = path
+	}
+
+	s.runLog = s.newRunLog()
+	if err := s.runLog.Open(ctx); err != nil {
+		s.logger.Warnf("failed to open audit stream of run %s, markers are not written: %s", s.config.RunID, err.Error())
+		s.runLog = nil
+	}
+	return closeFn, nil
+}
+
+func (s *scan) run(ctx context.Context) error {
+	closeFn, err := s.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	s.mark(cloud.MarkerRunStarted, "", s.config)
+
+	s.resources = s.newResources()
+	err = s.resources.CreateResources(ctx, s.config.Region, s.config.NumOfNic, s.config.InstanceTypes, s.config.KeyName,
+		s.config.SecurityGroups[0], s.config.Subnets, s.config.RoleName, s.config.RolePolicyName,
+		s.config.InstanceProfileName, s.config.Cluster)
+	s.result.Resources = s.resources.Resources()
+	if err != nil {
+		s.teardown()
+		return err
+	}
+	s.result.Timings.ResourcesReady = time.Now().UTC()
+	s.mark(cloud.MarkerResourcesCreated, "", s.result.Resources)
+
+	err = s.runTask(ctx)
+	s.teardown()
+	return err
+}
+
+func (s *scan) runTask(ctx context.Context) error {
+	runner := s.newRunner()
+	if s.config.Resume != "" {
+		s.logger.Infof("resuming the scan of run %s from its checkpoint in %s", s.config.Resume, s.config.Checkpoint)
+	}
+
+	task, err := runner.StartTask(ctx)
+	if err != nil {
+		return err
+	}
+	s.result.Task = task
+	s.result.Timings.TaskStarted = task.StartedAt
+	s.mark(cloud.MarkerTaskStarted, "", task)
+	if s.started != nil {
+		s.started(task)
+	}
+
+	watch := runner.WatchLogs(ctx, task)
+	err = runner.WaitTask(ctx, task, s.config.TaskTimeout)
+	if err != nil {
+		watch.Stop()
+		if errors.Is(err, cloud.ErrWaitTimeout) {
+			s.mark(cloud.MarkerTimeout, err.Error(), task)
+		}
+		return err
+	}
+	watch.Drain()
+	s.result.Timings.TaskStopped = task.StoppedAt
+	s.mark(cloud.MarkerTaskStopped, "", task)
+	return nil
+}
+
+// teardown destroys the resources and the log streams of the task, unless
+// they are kept
+func (s *scan) teardown() {
+	if s.config.SkipDestroy {
+		s.resources.DestroyResources(true)
+		s.result.Remaining = s.resources.Resources()
+		return
+	}
+
+	s.mark(cloud.MarkerDestroyStarted, "", s.resources.Resources())
+	s.resources.DestroyResources(false)
+	s.result.Remaining = s.resources.Resources()
+	s.mark(cloud.MarkerDestroyFinished, "", s.result.Remaining)
+
+	if s.config.DeleteLogStreams && s.result.Task != nil {
+		if err := s.newRunner().DeleteLogStreams(context.Background(), s.result.Task); err != nil {
+			s.logger.Errorf("%s", err.Error())
+		}
+	}
+}
+
+// mark writes a marker to the audit stream, a cancelled scan is still marked
+func (s *scan) mark(marker string, message string, data interface{}) {
+	if s.runLog == nil {
+		return
+	}
+	if err := s.runLog.Mark(context.Background(), marker, message, data); err != nil {
+		s.logger.Warnf("failed to write %s marker: %s", marker, err.Error())
+	}
+}
@@ -0,0 +1,249 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cmpxchg16/netz/cloud"
+)
+
+// fakeResources creates the resources of created, failing with err after
+// they're created
+type fakeResources struct {
+	created   cloud.Resources
+	err       error
+	resources cloud.Resources
+	destroys  []bool
+}
+
+func (f *fakeResources) CreateResources(ctx context.Context, region string, numOfNic int, instanceTypes []string, keyName string, securityGroup string, subnetIds []string, roleName string, rolePolicyName string, instanceProfileName string, ecsCluster string) error {
+	f.resources = f.created
+	return f.err
+}
+
+func (f *fakeResources) DestroyResources(skipDestroy bool) {
+	f.destroys = append(f.destroys, skipDestroy)
+	if !skipDestroy {
+		f.resources = cloud.Resources{Region: f.resources.Region}
+	}
+}
+
+func (f *fakeResources) Resources() cloud.Resources {
+	return f.resources
+}
+
+// fakeRunner runs a task whose container exits with exitCode, or fails
+// waiting for it with waitErr
+type fakeRunner struct {
+	exitCode int64
+	startErr error
+	waitErr  error
+	deleted  []*cloud.Task
+}
+
+func (f *fakeRunner) StartTask(ctx context.Context) (*cloud.Task, error) {
+	if f.startErr != nil {
+		return nil, f.startErr
+	}
+	return &cloud.Task{
+		Containers:  []cloud.TaskContainer{{ID: "scan"}},
+		ResultFiles: []string{"/opt/out/zgrab2-scan.out"},
+		StartedAt:   time.Now().UTC(),
+	}, nil
+}
+
+func (f *fakeRunner) WatchLogs(ctx context.Context, task *cloud.Task) *cloud.LogWatch {
+	return &cloud.LogWatch{}
+}
+
+func (f *fakeRunner) WaitTask(ctx context.Context, task *cloud.Task, taskTimeout int) error {
+	if f.waitErr != nil {
+		return f.waitErr
+	}
+	task.StoppedAt = time.Now().UTC()
+	task.Containers[0].ExitCode = &f.exitCode
+	return nil
+}
+
+func (f *fakeRunner) DeleteLogStreams(ctx context.Context, tasks ...*cloud.Task) error {
+	f.deleted = append(f.deleted, tasks...)
+	return nil
+}
+
+// fakeRunLog keeps the markers written to the audit stream
+type fakeRunLog struct {
+	markers []string
+}
+
+func (f *fakeRunLog) Open(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeRunLog) Mark(ctx context.Context, marker string, message string, data interface{}) error {
+	f.markers = append(f.markers, marker)
+	return nil
+}
+
+func newFakeScan(config Config, resources *fakeResources, runner *fakeRunner, markers *fakeRunLog) *scan {
+	config.Region = "us-east-1"
+	config.SecurityGroups = []string{"sg-1"}
+	config.Subnets = []string{"subnet-1"}
+	config.InstanceTypes = []string{"c5n.9xlarge"}
+	s := newScan(config.withDefaults())
+	s.newResources = func() resourceManager { return resources }
+	s.newRunner = func() taskRunner { return runner }
+	s.newRunLog = func() runLog { return markers }
+	return s
+}
+
+var testResources = cloud.Resources{
+	Region:               "us-east-1",
+	InstanceID:           "i-1",
+	ContainerInstanceARN: "arn:aws:ecs:us-east-1:1:container-instance/1",
+	Cluster:              "netz",
+	NetworkInterfaces:    []string{"eni-1"},
+}
+
+func TestScan(t *testing.T) {
+	errCapacity := errors.New("no capacity")
+	tests := []struct {
+		name        string
+		config      Config
+		resources   *fakeResources
+		runner      *fakeRunner
+		err         error
+		succeeded   bool
+		destroys    string
+		remaining   string
+		resultFiles string
+		markers     string
+	}{
+		{
+			name:        "destroyed when done",
+			config:      Config{DeleteLogStreams: true},
+			resources:   &fakeResources{created: testResources},
+			runner:      &fakeRunner{},
+			succeeded:   true,
+			destroys:    "[false]",
+			remaining:   "",
+			resultFiles: "[]",
+			markers:     "[run_started resources_created task_started task_stopped destroy_started destroy_finished]",
+		},
+		{
+			name:        "kept when done",
+			config:      Config{SkipDestroy: true},
+			resources:   &fakeResources{created: testResources},
+			runner:      &fakeRunner{exitCode: 1},
+			destroys:    "[true]",
+			remaining:   "i-1",
+			resultFiles: "[/opt/out/zgrab2-scan.out]",
+			markers:     "[run_started resources_created task_started task_stopped]",
+		},
+		{
+			name:        "resources failed",
+			resources:   &fakeResources{created: cloud.Resources{Region: "us-east-1", Cluster: "netz"}, err: errCapacity},
+			runner:      &fakeRunner{},
+			err:         errCapacity,
+			destroys:    "[false]",
+			resultFiles: "[]",
+			markers:     "[run_started destroy_started destroy_finished]",
+		},
+		{
+			name:        "task timed out",
+			resources:   &fakeResources{created: testResources},
+			runner:      &fakeRunner{waitErr: fmt.Errorf("%w waiting for the task", cloud.ErrWaitTimeout)},
+			err:         cloud.ErrWaitTimeout,
+			destroys:    "[false]",
+			resultFiles: "[]",
+			markers:     "[run_started resources_created task_started timeout destroy_started destroy_finished]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runLog := &fakeRunLog{}
+			s := newFakeScan(tt.config, tt.resources, tt.runner, runLog)
+			err := s.run(context.Background())
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			result := s.result
+			if result.Succeeded() != tt.succeeded {
+				t.Errorf("succeeded %v, want %v", result.Succeeded(), tt.succeeded)
+			}
+			if got := fmt.Sprint(tt.resources.destroys); got != tt.destroys {
+				t.Errorf("destroyed %s, want %s", got, tt.destroys)
+			}
+			if result.Resources.Cluster != "netz" {
+				t.Errorf("result has resources %+v", result.Resources)
+			}
+			if result.Remaining.InstanceID != tt.remaining {
+				t.Errorf("instance %q remains, want %q", result.Remaining.InstanceID, tt.remaining)
+			}
+			// the result files are only returned while the instance is kept
+			if got := fmt.Sprint(result.ResultFiles()); got != tt.resultFiles {
+				t.Errorf("result files %s, want %s", got, tt.resultFiles)
+			}
+			if got := fmt.Sprint(runLog.markers); got != tt.markers {
+				t.Errorf("marked %s, want %s", got, tt.markers)
+			}
+			if tt.config.DeleteLogStreams && len(tt.runner.deleted) != 1 {
+				t.Errorf("deleted the log streams of %d tasks, want 1", len(tt.runner.deleted))
+			}
+		})
+	}
+}
+
+func TestRunTask(t *testing.T) {
+	errStart := errors.New("no container instance")
+	tests := []struct {
+		name    string
+		runner  *fakeRunner
+		err     error
+		started bool
+		markers string
+	}{
+		{
+			name:    "stopped",
+			runner:  &fakeRunner{},
+			started: true,
+			markers: "[task_started task_stopped]",
+		},
+		{
+			name:    "failed to start",
+			runner:  &fakeRunner{startErr: errStart},
+			err:     errStart,
+			markers: "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources := &fakeResources{}
+			runLog := &fakeRunLog{}
+			s := newFakeScan(Config{}, resources, tt.runner, runLog)
+			var started *cloud.Task
+			s.started = func(task *cloud.Task) { started = task }
+
+			err := s.runOn(context.Background(), testResources)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if (started != nil) != tt.started {
+				t.Errorf("started %v, want %v", started != nil, tt.started)
+			}
+			// the resources of the run are left in place
+			if len(resources.destroys) != 0 || s.result.Remaining.InstanceID != testResources.InstanceID {
+				t.Errorf("destroyed %v, %q remains", resources.destroys, s.result.Remaining.InstanceID)
+			}
+			if got := fmt.Sprint(runLog.markers); got != tt.markers {
+				t.Errorf("marked %s, want %s", got, tt.markers)
+			}
+			if tt.started && len(s.result.ResultFiles()) != 1 {
+				t.Errorf("result files %v of a kept instance", s.result.ResultFiles())
+			}
+		})
+	}
+}